@@ -15,8 +15,13 @@ import (
 	"github.com/joho/godotenv"
 
 	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/eventhooks"
 	"github.com/shitcord/backend/internal/handlers"
 	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/scanner"
+	"github.com/shitcord/backend/internal/sfu"
+	"github.com/shitcord/backend/internal/storage"
+	"github.com/shitcord/backend/internal/uploadgc"
 	"github.com/shitcord/backend/internal/ws"
 )
 
@@ -38,31 +43,81 @@ func main() {
 	}
 	log.Println("✓ Database migrated")
 
+	// Set up upload storage
+	if err := storage.Init(); err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
+	log.Println("✓ Storage ready")
+
+	// Set up malware scanning of uploads
+	if err := scanner.Init(); err != nil {
+		log.Fatalf("Failed to set up upload scanner: %v", err)
+	}
+
+	// Relay voice channels through the server if the SFU is on
+	if err := sfu.Init(); err != nil {
+		log.Fatalf("Failed to set up voice SFU: %v", err)
+	}
+	if sfu.Enabled() {
+		log.Println("✓ Voice SFU enabled")
+	}
+
 	// Initialize WebSocket hub
 	hub := ws.NewHub()
 	go hub.Run()
 	log.Println("✓ WebSocket hub started")
 
-	// Create Fiber app
+	// Hard-delete disappearing messages once they expire
+	go handlers.RunMessageReaper()
+
+	// Post scheduled messages when they're due
+	go handlers.RunMessageScheduler()
+
+	// Post results for polls once voting closes
+	go handlers.RunPollFinalizer()
+
+	// Discard resumable uploads that were abandoned
+	go handlers.RunUploadSessionReaper()
+
+	// Deliver queued event hook payloads
+	go eventhooks.NewDispatcher().Run()
+
+	// Delete uploads nothing refers to any more
+	go uploadgc.NewCollector().Run()
+
+	// Create Fiber app. Request bodies are streamed so resumable upload chunks aren't held in
+	// memory; the body limit is enforced by middleware for every other route.
+	bodyLimit := 50 * 1024 * 1024 // 50MB
 	app := fiber.New(fiber.Config{
-		AppName:   "Shitcord API v1.0",
-		BodyLimit: 50 * 1024 * 1024, // 50MB
+		AppName:                      "Shitcord API v1.0",
+		BodyLimit:                    bodyLimit,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
 	})
 
 	// Global middleware
 	app.Use(recover.New())
+	app.Use(middleware.BodyLimit(bodyLimit, func(c *fiber.Ctx) bool {
+		return c.Method() == fiber.MethodPatch && strings.HasPrefix(c.Path(), "/api/v1/upload/resumable/")
+	}))
 	app.Use(logger.New(logger.Config{
 		Format: "${time} | ${status} | ${latency} | ${method} ${path}\n",
 	}))
 	app.Use(cors.New(cors.Config{
+		// Only preflights are answered here; other OPTIONS requests, like tus discovery, reach their routes
+		Next: func(c *fiber.Ctx) bool {
+			return c.Method() == fiber.MethodOptions && c.Get(fiber.HeaderAccessControlRequestMethod) == ""
+		},
 		AllowOrigins:     getEnv("ALLOWED_ORIGINS", "http://localhost:5173"),
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
-		AllowMethods:     "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset",
+		AllowMethods:     "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS",
+		ExposeHeaders:    "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires",
 		AllowCredentials: true,
 	}))
 
-	// Static file serving for uploads
-	app.Static("/uploads", "./uploads")
+	// Uploaded files, served from the storage driver and checked against the attachment's
+	// channel unless they are avatars or icons
+	app.Get("/uploads/*", middleware.OptionalAuth(), handlers.ServeUpload)
 
 	// API routes
 	api := app.Group("/api/v1")
@@ -76,12 +131,22 @@ func main() {
 		})
 	})
 
+	// tus clients may discover the resumable upload endpoint without credentials
+	api.Options("/upload/resumable", handlers.ResumableUploadOptions)
+
 	// Auth routes (public)
 	auth := api.Group("/auth")
 	auth.Post("/register", handlers.Register)
 	auth.Post("/login", handlers.Login)
 	auth.Post("/refresh", handlers.RefreshToken)
 
+	// Webhook execution (public, authenticated by the token in the URL)
+	api.Post("/webhooks/:webhookId/:token", handlers.ExecuteWebhook)
+
+	// Interaction responses (public, authenticated by the interaction token)
+	api.Post("/interactions/:interactionId/:token/callback", handlers.RespondToInteraction)
+	api.Post("/interactions/:interactionId/:token/followup", handlers.FollowUpInteraction)
+
 	// Protected routes
 	protected := api.Group("/", middleware.AuthRequired())
 
@@ -91,6 +156,9 @@ func main() {
 	users.Put("/me", handlers.UpdateCurrentUser)
 	users.Get("/me/keys", handlers.GetMyPublicKeys)
 	users.Post("/me/keys", handlers.UploadPublicKey)
+	users.Get("/me/storage", handlers.GetMyStorage)
+	users.Get("/me/mentions", handlers.GetMyMentions)
+	users.Delete("/me/mentions/:mentionId", handlers.DeleteMyMention)
 	users.Get("/:id", handlers.GetUser)
 	users.Get("/:id/keys", handlers.GetUserPublicKeys)
 
@@ -105,8 +173,20 @@ func main() {
 	servers.Post("/:serverId/leave", handlers.LeaveServer)
 	servers.Get("/:serverId/members", handlers.GetServerMembers)
 	servers.Delete("/:serverId/members/:userId", handlers.KickMember)
+	servers.Patch("/:serverId/voice/:userId", handlers.ModerateVoiceMember)
+	servers.Delete("/:serverId/voice/:userId", handlers.DisconnectVoiceMember)
 	servers.Post("/:serverId/invite", handlers.CreateInvite)
 	servers.Post("/join/:code", handlers.JoinByInvite)
+	servers.Post("/:serverId/event-subscriptions", handlers.CreateEventSubscription)
+	servers.Get("/:serverId/event-subscriptions", handlers.GetEventSubscriptions)
+	servers.Put("/:serverId/event-subscriptions/:subscriptionId", handlers.UpdateEventSubscription)
+	servers.Delete("/:serverId/event-subscriptions/:subscriptionId", handlers.DeleteEventSubscription)
+	servers.Post("/:serverId/event-subscriptions/:subscriptionId/rotate-secret", handlers.RotateEventSubscriptionSecret)
+	servers.Get("/:serverId/event-subscriptions/:subscriptionId/deliveries", handlers.GetEventDeliveries)
+	servers.Post("/:serverId/commands", handlers.CreateCommand)
+	servers.Get("/:serverId/commands", handlers.GetCommands)
+	servers.Put("/:serverId/commands/:commandId", handlers.UpdateCommand)
+	servers.Delete("/:serverId/commands/:commandId", handlers.DeleteCommand)
 
 	// Channel routes
 	channels := protected.Group("/servers/:serverId/channels")
@@ -115,6 +195,10 @@ func main() {
 	channels.Get("/:channelId", handlers.GetChannel)
 	channels.Put("/:channelId", handlers.UpdateChannel)
 	channels.Delete("/:channelId", handlers.DeleteChannel)
+	channels.Post("/:channelId/webhooks", handlers.CreateWebhook)
+	channels.Get("/:channelId/webhooks", handlers.GetWebhooks)
+	channels.Post("/:channelId/webhooks/:webhookId/rotate", handlers.RotateWebhookToken)
+	channels.Delete("/:channelId/webhooks/:webhookId", handlers.DeleteWebhook)
 
 	// Message routes
 	messages := protected.Group("/channels/:channelId/messages")
@@ -122,20 +206,42 @@ func main() {
 	messages.Post("/", handlers.SendMessage)
 	messages.Put("/:messageId", handlers.EditMessage)
 	messages.Delete("/:messageId", handlers.DeleteMessage)
+	messages.Post("/:messageId/ack", handlers.AckMessage)
+	messages.Post("/:messageId/dismiss", handlers.DismissMessage)
+	messages.Put("/:messageId/poll/answers/:answerId/vote", handlers.VotePoll)
+	messages.Delete("/:messageId/poll/answers/:answerId/vote", handlers.UnvotePoll)
+	protected.Post("/channels/:channelId/scheduled-messages", handlers.CreateScheduledMessage)
+	protected.Post("/channels/:channelId/interactions", handlers.CreateInteraction)
+
+	// Scheduled message routes
+	scheduled := protected.Group("/scheduled-messages")
+	scheduled.Get("/", handlers.GetScheduledMessages)
+	scheduled.Put("/:scheduledId", handlers.UpdateScheduledMessage)
+	scheduled.Delete("/:scheduledId", handlers.DeleteScheduledMessage)
 
 	// Direct message routes
 	dms := protected.Group("/dms")
 	dms.Get("/", handlers.GetDMChannels)
 	dms.Post("/", handlers.CreateDMChannel)
+	dms.Put("/:dmId", handlers.UpdateDMChannel)
+	dms.Post("/:dmId/participants", handlers.AddDMParticipant)
+	dms.Delete("/:dmId/participants/:userId", handlers.RemoveDMParticipant)
+	dms.Post("/:dmId/leave", handlers.LeaveDMChannel)
 
 	// File upload
 	protected.Post("/upload", handlers.UploadFile)
+	protected.Post("/upload/resumable", handlers.CreateResumableUpload)
+	protected.Head("/upload/resumable/:uploadId", handlers.HeadResumableUpload)
+	protected.Get("/upload/resumable/:uploadId", handlers.GetResumableUpload)
+	protected.Patch("/upload/resumable/:uploadId", handlers.PatchResumableUpload)
+	protected.Delete("/upload/resumable/:uploadId", handlers.DeleteResumableUpload)
 
 	// Voice/Video signaling
 	voice := protected.Group("/voice")
 	voice.Get("/ice-servers", handlers.GetICEServers)
 	voice.Post("/join/:channelId", handlers.JoinVoiceChannel)
 	voice.Post("/leave/:channelId", handlers.LeaveVoiceChannel)
+	voice.Patch("/state", handlers.UpdateVoiceState)
 
 	// Admin routes (requires admin)
 	admin := protected.Group("/admin", middleware.AdminRequired())
@@ -143,6 +249,11 @@ func main() {
 	admin.Get("/users", handlers.GetAllUsers)
 	admin.Post("/approve/:id", handlers.ApproveUser)
 	admin.Post("/reject/:id", handlers.RejectUser)
+	admin.Get("/storage", handlers.GetStorageReport)
+	admin.Put("/storage/users/:id", handlers.SetUserStorageQuota)
+	admin.Put("/storage/servers/:id", handlers.SetServerStorageQuota)
+	admin.Get("/scans", handlers.GetUploadScans)
+	admin.Delete("/scans/:id/quarantine", handlers.DeleteQuarantinedUpload)
 
 	// WebSocket endpoint
 	app.Use("/ws", middleware.AuthWSUpgrade())
@@ -0,0 +1,82 @@
+// Command shitcordctl runs maintenance tasks against a Shitcord instance's database and storage.
+//
+// Usage:
+//
+//	shitcordctl uploads gc [--dry-run] [--grace 24h]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/storage"
+	"github.com/shitcord/backend/internal/uploadgc"
+)
+
+const usage = `Usage: shitcordctl <command>
+
+Commands:
+  uploads gc [--dry-run] [--grace 24h]   Delete uploads nothing refers to any more
+`
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] + " " + os.Args[2] {
+	case "uploads gc":
+		uploadsGC(os.Args[3:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// connect loads the same configuration as the server. It doesn't migrate: the server does
+// that on start, and a maintenance command shouldn't change the schema under it.
+func connect() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found, using system environment variables")
+	}
+	if err := database.Connect(); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	if err := storage.Init(); err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
+}
+
+func uploadsGC(args []string) {
+	collector := uploadgc.NewCollector()
+
+	flags := flag.NewFlagSet("uploads gc", flag.ExitOnError)
+	flags.BoolVar(&collector.DryRun, "dry-run", false, "list orphaned uploads without deleting them")
+	flags.DurationVar(&collector.Grace, "grace", collector.Grace, "leave uploads younger than this alone")
+	flags.Parse(args)
+	if collector.Grace < uploadgc.MinGrace {
+		log.Fatalf("--grace must be at least %v", uploadgc.MinGrace)
+	}
+
+	connect()
+
+	report, err := collector.Collect(context.Background())
+	for _, o := range report.Orphans {
+		fmt.Printf("%-20s %12d  %s\n", o.Reason, o.Size, o.Key)
+	}
+	verb := "Deleted"
+	if collector.DryRun {
+		verb = "Would delete"
+	}
+	fmt.Printf("%s %d files (%.1fMB)\n", verb, len(report.Orphans), float64(report.Bytes)/(1<<20))
+	if err != nil {
+		log.Fatalf("Upload GC failed: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+// Package access decides who can read and post in server channels and DM channels. The REST
+// handlers and the WebSocket hub both check access through it.
+package access
+
+import (
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// Conversation is the server channel or DM channel that a message channel ID refers to.
+// Message routes take a bare channel ID, so callers use this to find out which one it is.
+type Conversation struct {
+	Channel *models.Channel
+	DM      *models.DMChannel
+}
+
+// LoadConversation looks up a channel ID as a server channel first, then as a DM channel
+func LoadConversation(channelID uuid.UUID) (*Conversation, bool) {
+	var channel models.Channel
+	if err := database.DB.First(&channel, "id = ?", channelID).Error; err == nil {
+		return &Conversation{Channel: &channel}, true
+	}
+
+	var dm models.DMChannel
+	if err := database.DB.First(&dm, "id = ?", channelID).Error; err == nil {
+		return &Conversation{DM: &dm}, true
+	}
+
+	return nil, false
+}
+
+// CanAccess reports whether a user may read and post in the conversation
+func (cv *Conversation) CanAccess(userID uuid.UUID) bool {
+	if cv.DM != nil {
+		return IsDMParticipant(userID, cv.DM.ID)
+	}
+	return IsMember(userID, cv.Channel.ServerID)
+}
+
+// CanAccessChannel reports whether a user can read a server channel or DM channel
+func CanAccessChannel(userID, channelID uuid.UUID) bool {
+	cv, ok := LoadConversation(channelID)
+	return ok && cv.CanAccess(userID)
+}
+
+// IsMember reports whether a user belongs to a server
+func IsMember(userID, serverID uuid.UUID) bool {
+	var count int64
+	database.DB.Model(&models.ServerMember{}).
+		Where("user_id = ? AND server_id = ?", userID, serverID).
+		Count(&count)
+	return count > 0
+}
+
+// IsDMParticipant reports whether a user is in a DM channel
+func IsDMParticipant(userID, dmID uuid.UUID) bool {
+	var count int64
+	database.DB.Model(&models.DMParticipant{}).
+		Where("dm_channel_id = ? AND user_id = ?", dmID, userID).
+		Count(&count)
+	return count > 0
+}
@@ -0,0 +1,130 @@
+// Package blobstore stores upload contents once per SHA-256 hash. Attachments keep their own
+// URL, file name and uploader and reference a shared blob, which is counted so it can be
+// deleted along with the last attachment using it.
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/storage"
+)
+
+// Key returns where the blob with a hash is stored
+func Key(hash string) string {
+	return "blobs/" + hash[:2] + "/" + hash
+}
+
+// AttachmentKey returns where an attachment's contents are stored. Files uploaded before
+// deduplication are stored under their own URL.
+func AttachmentKey(att *models.Attachment) string {
+	if att.BlobHash != "" {
+		return Key(att.BlobHash)
+	}
+	return storage.KeyFromURL(att.URL)
+}
+
+// Hash returns the hex SHA-256 of everything src holds and rewinds it
+func Hash(src io.ReadSeeker) (string, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return "", err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HashBytes returns the hex SHA-256 of data
+func HashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put takes a reference to the blob with a hash, storing body only if no blob with that
+// hash exists yet. Every Put must be matched by a Release.
+func Put(ctx context.Context, hash string, body io.Reader, size int64, contentType string) error {
+	result := database.DB.Model(&models.Blob{}).Where("hash = ?", hash).
+		UpdateColumns(map[string]interface{}{"ref_count": gorm.Expr("ref_count + 1"), "updated_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	key := Key(hash)
+	if err := storage.Default.Put(ctx, key, body, size, contentType); err != nil {
+		return err
+	}
+	// Concurrent uploads of the same new file all store it; the writes are identical, and
+	// whichever records it last just adds its reference
+	return database.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "hash"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"ref_count":  gorm.Expr("blobs.ref_count + 1"),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&models.Blob{Hash: hash, Key: key, Size: size, ContentType: contentType, RefCount: 1}).Error
+}
+
+// Release drops a reference to a blob and deletes it once nothing references it.
+// The blob is deleted from storage before its record, while the record is locked, so a
+// concurrent Put of the same contents waits and then stores it afresh.
+func Release(ctx context.Context, hash string) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Blob{}).Where("hash = ?", hash).
+			UpdateColumn("ref_count", gorm.Expr("ref_count - 1")).Error; err != nil {
+			return err
+		}
+		result := tx.Where("hash = ? AND ref_count <= 0", hash).Delete(&models.Blob{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return storage.Default.Delete(ctx, Key(hash))
+	})
+}
+
+// Purge deletes a blob no attachment references, unless a reference to it was taken since
+// before. It reports whether the blob was deleted.
+func Purge(ctx context.Context, hash string, before time.Time) (bool, error) {
+	purged := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("hash = ? AND updated_at < ? AND NOT EXISTS (?)", hash, before,
+			tx.Model(&models.Attachment{}).Select("1").Where("blob_hash = ?", hash)).Delete(&models.Blob{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		purged = true
+		return storage.Default.Delete(ctx, Key(hash))
+	})
+	return purged && err == nil, err
+}
+
+// Remove deletes an attachment's contents, or its reference to them if they are shared.
+// Callers delete the attachment record first, so a failure here leaves an unreferenced
+// blob for the garbage collector rather than an attachment without contents.
+func Remove(ctx context.Context, att *models.Attachment) {
+	var err error
+	if att.BlobHash != "" {
+		err = Release(ctx, att.BlobHash)
+	} else if key := storage.KeyFromURL(att.URL); key != "" {
+		err = storage.Default.Delete(ctx, key)
+	}
+	if err != nil {
+		log.Printf("Failed to remove upload %s: %v", att.URL, err)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"io"
@@ -81,6 +84,26 @@ func GenerateInviteCode() string {
 	return string(b)
 }
 
+// GenerateSecretToken generates a random URL-safe secret such as a webhook token
+func GenerateSecretToken() (string, error) {
+	b, err := GenerateRandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the SHA-256 hex digest a secret token is stored as
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenMatches compares a presented token against a stored hash in constant time
+func TokenMatches(token, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(hash)) == 1
+}
+
 func getServerKey() ([]byte, error) {
 	keyHex := os.Getenv("ENCRYPTION_KEY")
 	if keyHex == "" {
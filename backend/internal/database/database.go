@@ -59,17 +59,57 @@ func Migrate() error {
 		&models.ServerMember{},
 		&models.Channel{},
 		&models.DMChannel{},
+		&models.DMParticipant{},
 		&models.Message{},
+		&models.Attachment{},
+		&models.Blob{},
+		&models.UploadSession{},
+		&models.UploadScan{},
 		&models.VoiceState{},
 		&models.Invite{},
+		&models.Mention{},
+		&models.ReadState{},
+		&models.ScheduledMessage{},
+		&models.Poll{},
+		&models.PollAnswer{},
+		&models.PollVote{},
+		&models.Webhook{},
+		&models.EventSubscription{},
+		&models.EventDelivery{},
+		&models.ApplicationCommand{},
+		&models.Interaction{},
 	)
 	if err != nil {
 		return err
 	}
 
+	// Backfill participants for 1:1 DMs created before group DMs existed
+	var dms []models.DMChannel
+	DB.Where("is_group = ? AND id NOT IN (?)", false, DB.Model(&models.DMParticipant{}).Select("dm_channel_id")).Find(&dms)
+	for _, dm := range dms {
+		if dm.User1ID == nil || dm.User2ID == nil {
+			continue
+		}
+		DB.Create(&[]models.DMParticipant{
+			{DMChannelID: dm.ID, UserID: *dm.User1ID, JoinedAt: dm.CreatedAt},
+			{DMChannelID: dm.ID, UserID: *dm.User2ID, JoinedAt: dm.CreatedAt},
+		})
+	}
+
+	backfillAttachments()
+
+	// Count attachments posted before storage was tracked per server against their server
+	DB.Exec(`UPDATE attachments SET server_id = (SELECT server_id FROM channels WHERE channels.id = attachments.channel_id)
+		WHERE server_id IS NULL AND channel_id IS NOT NULL`)
+	DB.Exec(`UPDATE attachments SET server_id = (SELECT p.server_id FROM attachments p WHERE p.id = attachments.parent_id)
+		WHERE server_id IS NULL AND parent_id IS NOT NULL`)
+
 	// Reset all users to offline on startup (clean slate)
 	DB.Model(&models.User{}).Where("status != ?", "offline").Update("status", "offline")
 
+	// Nobody is connected to voice either
+	DB.Exec("DELETE FROM voice_states")
+
 	return nil
 }
 
@@ -79,3 +119,67 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// backfillAttachments records files uploaded before attachments were tracked, so they
+// keep being served: message files with their channel, avatars and icons as public
+func backfillAttachments() {
+	untracked := DB.Model(&models.Attachment{}).Select("url")
+
+	var messages []models.Message
+	DB.Unscoped().Where("attachment_url LIKE ? AND attachment_url NOT IN (?)", "/uploads/%", untracked).
+		Order("created_at ASC").Find(&messages)
+	for _, msg := range messages {
+		channelID, messageID := msg.ChannelID, msg.ID
+		fileType := msg.Type
+		if fileType != "image" && fileType != "video" && fileType != "audio" {
+			fileType = "file"
+		}
+		createLegacyAttachment(models.Attachment{
+			UploaderID: msg.AuthorID,
+			ChannelID:  &channelID,
+			MessageID:  &messageID,
+			Purpose:    "attachment",
+			URL:        msg.AttachmentURL,
+			Type:       fileType,
+			CreatedAt:  msg.CreatedAt,
+		})
+	}
+
+	var users []models.User
+	DB.Where("avatar_url LIKE ? AND avatar_url NOT IN (?)", "/uploads/%", untracked).Find(&users)
+	for _, user := range users {
+		createLegacyAttachment(models.Attachment{UploaderID: user.ID, Purpose: "avatar", URL: user.AvatarURL, Type: "image"})
+	}
+
+	var servers []models.Server
+	DB.Where("icon_url LIKE ? AND icon_url NOT IN (?)", "/uploads/%", untracked).Find(&servers)
+	for _, server := range servers {
+		createLegacyAttachment(models.Attachment{UploaderID: server.OwnerID, Purpose: "icon", URL: server.IconURL, Type: "image"})
+	}
+
+	var groups []models.DMChannel
+	DB.Where("owner_id IS NOT NULL AND icon_url LIKE ? AND icon_url NOT IN (?)", "/uploads/%", untracked).Find(&groups)
+	for _, dm := range groups {
+		createLegacyAttachment(models.Attachment{UploaderID: *dm.OwnerID, Purpose: "icon", URL: dm.IconURL, Type: "image"})
+	}
+}
+
+// createLegacyAttachment stores a backfilled attachment if its file still exists.
+// A file referenced from several places is recorded once, for the first reference.
+func createLegacyAttachment(att models.Attachment) {
+	info, err := os.Stat("." + att.URL)
+	if err != nil {
+		return
+	}
+	att.Filename = info.Name()
+	att.Size = info.Size()
+
+	var count int64
+	DB.Model(&models.Attachment{}).Where("url = ?", att.URL).Count(&count)
+	if count > 0 {
+		return
+	}
+	if err := DB.Create(&att).Error; err != nil {
+		log.Printf("Failed to backfill attachment %s: %v", att.URL, err)
+	}
+}
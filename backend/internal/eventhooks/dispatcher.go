@@ -0,0 +1,237 @@
+package eventhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is tried before it is marked failed
+	MaxAttempts = 8
+	// DisableAfter is how many consecutive failed attempts disable a subscription
+	DisableAfter = 20
+
+	// Retries back off exponentially from baseBackoff up to maxBackoff
+	baseBackoff = 30 * time.Second
+	maxBackoff  = time.Hour
+
+	// deliveryLease is how long an instance owns a claimed delivery
+	deliveryLease = time.Minute
+	// logRetention is how long finished deliveries stay in the delivery log
+	logRetention = 7 * 24 * time.Hour
+)
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-Shitcord-Event"
+	HeaderDelivery  = "X-Shitcord-Delivery"
+	HeaderTimestamp = "X-Shitcord-Timestamp"
+	HeaderSignature = "X-Shitcord-Signature"
+)
+
+// Sign computes the signature header value for a delivery body.
+// Receivers recompute it over "<timestamp>.<body>" with their secret and compare.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the delay before the next try after a number of failed attempts
+func backoff(attempts int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// Dispatcher sends queued deliveries. Several instances can run against the
+// same database; each delivery is claimed with a lease before it is sent.
+type Dispatcher struct {
+	Client    *http.Client
+	Interval  time.Duration
+	BatchSize int
+}
+
+// NewDispatcher returns a dispatcher with production defaults
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		Client:    NewClient(10 * time.Second),
+		Interval:  2 * time.Second,
+		BatchSize: 50,
+	}
+}
+
+// Run delivers due events and prunes the delivery log. It never returns.
+func (d *Dispatcher) Run() {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	var lastPrune time.Time
+	for range ticker.C {
+		d.DeliverDue()
+
+		if time.Since(lastPrune) > time.Hour {
+			pruneLog()
+			lastPrune = time.Now()
+		}
+	}
+}
+
+// DeliverDue claims and sends one batch of due deliveries and returns how many it attempted
+func (d *Dispatcher) DeliverDue() int {
+	now := time.Now()
+
+	var ids []uuid.UUID
+	database.DB.Model(&models.EventDelivery{}).
+		Where("status = ? AND next_attempt_at <= ? AND (claimed_until IS NULL OR claimed_until < ?)", "pending", now, now).
+		Order("next_attempt_at ASC").
+		Limit(d.BatchSize).
+		Pluck("id", &ids)
+
+	attempted := 0
+	for _, id := range ids {
+		claimedAt := time.Now()
+		result := database.DB.Model(&models.EventDelivery{}).
+			Where("id = ? AND status = ? AND (claimed_until IS NULL OR claimed_until < ?)", id, "pending", claimedAt).
+			Update("claimed_until", claimedAt.Add(deliveryLease))
+		if result.RowsAffected != 1 {
+			continue
+		}
+
+		var delivery models.EventDelivery
+		if err := database.DB.First(&delivery, "id = ?", id).Error; err != nil {
+			continue
+		}
+
+		var sub models.EventSubscription
+		if err := database.DB.First(&sub, "id = ?", delivery.SubscriptionID).Error; err != nil || !sub.IsActive {
+			finish(&delivery, "failed", 0, "Subscription disabled")
+			continue
+		}
+
+		d.deliver(&delivery, &sub)
+		attempted++
+	}
+
+	return attempted
+}
+
+// deliver makes one attempt and records the outcome
+func (d *Dispatcher) deliver(delivery *models.EventDelivery, sub *models.EventSubscription) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	statusCode, err := d.post(sub, delivery, body, timestamp)
+	delivery.Attempts++
+
+	if err == nil {
+		finish(delivery, "succeeded", statusCode, "")
+		database.DB.Model(sub).Update("failure_count", 0)
+		return
+	}
+
+	if delivery.Attempts >= MaxAttempts {
+		finish(delivery, "failed", statusCode, err.Error())
+	} else {
+		database.DB.Model(delivery).Updates(map[string]interface{}{
+			"attempts":         delivery.Attempts,
+			"next_attempt_at":  time.Now().Add(backoff(delivery.Attempts)),
+			"claimed_until":    nil,
+			"last_status_code": statusCode,
+			"last_error":       truncate(err.Error(), 512),
+		})
+	}
+
+	recordFailure(sub)
+}
+
+// post sends the signed request; any non-2xx response is an error
+func (d *Dispatcher) post(sub *models.EventSubscription, delivery *models.EventDelivery, body []byte, timestamp int64) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Shitcord-EventHooks/1.0")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, delivery.ID.String())
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, timestamp, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// finish records a delivery's final state
+func finish(delivery *models.EventDelivery, status string, statusCode int, errMsg string) {
+	updates := map[string]interface{}{
+		"status":           status,
+		"attempts":         delivery.Attempts,
+		"claimed_until":    nil,
+		"last_status_code": statusCode,
+		"last_error":       truncate(errMsg, 512),
+	}
+	if status == "succeeded" {
+		updates["delivered_at"] = time.Now()
+	}
+	database.DB.Model(delivery).Updates(updates)
+}
+
+// recordFailure bumps a subscription's consecutive failure count and disables it past the limit
+func recordFailure(sub *models.EventSubscription) {
+	database.DB.Model(sub).Update("failure_count", gorm.Expr("failure_count + 1"))
+
+	now := time.Now()
+	result := database.DB.Model(&models.EventSubscription{}).
+		Where("id = ? AND is_active = ? AND failure_count >= ?", sub.ID, true, DisableAfter).
+		Updates(map[string]interface{}{"is_active": false, "disabled_at": now})
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	log.Printf("Disabled event subscription %s after %d consecutive failures", sub.ID, DisableAfter)
+	database.DB.Model(&models.EventDelivery{}).
+		Where("subscription_id = ? AND status = ?", sub.ID, "pending").
+		Updates(map[string]interface{}{"status": "failed", "last_error": "Subscription disabled"})
+}
+
+// pruneLog removes finished deliveries older than the retention period
+func pruneLog() {
+	database.DB.Where("status != ? AND created_at < ?", "pending", time.Now().Add(-logRetention)).
+		Delete(&models.EventDelivery{})
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+package eventhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned for endpoints on loopback, private, link-local or other
+// internal addresses, which would let users make the server call its own network
+var ErrPrivateAddress = errors.New("URL must not point to a private address")
+
+// reservedNets are internal ranges the net.IP predicates don't cover
+var reservedNets = []*net.IPNet{
+	mustCIDR("0.0.0.0/8"),     // "This network"
+	mustCIDR("100.64.0.0/10"), // Carrier-grade NAT, also used for some cloud metadata services
+	mustCIDR("198.18.0.0/15"), // Benchmarking
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// AllowPrivate reports whether endpoints may be on private addresses, for local development
+func AllowPrivate() bool {
+	return os.Getenv("EVENT_HOOKS_ALLOW_PRIVATE") == "true"
+}
+
+// blockedIP reports whether outgoing requests to an address are refused
+func blockedIP(ip net.IP) bool {
+	if AllowPrivate() {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost resolves an endpoint's host and refuses it if any of its addresses are blocked
+func checkHost(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if blockedIP(ip) {
+			return ErrPrivateAddress
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return errors.New("URL host does not resolve")
+	}
+	for _, addr := range addrs {
+		if blockedIP(addr.IP) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
+
+// dialControl refuses connections to blocked addresses. It runs on the resolved address of
+// every connection, so a host that resolves differently after ValidateURL is still caught.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || blockedIP(ip) {
+		return fmt.Errorf("connecting to %s: %w", host, ErrPrivateAddress)
+	}
+	return nil
+}
+
+// NewClient returns an HTTP client for calling user-supplied endpoints. It doesn't follow
+// redirects, ignores proxy settings and won't connect to private addresses.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: dialControl,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		// A redirect counts as a failed request rather than being followed
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
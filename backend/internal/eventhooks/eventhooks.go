@@ -0,0 +1,122 @@
+// Package eventhooks delivers server events to external HTTPS endpoints.
+// Events are queued as EventDelivery rows and sent by a Dispatcher with
+// HMAC-SHA256 signatures, retries with exponential backoff, and automatic
+// disabling of subscriptions that keep failing.
+package eventhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// Event types that can be subscribed to
+const (
+	EventMemberJoin       = "MEMBER_JOIN"
+	EventMemberLeave      = "MEMBER_LEAVE"
+	EventMemberKick       = "MEMBER_KICK"
+	EventMessageCreate    = "MESSAGE_CREATE" // Plaintext messages only
+	EventMessageDelete    = "MESSAGE_DELETE" // Plaintext messages only
+	EventVoiceJoin        = "VOICE_STATE_JOIN"
+	EventVoiceLeave       = "VOICE_STATE_LEAVE"
+	EventModMessageDelete = "MODERATION_MESSAGE_DELETE"
+)
+
+var validEvents = map[string]bool{
+	EventMemberJoin:       true,
+	EventMemberLeave:      true,
+	EventMemberKick:       true,
+	EventMessageCreate:    true,
+	EventMessageDelete:    true,
+	EventVoiceJoin:        true,
+	EventVoiceLeave:       true,
+	EventModMessageDelete: true,
+}
+
+// ValidEvent reports whether an event type can be subscribed to
+func ValidEvent(event string) bool {
+	return validEvents[event]
+}
+
+// Payload is the JSON body POSTed to subscribers. It has the same shape as ws.WSMessage.
+type Payload struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	ChannelID string          `json:"channel_id,omitempty"`
+	ServerID  string          `json:"server_id,omitempty"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+// AllowInsecure reports whether plain http:// endpoints are allowed, for local development
+func AllowInsecure() bool {
+	return os.Getenv("EVENT_HOOKS_ALLOW_HTTP") == "true"
+}
+
+// ValidateURL checks that a subscription endpoint is an absolute HTTPS URL on a public address
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return errors.New("URL must be absolute")
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && AllowInsecure()) {
+		return errors.New("URL must use https")
+	}
+	return checkHost(u.Hostname())
+}
+
+// Emit queues an event for every active subscription on the server that wants it.
+// channelID may be empty for server-wide events.
+func Emit(serverID uuid.UUID, channelID string, event string, data interface{}) {
+	if database.DB == nil {
+		return
+	}
+
+	var subs []models.EventSubscription
+	database.DB.Where("server_id = ? AND is_active = ?", serverID, true).Find(&subs)
+	if len(subs) == 0 {
+		return
+	}
+
+	dataBytes, _ := json.Marshal(data)
+	body, _ := json.Marshal(Payload{
+		Event:     event,
+		Data:      dataBytes,
+		ChannelID: channelID,
+		ServerID:  serverID.String(),
+		Timestamp: time.Now().UnixMilli(),
+	})
+
+	now := time.Now()
+	for _, sub := range subs {
+		if !subscribed(&sub, event) {
+			continue
+		}
+		delivery := models.EventDelivery{
+			SubscriptionID: sub.ID,
+			Event:          event,
+			Payload:        string(body),
+			Status:         "pending",
+			NextAttemptAt:  now,
+		}
+		if err := database.DB.Create(&delivery).Error; err != nil {
+			log.Printf("Failed to queue %s for event subscription %s: %v", event, sub.ID, err)
+		}
+	}
+}
+
+func subscribed(sub *models.EventSubscription, event string) bool {
+	for _, e := range sub.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,312 @@
+package eventhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// setupDB points database.DB at a fresh SQLite database for the test
+func setupDB(t *testing.T) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.EventSubscription{}, &models.EventDelivery{}); err != nil {
+		t.Fatal(err)
+	}
+	prev := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = prev })
+}
+
+// receiver is an httptest endpoint that checks signatures the way a subscriber would and
+// answers with the given status codes in turn, repeating the last one
+type receiver struct {
+	*httptest.Server
+	secret   string
+	statuses []int
+	calls    atomic.Int32
+	badSigs  atomic.Int32
+	lastBody atomic.Value
+}
+
+func newReceiver(t *testing.T, secret string, statuses ...int) *receiver {
+	t.Helper()
+	r := &receiver{secret: secret, statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := int(r.calls.Add(1))
+		body, _ := io.ReadAll(req.Body)
+		r.lastBody.Store(string(body))
+
+		mac := hmac.New(sha256.New, []byte(r.secret))
+		mac.Write([]byte(req.Header.Get(HeaderTimestamp) + "." + string(body)))
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(want), []byte(req.Header.Get(HeaderSignature))) {
+			r.badSigs.Add(1)
+		}
+
+		status := r.statuses[len(r.statuses)-1]
+		if n <= len(r.statuses) {
+			status = r.statuses[n-1]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+
+	// The receiver is on loopback
+	t.Setenv("EVENT_HOOKS_ALLOW_HTTP", "true")
+	t.Setenv("EVENT_HOOKS_ALLOW_PRIVATE", "true")
+	return r
+}
+
+// subscribe creates an active subscription for MEMBER_JOIN and queues one event for it
+func subscribe(t *testing.T, url, secret string) (models.EventSubscription, models.EventDelivery) {
+	t.Helper()
+	sub := models.EventSubscription{
+		ServerID:  uuid.New(),
+		CreatorID: uuid.New(),
+		URL:       url,
+		Events:    []string{EventMemberJoin},
+		Secret:    secret,
+		IsActive:  true,
+	}
+	if err := database.DB.Create(&sub).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	Emit(sub.ServerID, "", EventMemberJoin, map[string]string{"user_id": "u1"})
+	Emit(sub.ServerID, "", EventMemberLeave, map[string]string{"user_id": "u1"}) // Not subscribed
+
+	var deliveries []models.EventDelivery
+	database.DB.Where("subscription_id = ?", sub.ID).Find(&deliveries)
+	if len(deliveries) != 1 {
+		t.Fatalf("queued %d deliveries, want 1", len(deliveries))
+	}
+	return sub, deliveries[0]
+}
+
+func reload(t *testing.T, delivery *models.EventDelivery) {
+	t.Helper()
+	if err := database.DB.First(delivery, "id = ?", delivery.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// makeDue moves a pending retry's next attempt into the past
+func makeDue(delivery *models.EventDelivery) {
+	database.DB.Model(delivery).Update("next_attempt_at", time.Now().Add(-time.Second))
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"MEMBER_JOIN"}`)
+	sig := Sign("secret", 1700000000, body)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); sig != want {
+		t.Fatalf("Sign = %s, want %s", sig, want)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      []byte
+	}{
+		{"other secret", "other", 1700000000, body},
+		{"other timestamp", "secret", 1700000001, body},
+		{"tampered body", "secret", 1700000000, []byte(`{"event":"MEMBER_KICK"}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if Sign(tt.secret, tt.timestamp, tt.body) == sig {
+				t.Fatal("signature did not change")
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	setupDB(t)
+	r := newReceiver(t, "s3cret", http.StatusNoContent)
+	_, delivery := subscribe(t, r.URL, "s3cret")
+
+	if n := NewDispatcher().DeliverDue(); n != 1 {
+		t.Fatalf("DeliverDue attempted %d, want 1", n)
+	}
+
+	if r.calls.Load() != 1 || r.badSigs.Load() != 0 {
+		t.Fatalf("receiver got %d calls, %d with bad signatures", r.calls.Load(), r.badSigs.Load())
+	}
+	if body := r.lastBody.Load().(string); body != delivery.Payload {
+		t.Fatalf("receiver got body %s, want %s", body, delivery.Payload)
+	}
+
+	reload(t, &delivery)
+	if delivery.Status != "succeeded" || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusNoContent {
+		t.Fatalf("delivery is %s after %d attempts (status code %d)", delivery.Status, delivery.Attempts, delivery.LastStatusCode)
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	setupDB(t)
+	r := newReceiver(t, "s3cret", http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK)
+	sub, delivery := subscribe(t, r.URL, "s3cret")
+	d := NewDispatcher()
+
+	for attempt, status := range []int{http.StatusInternalServerError, http.StatusBadGateway} {
+		before := time.Now()
+		d.DeliverDue()
+		reload(t, &delivery)
+
+		if delivery.Status != "pending" || delivery.Attempts != attempt+1 || delivery.LastStatusCode != status {
+			t.Fatalf("after attempt %d: %s, %d attempts, status code %d", attempt+1, delivery.Status, delivery.Attempts, delivery.LastStatusCode)
+		}
+		wait := delivery.NextAttemptAt.Sub(before)
+		if want := backoff(attempt + 1); wait < want || wait > want+5*time.Second {
+			t.Fatalf("after attempt %d: retry in %v, want %v", attempt+1, wait, want)
+		}
+
+		// Not due yet
+		if n := d.DeliverDue(); n != 0 {
+			t.Fatalf("retried %d deliveries before they were due", n)
+		}
+		makeDue(&delivery)
+	}
+
+	d.DeliverDue()
+	reload(t, &delivery)
+	if delivery.Status != "succeeded" || delivery.Attempts != 3 {
+		t.Fatalf("delivery is %s after %d attempts, want succeeded after 3", delivery.Status, delivery.Attempts)
+	}
+	if r.calls.Load() != 3 || r.badSigs.Load() != 0 {
+		t.Fatalf("receiver got %d calls, %d with bad signatures", r.calls.Load(), r.badSigs.Load())
+	}
+
+	// Success resets the consecutive failure count
+	database.DB.First(&sub, "id = ?", sub.ID)
+	if sub.FailureCount != 0 {
+		t.Fatalf("failure count is %d after a success", sub.FailureCount)
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	setupDB(t)
+	r := newReceiver(t, "s3cret", http.StatusServiceUnavailable)
+	sub, delivery := subscribe(t, r.URL, "s3cret")
+
+	database.DB.Model(&delivery).Update("attempts", MaxAttempts-1)
+	database.DB.Model(&sub).Update("failure_count", DisableAfter-1)
+
+	NewDispatcher().DeliverDue()
+
+	reload(t, &delivery)
+	if delivery.Status != "failed" || delivery.Attempts != MaxAttempts {
+		t.Fatalf("delivery is %s after %d attempts, want failed after %d", delivery.Status, delivery.Attempts, MaxAttempts)
+	}
+
+	database.DB.First(&sub, "id = ?", sub.ID)
+	if sub.IsActive || sub.DisabledAt == nil {
+		t.Fatalf("subscription still active after %d consecutive failures", DisableAfter)
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr error
+	}{
+		{"https://93.184.216.34/hook", nil},
+		{"https://[2606:2800:220:1::]/hook", nil},
+		{"http://93.184.216.34/hook", errAny},
+		{"/relative", errAny},
+		{"https://127.0.0.1/hook", ErrPrivateAddress},
+		{"https://[::1]/hook", ErrPrivateAddress},
+		{"https://10.1.2.3/hook", ErrPrivateAddress},
+		{"https://172.16.0.1/hook", ErrPrivateAddress},
+		{"https://192.168.1.1/hook", ErrPrivateAddress},
+		{"https://169.254.169.254/latest/meta-data", ErrPrivateAddress},
+		{"https://[fe80::1]/hook", ErrPrivateAddress},
+		{"https://[fd00::1]/hook", ErrPrivateAddress},
+		{"https://0.0.0.0/hook", ErrPrivateAddress},
+		{"https://100.100.100.200/hook", ErrPrivateAddress},
+		{"https://[::ffff:127.0.0.1]/hook", ErrPrivateAddress},
+		{"https://localhost:8443/hook", ErrPrivateAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := ValidateURL(tt.url)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr == errAny && err == nil:
+				t.Fatal("expected an error")
+			case tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// errAny stands for any validation error in TestValidateURL
+var errAny = errors.New("any error")
+
+func TestClientRefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// Even a URL that got past ValidateURL, e.g. by resolving differently later, is refused
+	_, err := NewClient(time.Second).Get(srv.URL)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("got %v, want %v", err, ErrPrivateAddress)
+	}
+
+	t.Setenv("EVENT_HOOKS_ALLOW_PRIVATE", "true")
+	resp, err := NewClient(time.Second).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("with private addresses allowed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,204 @@
+// Package filetype decides which uploads are accepted and how they are served.
+// A file's extension picks its type, and its first bytes must agree with it, so a
+// renamed HTML page or script can't pass as an image or a text file.
+package filetype
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// SniffLen is how many leading bytes Detect needs to see
+const SniffLen = 512
+
+// Type describes an accepted kind of file
+type Type struct {
+	Ext      string // Lowercase, with the leading dot
+	MIME     string // Content-Type it is served with
+	Category string // image, video, audio or file
+	Inline   bool   // Safe to display in the browser; everything else is forced to download
+	match    func(head []byte) bool
+}
+
+var (
+	// ErrNotAllowed means the extension is not on the allow list, or is on the deny list
+	ErrNotAllowed = errors.New("file type is not allowed")
+	// ErrMismatch means the contents don't look like the extension claims
+	ErrMismatch = errors.New("file contents do not match its extension")
+)
+
+var known = map[string]*Type{}
+
+func register(t *Type) {
+	known[t.Ext] = t
+}
+
+func init() {
+	// Raster images
+	register(&Type{Ext: ".png", MIME: "image/png", Category: "image", Inline: true, match: prefix("\x89PNG\r\n\x1a\n")})
+	register(&Type{Ext: ".jpg", MIME: "image/jpeg", Category: "image", Inline: true, match: prefix("\xff\xd8\xff")})
+	register(&Type{Ext: ".jpeg", MIME: "image/jpeg", Category: "image", Inline: true, match: prefix("\xff\xd8\xff")})
+	register(&Type{Ext: ".gif", MIME: "image/gif", Category: "image", Inline: true, match: anyPrefix("GIF87a", "GIF89a")})
+	register(&Type{Ext: ".webp", MIME: "image/webp", Category: "image", Inline: true, match: riff("WEBP")})
+	register(&Type{Ext: ".bmp", MIME: "image/bmp", Category: "image", Inline: true, match: prefix("BM")})
+	register(&Type{Ext: ".ico", MIME: "image/x-icon", Category: "image", Inline: true, match: prefix("\x00\x00\x01\x00")})
+	register(&Type{Ext: ".tiff", MIME: "image/tiff", Category: "image", match: anyPrefix("II*\x00", "MM\x00*")})
+
+	// SVG can carry script, so it is only ever downloaded
+	register(&Type{Ext: ".svg", MIME: "image/svg+xml", Category: "image", match: isSVG})
+
+	// Video and audio
+	register(&Type{Ext: ".mp4", MIME: "video/mp4", Category: "video", Inline: true, match: isISOBMFF})
+	register(&Type{Ext: ".mov", MIME: "video/quicktime", Category: "video", Inline: true, match: isISOBMFF})
+	register(&Type{Ext: ".webm", MIME: "video/webm", Category: "video", Inline: true, match: prefix("\x1a\x45\xdf\xa3")})
+	register(&Type{Ext: ".mp3", MIME: "audio/mpeg", Category: "audio", Inline: true, match: isMP3})
+	register(&Type{Ext: ".ogg", MIME: "audio/ogg", Category: "audio", Inline: true, match: prefix("OggS")})
+	register(&Type{Ext: ".wav", MIME: "audio/wav", Category: "audio", Inline: true, match: riff("WAVE")})
+	register(&Type{Ext: ".flac", MIME: "audio/flac", Category: "audio", Inline: true, match: prefix("fLaC")})
+
+	// Documents and archives
+	register(&Type{Ext: ".pdf", MIME: "application/pdf", Category: "file", match: prefix("%PDF-")})
+	register(&Type{Ext: ".zip", MIME: "application/zip", Category: "file", match: isZip})
+	register(&Type{Ext: ".docx", MIME: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Category: "file", match: isZip})
+	register(&Type{Ext: ".xlsx", MIME: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Category: "file", match: isZip})
+	register(&Type{Ext: ".pptx", MIME: "application/vnd.openxmlformats-officedocument.presentationml.presentation", Category: "file", match: isZip})
+	register(&Type{Ext: ".doc", MIME: "application/msword", Category: "file", match: prefix("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")})
+	register(&Type{Ext: ".xls", MIME: "application/vnd.ms-excel", Category: "file", match: prefix("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")})
+	register(&Type{Ext: ".gz", MIME: "application/gzip", Category: "file", match: prefix("\x1f\x8b")})
+	register(&Type{Ext: ".7z", MIME: "application/x-7z-compressed", Category: "file", match: prefix("7z\xbc\xaf\x27\x1c")})
+	register(&Type{Ext: ".rar", MIME: "application/vnd.rar", Category: "file", match: prefix("Rar!\x1a\x07")})
+	register(&Type{Ext: ".tar", MIME: "application/x-tar", Category: "file", match: isTar})
+
+	// Text and source code is served as plain text whatever the language
+	for _, ext := range []string{".txt", ".md", ".csv", ".json", ".xml", ".yaml", ".yml",
+		".go", ".py", ".js", ".ts", ".rs", ".c", ".cpp", ".h", ".java", ".rb"} {
+		register(&Type{Ext: ext, MIME: "text/plain; charset=utf-8", Category: "file", Inline: true, match: isPlainText})
+	}
+}
+
+// Lookup returns the type an extension is served as. Extensions that are allowed but not
+// known are downloaded as application/octet-stream.
+func Lookup(ext string) *Type {
+	ext = strings.ToLower(ext)
+	if t, ok := known[ext]; ok {
+		return t
+	}
+	return &Type{Ext: ext, MIME: "application/octet-stream", Category: "file", match: notMarkup}
+}
+
+// Allowed reports whether uploads with this extension are accepted. UPLOAD_ALLOWED_EXTENSIONS
+// replaces the built-in list of known types, and UPLOAD_DENIED_EXTENSIONS removes entries from it.
+func Allowed(ext string) bool {
+	ext = strings.ToLower(ext)
+	if ext == "" || inList(os.Getenv("UPLOAD_DENIED_EXTENSIONS"), ext) {
+		return false
+	}
+	if allowed := os.Getenv("UPLOAD_ALLOWED_EXTENSIONS"); allowed != "" {
+		return inList(allowed, ext)
+	}
+	_, ok := known[ext]
+	return ok
+}
+
+// Detect checks that a file's leading bytes agree with its extension and returns its type
+func Detect(ext string, head []byte) (*Type, error) {
+	if !Allowed(ext) {
+		return nil, ErrNotAllowed
+	}
+	t := Lookup(ext)
+	if !t.match(head) {
+		return nil, ErrMismatch
+	}
+	return t, nil
+}
+
+// inList reports whether ext is in a comma-separated list; entries may omit the dot
+func inList(list, ext string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" && !strings.HasPrefix(entry, ".") {
+			entry = "." + entry
+		}
+		if entry == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func prefix(magic string) func([]byte) bool {
+	return func(head []byte) bool {
+		return bytes.HasPrefix(head, []byte(magic))
+	}
+}
+
+func anyPrefix(magics ...string) func([]byte) bool {
+	return func(head []byte) bool {
+		for _, magic := range magics {
+			if bytes.HasPrefix(head, []byte(magic)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// riff matches RIFF containers of the given form type, such as WEBP or WAVE
+func riff(form string) func([]byte) bool {
+	return func(head []byte) bool {
+		return len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == form
+	}
+}
+
+// isISOBMFF matches MP4 and QuickTime files, which start with an "ftyp" box
+func isISOBMFF(head []byte) bool {
+	return len(head) >= 12 && string(head[4:8]) == "ftyp"
+}
+
+func isMP3(head []byte) bool {
+	if bytes.HasPrefix(head, []byte("ID3")) {
+		return true
+	}
+	// A bare MPEG audio frame header starts with 11 set sync bits
+	return len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0
+}
+
+func isZip(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06"))
+}
+
+func isTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// isPlainText accepts UTF-8 text that a browser wouldn't sniff as HTML
+func isPlainText(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	// The sniffed prefix may end in the middle of a multi-byte character
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+	return utf8.Valid(head) && notMarkup(head)
+}
+
+// notMarkup rejects content a browser would treat as HTML
+func notMarkup(head []byte) bool {
+	return !strings.HasPrefix(http.DetectContentType(head), "text/html")
+}
+
+// isSVG accepts XML that starts like an SVG document
+func isSVG(head []byte) bool {
+	trimmed := bytes.TrimSpace(head)
+	for _, start := range []string{"<?xml", "<svg", "<!DOCTYPE svg", "<!--"} {
+		if bytes.HasPrefix(trimmed, []byte(start)) {
+			return true
+		}
+	}
+	return false
+}
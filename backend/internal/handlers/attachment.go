@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/shitcord/backend/internal/blobstore"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/filetype"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/storage"
+)
+
+// signedURLLifetime is how long a signed attachment URL stays valid
+const signedURLLifetime = time.Hour
+
+// isPublicUpload reports whether an upload may be served to anyone
+func isPublicUpload(att *models.Attachment) bool {
+	return att.Purpose == "avatar" || att.Purpose == "icon"
+}
+
+// signUploadURL returns a short-lived URL for an upload that works without authentication.
+// It falls back to the plain URL if the storage driver can't sign one.
+func signUploadURL(att *models.Attachment) string {
+	// Drivers that check their own signatures are served through ServeUpload, which finds
+	// the stored contents from the upload's URL; others sign a URL for the contents directly
+	key := blobstore.AttachmentKey(att)
+	if _, ok := storage.Default.(storage.Verifier); ok {
+		key = storage.KeyFromURL(att.URL)
+	}
+	ft := filetype.Lookup(path.Ext(att.URL))
+	signed, err := storage.Default.PresignedURL(context.Background(), key, signedURLLifetime, storage.ResponseHeaders{
+		ContentType:        ft.MIME,
+		ContentDisposition: contentDisposition(ft, downloadName(att, ft)),
+	})
+	if err != nil {
+		log.Printf("Failed to presign %s: %v", att.URL, err)
+		return att.URL
+	}
+	return signed
+}
+
+// signUpload fills in signed URLs for a non-public upload and its thumbnails
+func signUpload(att *models.Attachment) {
+	if isPublicUpload(att) {
+		return
+	}
+	att.SignedURL = signUploadURL(att)
+	for i := range att.Thumbnails {
+		att.Thumbnails[i].SignedURL = signUploadURL(&att.Thumbnails[i])
+	}
+}
+
+// signAttachments fills in signed URLs, dimensions and thumbnails for messages with uploaded attachments
+func signAttachments(messages []models.Message) {
+	msgs := make([]*models.Message, len(messages))
+	for i := range messages {
+		msgs[i] = &messages[i]
+	}
+	loadMessageAttachments(msgs)
+}
+
+func signAttachment(msg *models.Message) {
+	loadMessageAttachments([]*models.Message{msg})
+}
+
+func loadMessageAttachments(msgs []*models.Message) {
+	var urls []string
+	for _, msg := range msgs {
+		if strings.HasPrefix(msg.AttachmentURL, "/uploads/") {
+			urls = append(urls, msg.AttachmentURL)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	var atts []models.Attachment
+	database.DB.Preload("Thumbnails", func(db *gorm.DB) *gorm.DB {
+		return db.Order("width")
+	}).Where("url IN ?", urls).Find(&atts)
+	byURL := make(map[string]*models.Attachment, len(atts))
+	for i := range atts {
+		byURL[atts[i].URL] = &atts[i]
+	}
+
+	for _, msg := range msgs {
+		if att, ok := byURL[msg.AttachmentURL]; ok {
+			signUpload(att)
+			msg.AttachmentSigned = att.SignedURL
+			msg.Attachment = att
+		}
+	}
+}
+
+// canViewAttachment reports whether a user may download a non-public upload.
+// Until it is posted only the uploader can see it; afterwards anyone who can see the channel.
+func canViewAttachment(userID uuid.UUID, att *models.Attachment) bool {
+	if userID == uuid.Nil {
+		return false
+	}
+	if att.ChannelID == nil {
+		return att.UploaderID == userID
+	}
+	cv, ok := loadConversation(*att.ChannelID)
+	return ok && cv.canAccess(userID)
+}
+
+// checkMessageAttachment validates an attachment URL on a new message. Uploaded files must be
+// the author's own attachment, not already posted and within the channel's upload limit and
+// the server's storage quota; other URLs are plain links.
+func checkMessageAttachment(authorID uuid.UUID, cv *conversation, url string) string {
+	if !strings.HasPrefix(url, "/uploads/") {
+		return ""
+	}
+
+	var att models.Attachment
+	if err := database.DB.First(&att, "url = ?", url).Error; err != nil || att.UploaderID != authorID || att.Purpose != "attachment" {
+		return "Unknown attachment"
+	}
+	if att.MessageID != nil {
+		return "Attachment is already used by another message"
+	}
+	if limit := uploadLimit(authorID, cv); att.Size > limit {
+		return fmt.Sprintf("Attachments in this channel can be at most %dMB", limit>>20)
+	}
+
+	// Thumbnails count against the server too
+	var size int64
+	database.DB.Model(&models.Attachment{}).Where("id = ? OR parent_id = ?", att.ID, att.ID).
+		Select("COALESCE(SUM(size), 0)").Scan(&size)
+	return checkServerQuota(cv, size)
+}
+
+// linkAttachment ties an uploaded attachment to the message it was posted in
+// and counts it and its thumbnails against the server's storage
+func linkAttachment(tx *gorm.DB, msg *models.Message, serverID *uuid.UUID) error {
+	if !strings.HasPrefix(msg.AttachmentURL, "/uploads/") {
+		return nil
+	}
+	var att models.Attachment
+	if err := tx.Where("url = ? AND uploader_id = ? AND message_id IS NULL", msg.AttachmentURL, msg.AuthorID).First(&att).Error; err != nil {
+		return nil
+	}
+	if err := tx.Model(&att).Updates(map[string]interface{}{"channel_id": msg.ChannelID, "message_id": msg.ID, "server_id": serverID}).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.Attachment{}).Where("parent_id = ?", att.ID).Update("server_id", serverID).Error
+}
+
+// uploadCSP stops anything served from /uploads from running script or loading other resources
+const uploadCSP = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+// downloadName is the file name offered to browsers, keeping the extension the file was checked against
+func downloadName(att *models.Attachment, ft *filetype.Type) string {
+	name := att.Filename
+	if name == "" {
+		name = "file"
+	}
+	if !strings.EqualFold(filepath.Ext(name), ft.Ext) {
+		name += ft.Ext
+	}
+	return name
+}
+
+// contentDisposition forces risky types to download instead of opening in the browser
+func contentDisposition(ft *filetype.Type, name string) string {
+	disposition := "attachment"
+	if ft.Inline {
+		disposition = "inline"
+	}
+	return disposition + "; filename*=UTF-8''" + url.PathEscape(name)
+}
+
+// ServeUpload serves an uploaded file. Avatars and icons are public; attachments need a
+// valid signed URL or a bearer token for someone who can see the channel.
+func ServeUpload(c *fiber.Ctx) error {
+	key := c.Params("*")
+
+	var att models.Attachment
+	if err := database.DB.First(&att, "url = ?", "/uploads/"+key).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	// Thumbnails are visible to whoever can see the image they were made from
+	owner := &att
+	if att.ParentID != nil {
+		var parent models.Attachment
+		if err := database.DB.First(&parent, "id = ?", *att.ParentID).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File not found",
+			})
+		}
+		owner = &parent
+	}
+
+	// Files the user can't see look the same as files that don't exist
+	if !isPublicUpload(owner) && !canViewAttachment(middleware.GetUserID(c), owner) {
+		verifier, ok := storage.Default.(storage.Verifier)
+		if !ok || !verifier.VerifyPresigned(key, c.Query("expires"), c.Query("sig")) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File not found",
+			})
+		}
+	}
+
+	body, err := storage.Default.Open(c.Context(), blobstore.AttachmentKey(&att))
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Failed to open upload %s: %v", key, err)
+		}
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	if isPublicUpload(owner) {
+		c.Set("Cache-Control", "public, max-age=86400")
+	} else {
+		c.Set("Cache-Control", "private, max-age=3600")
+	}
+
+	// The type comes from our own table, never from what the uploader claimed, and browsers
+	// must not sniff past it or run anything the file contains
+	ft := filetype.Lookup(filepath.Ext(key))
+	c.Set(fiber.HeaderContentType, ft.MIME)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, uploadCSP)
+	c.Set(fiber.HeaderContentDisposition, contentDisposition(ft, downloadName(&att, ft)))
+
+	// SendStream closes the body once it has been written
+	if att.Size > 0 {
+		return c.SendStream(body, int(att.Size))
+	}
+	return c.SendStream(body)
+}
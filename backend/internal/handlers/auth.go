@@ -268,10 +268,11 @@ func UpdateCurrentUser(c *fiber.Ctx) error {
 	userID := middleware.GetUserID(c)
 
 	type UpdateRequest struct {
-		DisplayName *string `json:"display_name"`
-		AvatarURL   *string `json:"avatar_url"`
-		Bio         *string `json:"bio"`
-		Status      *string `json:"status"`
+		DisplayName  *string `json:"display_name"`
+		AvatarURL    *string `json:"avatar_url"`
+		Bio          *string `json:"bio"`
+		Status       *string `json:"status"`
+		SendReceipts *bool   `json:"send_receipts"`
 	}
 
 	var req UpdateRequest
@@ -300,6 +301,9 @@ func UpdateCurrentUser(c *fiber.Ctx) error {
 		}
 		updates["status"] = *req.Status
 	}
+	if req.SendReceipts != nil {
+		updates["send_receipts"] = *req.SendReceipts
+	}
 
 	if len(updates) == 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 
 	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/eventhooks"
 	"github.com/shitcord/backend/internal/middleware"
 	"github.com/shitcord/backend/internal/models"
 	"github.com/shitcord/backend/internal/ws"
@@ -157,10 +160,11 @@ func UpdateChannel(c *fiber.Ctx) error {
 	}
 
 	type UpdateRequest struct {
-		Name      *string `json:"name"`
-		Topic     *string `json:"topic"`
-		Position  *int    `json:"position"`
-		IsPrivate *bool   `json:"is_private"`
+		Name       *string `json:"name"`
+		Topic      *string `json:"topic"`
+		Position   *int    `json:"position"`
+		IsPrivate  *bool   `json:"is_private"`
+		MessageTTL *int    `json:"message_ttl"`
 	}
 
 	var req UpdateRequest
@@ -185,9 +189,30 @@ func UpdateChannel(c *fiber.Ctx) error {
 	}
 
 	var channel models.Channel
-	database.DB.Model(&channel).Where("id = ? AND server_id = ?", channelID, serverID).Updates(updates)
+	if err := database.DB.Where("id = ? AND server_id = ?", channelID, serverID).First(&channel).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+	}
+
+	ttlChanged := false
+	if req.MessageTTL != nil {
+		if !validMessageTTL(*req.MessageTTL) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Disappearing message timer must be 0 or between 5 minutes and 4 weeks",
+			})
+		}
+		ttlChanged = *req.MessageTTL != channel.MessageTTL
+		updates["message_ttl"] = *req.MessageTTL
+	}
+
+	database.DB.Model(&channel).Updates(updates)
 	database.DB.First(&channel, "id = ?", channelID)
 
+	if ttlChanged {
+		recordMessageTTLChange(channel.ID, userID, channel.MessageTTL)
+	}
+
 	return c.JSON(channel)
 }
 
@@ -214,8 +239,9 @@ func DeleteChannel(c *fiber.Ctx) error {
 		})
 	}
 
-	// Delete messages first
+	// Delete messages and webhooks first
 	database.DB.Where("channel_id = ?", channelID).Delete(&models.Message{})
+	database.DB.Where("channel_id = ?", channelID).Delete(&models.Webhook{})
 	database.DB.Where("id = ? AND server_id = ?", channelID, serverID).Delete(&models.Channel{})
 
 	return c.JSON(fiber.Map{"message": "Channel deleted successfully"})
@@ -230,6 +256,14 @@ func GetMessages(c *fiber.Ctx) error {
 		})
 	}
 
+	userID := middleware.GetUserID(c)
+	cv, ok := loadConversation(channelID)
+	if !ok || !cv.canAccess(userID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+	}
+
 	limit, _ := strconv.Atoi(c.Query("limit", "50"))
 	if limit > 100 {
 		limit = 100
@@ -240,7 +274,11 @@ func GetMessages(c *fiber.Ctx) error {
 
 	beforeID := c.Query("before")
 
-	query := database.DB.Where("channel_id = ?", channelID).
+	// Expired messages stay hidden even before the reaper gets to them,
+	// and other people's ephemeral messages are never shown
+	query := withPoll(database.DB).Where("channel_id = ?", channelID).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Scopes(visibleTo(userID)).
 		Preload("Author").
 		Preload("ReplyTo").
 		Preload("ReplyTo.Author").
@@ -264,9 +302,68 @@ func GetMessages(c *fiber.Ctx) error {
 		messages[i], messages[j] = messages[j], messages[i]
 	}
 
+	attachReceipts(channelID, messages)
+	attachPollVotes(userID, messages)
+	signAttachments(messages)
+
 	return c.JSON(messages)
 }
 
+// SendMessageRequest is the message payload clients send, encrypted client-side.
+// Scheduled messages store the same payload until it is due.
+type SendMessageRequest struct {
+	Content          string                  `json:"content"`
+	Nonce            string                  `json:"nonce"`
+	EncryptionHeader string                  `json:"encryption_header"`
+	Type             string                  `json:"type"`
+	AttachmentURL    string                  `json:"attachment_url"`
+	ReplyToID        *uuid.UUID              `json:"reply_to_id"`
+	Mentions         *models.MentionMetadata `json:"mentions"`
+	RequestReceipts  bool                    `json:"request_receipts"`
+	Poll             *models.PollSpec        `json:"poll"`
+}
+
+// validate checks the payload against the conversation and resolves who gets mentioned.
+// The returned string is a client-facing error message when validation fails.
+func (req *SendMessageRequest) validate(authorID uuid.UUID, cv *conversation) (map[uuid.UUID]string, string) {
+	if req.Content == "" && req.AttachmentURL == "" && req.Poll == nil {
+		return nil, "Message content cannot be empty"
+	}
+
+	if req.Type == "" {
+		req.Type = "text"
+		if req.Poll != nil {
+			req.Type = "poll"
+		}
+	}
+
+	// System messages come only from the server
+	validTypes := map[string]bool{"text": true, "image": true, "file": true, "poll": true}
+	if !validTypes[req.Type] {
+		return nil, "Invalid message type. Must be: text, image, file, or poll"
+	}
+
+	if (req.Type == "poll") != (req.Poll != nil) {
+		return nil, "Poll messages must have type poll and a poll definition"
+	}
+	if req.Poll != nil {
+		if errMsg := validatePoll(req.Poll); errMsg != "" {
+			return nil, errMsg
+		}
+	}
+
+	if req.RequestReceipts && !cv.isDM() {
+		return nil, "Receipts can only be requested in direct messages"
+	}
+
+	if errMsg := checkMessageAttachment(authorID, cv, req.AttachmentURL); errMsg != "" {
+		return nil, errMsg
+	}
+
+	// Mention metadata is plaintext, so validate it before storing anything
+	return resolveMentions(authorID, cv, req.Mentions)
+}
+
 // SendMessage sends a new message to a channel
 func SendMessage(c *fiber.Ctx) error {
 	userID := middleware.GetUserID(c)
@@ -277,58 +374,103 @@ func SendMessage(c *fiber.Ctx) error {
 		})
 	}
 
-	type SendRequest struct {
-		Content          string     `json:"content"`
-		Nonce            string     `json:"nonce"`
-		EncryptionHeader string     `json:"encryption_header"`
-		Type             string     `json:"type"`
-		AttachmentURL    string     `json:"attachment_url"`
-		ReplyToID        *uuid.UUID `json:"reply_to_id"`
-	}
-
-	var req SendRequest
+	var req SendMessageRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
 
-	if req.Content == "" && req.AttachmentURL == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Message content cannot be empty",
+	cv, ok := loadConversation(channelID)
+	if !ok || !cv.canAccess(userID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
 		})
 	}
 
-	if req.Type == "" {
-		req.Type = "text"
-	}
-
-	msg := models.Message{
-		ChannelID:        channelID,
-		AuthorID:         userID,
-		Content:          req.Content,
-		Nonce:            req.Nonce,
-		EncryptionHeader: req.EncryptionHeader,
-		Type:             req.Type,
-		AttachmentURL:    req.AttachmentURL,
-		ReplyToID:        req.ReplyToID,
+	mentionRecipients, errMsg := req.validate(userID, cv)
+	if errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
 	}
 
-	if err := database.DB.Create(&msg).Error; err != nil {
+	msg := models.Message{AuthorID: userID}
+	if err := publishMessage(&msg, cv, &req, mentionRecipients, userID); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to send message",
 		})
 	}
 
+	return c.Status(fiber.StatusCreated).JSON(msg)
+}
+
+// publishMessage stores a validated message and fans it out: WebSocket broadcast,
+// mention inbox and the author's read state. msg must have AuthorID set; a preset ID is kept.
+// excludeID is left out of the broadcast, normally the author who already has the REST response.
+func publishMessage(msg *models.Message, cv *conversation, req *SendMessageRequest, mentionRecipients map[uuid.UUID]string, excludeID uuid.UUID) error {
+	channelID := cv.id()
+	userID := msg.AuthorID
+
+	msg.ChannelID = channelID
+	msg.Content = req.Content
+	msg.Nonce = req.Nonce
+	msg.EncryptionHeader = req.EncryptionHeader
+	msg.Type = req.Type
+	msg.AttachmentURL = req.AttachmentURL
+	msg.ReplyToID = req.ReplyToID
+	msg.Mentions = req.Mentions
+	msg.RequestReceipts = req.RequestReceipts
+	msg.ExpiresAt = messageExpiry(cv.messageTTL())
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(msg).Error; err != nil {
+			return err
+		}
+		if err := linkAttachment(tx, msg, cv.serverID()); err != nil {
+			return err
+		}
+		if req.Poll != nil {
+			poll := newPoll(msg, req.Poll)
+			return tx.Create(&poll).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	// Reload with author
-	database.DB.Preload("Author").Preload("ReplyTo").Preload("ReplyTo.Author").First(&msg, "id = ?", msg.ID)
+	withPoll(database.DB).Preload("Author").Preload("ReplyTo").Preload("ReplyTo.Author").First(msg, "id = ?", msg.ID)
+	signAttachment(msg)
 
-	// Broadcast to all subscribers of this channel via WebSocket
+	// Broadcast to all subscribers of this channel via WebSocket.
+	// DM deliveries are tracked so senders can get delivered receipts.
 	if ws.GlobalHub != nil {
-		ws.GlobalHub.BroadcastToChannel(channelID.String(), ws.EventMessage, msg, userID)
+		if cv.isDM() {
+			delivered := *msg
+			ws.GlobalHub.BroadcastToChannelWithDelivery(channelID.String(), ws.EventMessage, delivered, excludeID, func(userIDs []uuid.UUID) {
+				ws.MarkDelivered(&delivered, userIDs)
+			})
+		} else {
+			ws.GlobalHub.BroadcastToChannel(channelID.String(), ws.EventMessage, *msg, excludeID)
+		}
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(msg)
+	// Only plaintext messages can leave the server through event hooks
+	if msg.IsPlaintext && !cv.isDM() {
+		eventhooks.Emit(cv.Channel.ServerID, channelID.String(), eventhooks.EventMessageCreate, msg)
+	}
+
+	// Feed the mention inbox of everyone who was mentioned
+	createMentions(msg, cv, mentionRecipients)
+
+	// Authors have read their own message
+	if msg.WebhookID == nil {
+		ws.AckMessage(userID, channelID, msg.ID)
+	}
+
+	return nil
 }
 
 // EditMessage edits an existing message
@@ -348,7 +490,7 @@ func EditMessage(c *fiber.Ctx) error {
 		})
 	}
 
-	if msg.AuthorID != userID {
+	if msg.AuthorID != userID || msg.WebhookID != nil || msg.IsEphemeral {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
 			"error": "You can only edit your own messages",
 		})
@@ -374,7 +516,8 @@ func EditMessage(c *fiber.Ctx) error {
 		"is_edited":         true,
 	})
 
-	database.DB.Preload("Author").First(&msg, "id = ?", msg.ID)
+	withPoll(database.DB).Preload("Author").First(&msg, "id = ?", msg.ID)
+	signAttachment(&msg)
 
 	// Broadcast edit to all subscribers of this channel via WebSocket
 	if ws.GlobalHub != nil {
@@ -401,16 +544,21 @@ func DeleteMessage(c *fiber.Ctx) error {
 		})
 	}
 
+	if msg.IsEphemeral {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Ephemeral messages can only be dismissed",
+		})
+	}
+
 	// Authors can delete their own messages, admins can delete any
-	if msg.AuthorID != userID {
+	var channel models.Channel
+	isServerChannel := database.DB.First(&channel, "id = ?", msg.ChannelID).Error == nil
+	if msg.AuthorID != userID && isServerChannel {
 		// Check if user is admin/mod in the channel's server
-		var channel models.Channel
-		if err := database.DB.First(&channel, "id = ?", msg.ChannelID).Error; err == nil {
-			if !hasPermission(userID, channel.ServerID, "moderator") {
-				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-					"error": "Insufficient permissions",
-				})
-			}
+		if !hasPermission(userID, channel.ServerID, "moderator") {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Insufficient permissions",
+			})
 		}
 	}
 
@@ -418,6 +566,23 @@ func DeleteMessage(c *fiber.Ctx) error {
 	messageIDStr := msg.ID.String()
 	database.DB.Delete(&msg)
 
+	if isServerChannel {
+		if msg.IsPlaintext {
+			eventhooks.Emit(channel.ServerID, channelIDStr, eventhooks.EventMessageDelete, map[string]interface{}{
+				"message_id": messageIDStr,
+				"channel_id": channelIDStr,
+			})
+		}
+		if msg.AuthorID != userID {
+			eventhooks.Emit(channel.ServerID, channelIDStr, eventhooks.EventModMessageDelete, map[string]interface{}{
+				"message_id":   messageIDStr,
+				"channel_id":   channelIDStr,
+				"author_id":    msg.AuthorID,
+				"moderator_id": userID,
+			})
+		}
+	}
+
 	// Broadcast delete to all subscribers of this channel via WebSocket
 	if ws.GlobalHub != nil {
 		ws.GlobalHub.BroadcastToChannel(channelIDStr, ws.EventMessageDelete, map[string]interface{}{
@@ -428,64 +593,3 @@ func DeleteMessage(c *fiber.Ctx) error {
 
 	return c.JSON(fiber.Map{"message": "Message deleted successfully"})
 }
-
-// GetDMChannels returns all DM channels for the current user
-func GetDMChannels(c *fiber.Ctx) error {
-	userID := middleware.GetUserID(c)
-
-	var dms []models.DMChannel
-	database.DB.Where("user1_id = ? OR user2_id = ?", userID, userID).
-		Preload("User1").Preload("User2").
-		Find(&dms)
-
-	return c.JSON(dms)
-}
-
-// CreateDMChannel creates a direct message channel between two users
-func CreateDMChannel(c *fiber.Ctx) error {
-	userID := middleware.GetUserID(c)
-
-	type DMRequest struct {
-		RecipientID uuid.UUID `json:"recipient_id"`
-	}
-
-	var req DMRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request body",
-		})
-	}
-
-	if req.RecipientID == userID {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Cannot create a DM with yourself",
-		})
-	}
-
-	// Check if DM already exists
-	var existing models.DMChannel
-	err := database.DB.Where(
-		"(user1_id = ? AND user2_id = ?) OR (user1_id = ? AND user2_id = ?)",
-		userID, req.RecipientID, req.RecipientID, userID,
-	).First(&existing).Error
-
-	if err == nil {
-		database.DB.Preload("User1").Preload("User2").First(&existing, "id = ?", existing.ID)
-		return c.JSON(existing)
-	}
-
-	dm := models.DMChannel{
-		User1ID: userID,
-		User2ID: req.RecipientID,
-	}
-
-	if err := database.DB.Create(&dm).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create DM channel",
-		})
-	}
-
-	database.DB.Preload("User1").Preload("User2").First(&dm, "id = ?", dm.ID)
-
-	return c.Status(fiber.StatusCreated).JSON(dm)
-}
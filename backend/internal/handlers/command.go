@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/crypto"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/eventhooks"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// Application command limits
+const (
+	maxServerCommands  = 100
+	maxCommandOptions  = 25
+	maxCommandChoices  = 25
+	maxCommandDescLen  = 100
+	maxOptionStringLen = 1000
+)
+
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var commandOptionTypes = map[string]bool{
+	"string":  true,
+	"integer": true,
+	"number":  true,
+	"boolean": true,
+	"user":    true,
+	"channel": true,
+}
+
+// validateCommand checks a command definition and returns a client-facing error if it is invalid
+func validateCommand(name, description string, options []models.CommandOption) string {
+	if !commandNamePattern.MatchString(name) {
+		return "Command name must be 1-32 lowercase letters, digits, dashes or underscores"
+	}
+	if len(description) > maxCommandDescLen {
+		return "Command description must be at most 100 characters"
+	}
+	if len(options) > maxCommandOptions {
+		return "Commands can have at most " + strconv.Itoa(maxCommandOptions) + " options"
+	}
+
+	seen := make(map[string]bool)
+	for _, opt := range options {
+		if !commandNamePattern.MatchString(opt.Name) {
+			return "Option name must be 1-32 lowercase letters, digits, dashes or underscores"
+		}
+		if seen[opt.Name] {
+			return "Duplicate option: " + opt.Name
+		}
+		seen[opt.Name] = true
+
+		if !commandOptionTypes[opt.Type] {
+			return "Unknown option type: " + opt.Type
+		}
+		if len(opt.Description) > maxCommandDescLen {
+			return "Option description must be at most 100 characters"
+		}
+		if len(opt.Choices) > 0 && opt.Type != "string" {
+			return "Only string options can have choices"
+		}
+		if len(opt.Choices) > maxCommandChoices {
+			return "Options can have at most " + strconv.Itoa(maxCommandChoices) + " choices"
+		}
+	}
+	return ""
+}
+
+// CreateCommand registers an application command on a server.
+// The callback signing secret is only shown in this response.
+func CreateCommand(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	serverID, err := uuid.Parse(c.Params("serverId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid server ID",
+		})
+	}
+
+	if !hasPermission(userID, serverID, "admin") {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Insufficient permissions",
+		})
+	}
+
+	type CreateRequest struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Options     []models.CommandOption `json:"options"`
+		CallbackURL string                 `json:"callback_url"`
+	}
+
+	var req CreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if errMsg := validateCommand(req.Name, req.Description, req.Options); errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	if req.CallbackURL != "" {
+		if err := eventhooks.ValidateURL(req.CallbackURL); err != nil || len(req.CallbackURL) > 1024 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid callback URL: must be an absolute https URL on a public address",
+			})
+		}
+	}
+
+	var count int64
+	database.DB.Model(&models.ApplicationCommand{}).Where("server_id = ?", serverID).Count(&count)
+	if count >= maxServerCommands {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Servers can have at most " + strconv.Itoa(maxServerCommands) + " commands",
+		})
+	}
+
+	var existing int64
+	database.DB.Model(&models.ApplicationCommand{}).Where("server_id = ? AND name = ?", serverID, req.Name).Count(&existing)
+	if existing > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A command with this name already exists",
+		})
+	}
+
+	secret, err := crypto.GenerateSecretToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate signing secret",
+		})
+	}
+
+	if req.Options == nil {
+		req.Options = []models.CommandOption{}
+	}
+
+	cmd := models.ApplicationCommand{
+		ServerID:    serverID,
+		OwnerID:     userID,
+		Name:        req.Name,
+		Description: req.Description,
+		Options:     req.Options,
+		CallbackURL: req.CallbackURL,
+		Secret:      secret,
+	}
+
+	if err := database.DB.Create(&cmd).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create command",
+		})
+	}
+
+	database.DB.Preload("Owner").First(&cmd, "id = ?", cmd.ID)
+	cmd.Secret = secret
+
+	return c.Status(fiber.StatusCreated).JSON(cmd)
+}
+
+// GetCommands lists a server's application commands for its members, without secrets
+func GetCommands(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	serverID, err := uuid.Parse(c.Params("serverId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid server ID",
+		})
+	}
+
+	if !isMember(userID, serverID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Not a member of this server",
+		})
+	}
+
+	var commands []models.ApplicationCommand
+	database.DB.Where("server_id = ?", serverID).Preload("Owner").Order("name ASC").Find(&commands)
+	for i := range commands {
+		commands[i].Secret = ""
+	}
+
+	return c.JSON(commands)
+}
+
+// UpdateCommand changes a command's description, options or callback URL
+func UpdateCommand(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	cmd, errResp := commandForAdmin(c, userID)
+	if cmd == nil {
+		return errResp
+	}
+
+	type UpdateRequest struct {
+		Description *string                `json:"description"`
+		Options     []models.CommandOption `json:"options"`
+		CallbackURL *string                `json:"callback_url"`
+	}
+
+	var req UpdateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Description != nil {
+		cmd.Description = *req.Description
+	}
+	if req.Options != nil {
+		cmd.Options = req.Options
+	}
+	if req.CallbackURL != nil {
+		if *req.CallbackURL != "" {
+			if err := eventhooks.ValidateURL(*req.CallbackURL); err != nil || len(*req.CallbackURL) > 1024 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid callback URL: must be an absolute https URL on a public address",
+				})
+			}
+		}
+		cmd.CallbackURL = *req.CallbackURL
+	}
+
+	if errMsg := validateCommand(cmd.Name, cmd.Description, cmd.Options); errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	if err := database.DB.Model(cmd).Select("description", "options", "callback_url").Updates(cmd).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update command",
+		})
+	}
+
+	database.DB.Preload("Owner").First(cmd, "id = ?", cmd.ID)
+	cmd.Secret = ""
+
+	return c.JSON(cmd)
+}
+
+// DeleteCommand unregisters a command. Pending interactions can no longer be answered.
+func DeleteCommand(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	cmd, errResp := commandForAdmin(c, userID)
+	if cmd == nil {
+		return errResp
+	}
+
+	database.DB.Where("command_id = ?", cmd.ID).Delete(&models.Interaction{})
+	database.DB.Delete(cmd)
+
+	return c.JSON(fiber.Map{"message": "Command deleted successfully"})
+}
+
+// commandForAdmin loads the :commandId command of the :serverId server and checks
+// the user is an admin there. On failure it returns nil and the error response to send.
+func commandForAdmin(c *fiber.Ctx, userID uuid.UUID) (*models.ApplicationCommand, error) {
+	serverID, err := uuid.Parse(c.Params("serverId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid server ID",
+		})
+	}
+
+	commandID, err := uuid.Parse(c.Params("commandId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid command ID",
+		})
+	}
+
+	if !hasPermission(userID, serverID, "admin") {
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Insufficient permissions",
+		})
+	}
+
+	var cmd models.ApplicationCommand
+	if err := database.DB.First(&cmd, "id = ? AND server_id = ?", commandID, serverID).Error; err != nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Command not found",
+		})
+	}
+
+	return &cmd, nil
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/access"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// conversation adds what handlers need to know about a channel to access.Conversation
+type conversation struct {
+	*access.Conversation
+}
+
+// loadConversation looks up a channel ID as a server channel first, then as a DM channel
+func loadConversation(channelID uuid.UUID) (*conversation, bool) {
+	cv, ok := access.LoadConversation(channelID)
+	if !ok {
+		return nil, false
+	}
+	return &conversation{cv}, true
+}
+
+// isDM reports whether the conversation is a direct message channel
+func (cv *conversation) isDM() bool {
+	return cv.DM != nil
+}
+
+// serverID returns the owning server ID, or nil for DMs
+func (cv *conversation) serverID() *uuid.UUID {
+	if cv.Channel == nil {
+		return nil
+	}
+	id := cv.Channel.ServerID
+	return &id
+}
+
+// canAccess reports whether a user may read and post in the conversation
+func (cv *conversation) canAccess(userID uuid.UUID) bool {
+	return cv.CanAccess(userID)
+}
+
+// memberIDs returns every user who can see the conversation
+func (cv *conversation) memberIDs() []uuid.UUID {
+	if cv.DM != nil {
+		return dmParticipantIDs(cv.DM.ID)
+	}
+
+	var ids []uuid.UUID
+	database.DB.Model(&models.ServerMember{}).
+		Where("server_id = ?", cv.Channel.ServerID).
+		Pluck("user_id", &ids)
+	return ids
+}
+
+// messageTTL returns the disappearing messages timer in seconds, 0 when it is off
+func (cv *conversation) messageTTL() int {
+	if cv.DM != nil {
+		return cv.DM.MessageTTL
+	}
+	return cv.Channel.MessageTTL
+}
+
+// id returns the channel ID that messages in this conversation are posted to
+func (cv *conversation) id() uuid.UUID {
+	if cv.DM != nil {
+		return cv.DM.ID
+	}
+	return cv.Channel.ID
+}
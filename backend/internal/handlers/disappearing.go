@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/blobstore"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/storage"
+	"github.com/shitcord/backend/internal/ws"
+)
+
+// Disappearing message timers are stored in seconds
+const (
+	minMessageTTL = 5 * 60
+	maxMessageTTL = 4 * 7 * 24 * 60 * 60
+
+	// How often the reaper looks for expired messages, and how many it removes per pass
+	reaperInterval  = 30 * time.Second
+	reaperBatchSize = 500
+)
+
+// validMessageTTL reports whether a timer is off (0) or within the allowed range
+func validMessageTTL(seconds int) bool {
+	return seconds == 0 || (seconds >= minMessageTTL && seconds <= maxMessageTTL)
+}
+
+// messageExpiry returns when a message sent now should disappear, or nil if the timer is off
+func messageExpiry(ttl int) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	expiresAt := time.Now().Add(time.Duration(ttl) * time.Second)
+	return &expiresAt
+}
+
+// createSystemMessage stores a server-generated message and broadcasts it to the channel.
+// The content is plaintext JSON describing the event; clients render it themselves.
+func createSystemMessage(channelID, actorID uuid.UUID, content map[string]interface{}) *models.Message {
+	body, _ := json.Marshal(content)
+
+	msg := models.Message{
+		ChannelID: channelID,
+		AuthorID:  actorID,
+		Content:   string(body),
+		Type:      "system",
+	}
+
+	if err := database.DB.Create(&msg).Error; err != nil {
+		return nil
+	}
+
+	database.DB.Preload("Author").First(&msg, "id = ?", msg.ID)
+
+	if ws.GlobalHub != nil {
+		ws.GlobalHub.BroadcastToChannel(channelID.String(), ws.EventMessage, msg, uuid.Nil)
+	}
+
+	return &msg
+}
+
+// recordMessageTTLChange posts the system message for a disappearing messages timer change
+func recordMessageTTLChange(channelID, actorID uuid.UUID, ttl int) {
+	createSystemMessage(channelID, actorID, map[string]interface{}{
+		"event":       "message_ttl_update",
+		"message_ttl": ttl,
+	})
+}
+
+// RunMessageReaper hard-deletes expired messages in the background. It never returns.
+func RunMessageReaper() {
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reapExpiredMessages()
+	}
+}
+
+// reapExpiredMessages removes every message past its expiry, including soft-deleted ones,
+// along with their mentions and uploaded attachments
+func reapExpiredMessages() {
+	for {
+		var messages []models.Message
+		database.DB.Unscoped().
+			Where("expires_at IS NOT NULL AND expires_at <= ?", time.Now()).
+			Order("expires_at ASC").
+			Limit(reaperBatchSize).
+			Find(&messages)
+
+		if len(messages) == 0 {
+			return
+		}
+
+		for _, msg := range messages {
+			database.DB.Where("message_id = ?", msg.ID).Delete(&models.Mention{})
+			deletePoll(msg.ID)
+			if err := database.DB.Unscoped().Delete(&msg).Error; err != nil {
+				log.Printf("Failed to reap message %s: %v", msg.ID, err)
+				return
+			}
+			removeUpload(msg.AttachmentURL)
+
+			// Soft-deleted messages were already removed from clients
+			if ws.GlobalHub != nil && !msg.DeletedAt.Valid {
+				data := map[string]interface{}{
+					"message_id": msg.ID.String(),
+					"channel_id": msg.ChannelID.String(),
+				}
+				if msg.VisibleToID != nil {
+					ws.GlobalHub.SendToUser(*msg.VisibleToID, ws.EventMessageDelete, data)
+				} else {
+					ws.GlobalHub.BroadcastToChannel(msg.ChannelID.String(), ws.EventMessageDelete, data, uuid.Nil)
+				}
+			}
+		}
+
+		if len(messages) < reaperBatchSize {
+			return
+		}
+	}
+}
+
+// removeUpload deletes a file that UploadFile stored along with its thumbnails and attachment records,
+// ignoring URLs that aren't uploads
+func removeUpload(url string) {
+	if storage.KeyFromURL(url) == "" {
+		return
+	}
+	att := models.Attachment{URL: url}
+	if err := database.DB.Preload("Thumbnails").First(&att, "url = ?", url).Error; err == nil {
+		database.DB.Where("id = ? OR parent_id = ?", att.ID, att.ID).Delete(&models.Attachment{})
+		for i := range att.Thumbnails {
+			blobstore.Remove(context.Background(), &att.Thumbnails[i])
+		}
+	}
+	blobstore.Remove(context.Background(), &att)
+}
@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/access"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/ws"
+)
+
+// maxGroupDMParticipants returns how many users a group DM can hold, including the owner
+func maxGroupDMParticipants() int {
+	if n, err := strconv.Atoi(os.Getenv("GROUP_DM_MAX_PARTICIPANTS")); err == nil && n >= 3 {
+		return n
+	}
+	return 10
+}
+
+// GetDMChannels returns all DM channels for the current user
+func GetDMChannels(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var dms []models.DMChannel
+	database.DB.Where("id IN (?)", database.DB.Model(&models.DMParticipant{}).Select("dm_channel_id").Where("user_id = ?", userID)).
+		Preload("User1").Preload("User2").Preload("Participants.User").
+		Find(&dms)
+
+	return c.JSON(dms)
+}
+
+// CreateDMChannel creates a 1:1 DM with one recipient, or a group DM with several
+func CreateDMChannel(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	type DMRequest struct {
+		RecipientID  uuid.UUID   `json:"recipient_id"`
+		RecipientIDs []uuid.UUID `json:"recipient_ids"`
+		Name         string      `json:"name"`
+	}
+
+	var req DMRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Accept both the single recipient_id and a recipient_ids list
+	seen := map[uuid.UUID]bool{}
+	var recipients []uuid.UUID
+	for _, id := range append(req.RecipientIDs, req.RecipientID) {
+		if id == uuid.Nil || seen[id] {
+			continue
+		}
+		if id == userID {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Cannot create a DM with yourself",
+			})
+		}
+		seen[id] = true
+		recipients = append(recipients, id)
+	}
+
+	if len(recipients) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one recipient is required",
+		})
+	}
+
+	if len(recipients)+1 > maxGroupDMParticipants() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Group DMs can have at most " + strconv.Itoa(maxGroupDMParticipants()) + " participants",
+		})
+	}
+
+	var found int64
+	database.DB.Model(&models.User{}).Where("id IN ?", recipients).Count(&found)
+	if int(found) != len(recipients) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Recipient not found",
+		})
+	}
+
+	if len(recipients) == 1 && req.Name == "" {
+		return createDirectDM(c, userID, recipients[0])
+	}
+
+	dm := models.DMChannel{
+		IsGroup: true,
+		OwnerID: &userID,
+		Name:    req.Name,
+	}
+
+	tx := database.DB.Begin()
+	if err := tx.Create(&dm).Error; err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create DM channel",
+		})
+	}
+
+	participants := []models.DMParticipant{{DMChannelID: dm.ID, UserID: userID}}
+	for _, id := range recipients {
+		participants = append(participants, models.DMParticipant{DMChannelID: dm.ID, UserID: id})
+	}
+	if err := tx.Create(&participants).Error; err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add participants",
+		})
+	}
+	tx.Commit()
+
+	loadDMChannel(&dm)
+	notifyDMParticipants(dm.ID, ws.EventDMCreate, dm)
+
+	return c.Status(fiber.StatusCreated).JSON(dm)
+}
+
+// createDirectDM returns the existing 1:1 DM between two users, or creates it
+func createDirectDM(c *fiber.Ctx, userID, recipientID uuid.UUID) error {
+	// Check if DM already exists
+	var existing models.DMChannel
+	err := database.DB.Where(
+		"(user1_id = ? AND user2_id = ?) OR (user1_id = ? AND user2_id = ?)",
+		userID, recipientID, recipientID, userID,
+	).First(&existing).Error
+
+	if err == nil {
+		loadDMChannel(&existing)
+		return c.JSON(existing)
+	}
+
+	dm := models.DMChannel{
+		User1ID: &userID,
+		User2ID: &recipientID,
+	}
+
+	tx := database.DB.Begin()
+	if err := tx.Create(&dm).Error; err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create DM channel",
+		})
+	}
+
+	participants := []models.DMParticipant{
+		{DMChannelID: dm.ID, UserID: userID},
+		{DMChannelID: dm.ID, UserID: recipientID},
+	}
+	if err := tx.Create(&participants).Error; err != nil {
+		tx.Rollback()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add participants",
+		})
+	}
+	tx.Commit()
+
+	loadDMChannel(&dm)
+
+	return c.Status(fiber.StatusCreated).JSON(dm)
+}
+
+// UpdateDMChannel changes a DM's disappearing messages timer, or a group DM's name and icon
+func UpdateDMChannel(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	dm, errResp := dmForParticipant(c, userID)
+	if dm == nil {
+		return errResp
+	}
+
+	type UpdateRequest struct {
+		Name       *string `json:"name"`
+		IconURL    *string `json:"icon_url"`
+		MessageTTL *int    `json:"message_ttl"`
+	}
+
+	var req UpdateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if !dm.IsGroup && (req.Name != nil || req.IconURL != nil) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Only group DMs have a name and icon",
+		})
+	}
+
+	updates := map[string]interface{}{}
+	ttlChanged := false
+	if req.MessageTTL != nil {
+		if !validMessageTTL(*req.MessageTTL) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Disappearing message timer must be 0 or between 5 minutes and 4 weeks",
+			})
+		}
+		ttlChanged = *req.MessageTTL != dm.MessageTTL
+		updates["message_ttl"] = *req.MessageTTL
+	}
+	if req.Name != nil {
+		if len(*req.Name) > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Name must be at most 100 characters",
+			})
+		}
+		updates["name"] = *req.Name
+	}
+	if req.IconURL != nil {
+		updates["icon_url"] = *req.IconURL
+	}
+
+	if len(updates) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No fields to update",
+		})
+	}
+
+	database.DB.Model(dm).Updates(updates)
+	loadDMChannel(dm)
+	notifyDMParticipants(dm.ID, ws.EventDMUpdate, dm)
+
+	if ttlChanged {
+		recordMessageTTLChange(dm.ID, userID, dm.MessageTTL)
+	}
+
+	return c.JSON(dm)
+}
+
+// AddDMParticipant adds a user to a group DM. Any participant can add people.
+func AddDMParticipant(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	dm, errResp := groupDMForParticipant(c, userID)
+	if dm == nil {
+		return errResp
+	}
+
+	type AddRequest struct {
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	var req AddRequest
+	if err := c.BodyParser(&req); err != nil || req.UserID == uuid.Nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, "id = ?", req.UserID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if isDMParticipant(req.UserID, dm.ID) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User is already in this group DM",
+		})
+	}
+
+	if len(dmParticipantIDs(dm.ID)) >= maxGroupDMParticipants() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Group DMs can have at most " + strconv.Itoa(maxGroupDMParticipants()) + " participants",
+		})
+	}
+
+	participant := models.DMParticipant{DMChannelID: dm.ID, UserID: req.UserID}
+	if err := database.DB.Create(&participant).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add participant",
+		})
+	}
+	participant.User = user
+
+	notifyDMParticipants(dm.ID, ws.EventDMParticipantAdd, fiber.Map{
+		"dm_channel_id": dm.ID,
+		"participant":   participant,
+		"added_by":      userID,
+	})
+
+	// The new participant gets the full channel so they can render it
+	loadDMChannel(dm)
+	if ws.GlobalHub != nil {
+		ws.GlobalHub.SendToUser(req.UserID, ws.EventDMCreate, dm)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(participant)
+}
+
+// RemoveDMParticipant removes someone from a group DM (owner only)
+func RemoveDMParticipant(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	dm, errResp := groupDMForParticipant(c, userID)
+	if dm == nil {
+		return errResp
+	}
+
+	targetID, err := uuid.Parse(c.Params("userId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if dm.OwnerID == nil || *dm.OwnerID != userID {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the group owner can remove participants",
+		})
+	}
+
+	if targetID == userID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Use leave to remove yourself",
+		})
+	}
+
+	if !isDMParticipant(targetID, dm.ID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User is not in this group DM",
+		})
+	}
+
+	removeDMParticipant(dm, targetID, userID)
+
+	return c.JSON(fiber.Map{"message": "Participant removed"})
+}
+
+// LeaveDMChannel removes the current user from a group DM. If the owner leaves,
+// ownership passes to the longest-standing participant; the last one out deletes the group.
+func LeaveDMChannel(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	dm, errResp := groupDMForParticipant(c, userID)
+	if dm == nil {
+		return errResp
+	}
+
+	removeDMParticipant(dm, userID, userID)
+
+	return c.JSON(fiber.Map{"message": "Left group DM"})
+}
+
+// removeDMParticipant takes a user out of a group DM and tells everyone involved
+func removeDMParticipant(dm *models.DMChannel, targetID, actorID uuid.UUID) {
+	database.DB.Where("dm_channel_id = ? AND user_id = ?", dm.ID, targetID).Delete(&models.DMParticipant{})
+
+	if ws.GlobalHub != nil {
+		ws.GlobalHub.UnsubscribeUser(targetID, dm.ID.String())
+		ws.GlobalHub.SendToUser(targetID, ws.EventDMParticipantRemove, fiber.Map{
+			"dm_channel_id": dm.ID,
+			"user_id":       targetID,
+			"removed_by":    actorID,
+		})
+	}
+
+	var next models.DMParticipant
+	if err := database.DB.Where("dm_channel_id = ?", dm.ID).Order("joined_at ASC").First(&next).Error; err != nil {
+		// Nobody left, so the group goes away
+		database.DB.Where("channel_id = ?", dm.ID).Delete(&models.Message{})
+		database.DB.Delete(dm)
+		return
+	}
+
+	if dm.OwnerID != nil && *dm.OwnerID == targetID {
+		database.DB.Model(dm).Update("owner_id", next.UserID)
+		dm.OwnerID = &next.UserID
+	}
+
+	notifyDMParticipants(dm.ID, ws.EventDMParticipantRemove, fiber.Map{
+		"dm_channel_id": dm.ID,
+		"user_id":       targetID,
+		"removed_by":    actorID,
+		"owner_id":      dm.OwnerID,
+	})
+}
+
+// groupDMForParticipant loads the :dmId group DM and checks the user is in it.
+// On failure it returns a nil channel and the error response to send.
+func groupDMForParticipant(c *fiber.Ctx, userID uuid.UUID) (*models.DMChannel, error) {
+	dm, errResp := dmForParticipant(c, userID)
+	if dm == nil {
+		return nil, errResp
+	}
+
+	if !dm.IsGroup {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "This is not a group DM",
+		})
+	}
+
+	return dm, nil
+}
+
+// dmForParticipant loads the :dmId DM, 1:1 or group, and checks the user is in it.
+// On failure it returns a nil channel and the error response to send.
+func dmForParticipant(c *fiber.Ctx, userID uuid.UUID) (*models.DMChannel, error) {
+	dmID, err := uuid.Parse(c.Params("dmId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid DM channel ID",
+		})
+	}
+
+	var dm models.DMChannel
+	if err := database.DB.First(&dm, "id = ?", dmID).Error; err != nil || !isDMParticipant(userID, dmID) {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "DM channel not found",
+		})
+	}
+
+	return &dm, nil
+}
+
+// loadDMChannel reloads a DM channel with its users and participants
+func loadDMChannel(dm *models.DMChannel) {
+	database.DB.Preload("User1").Preload("User2").Preload("Participants.User").First(dm, "id = ?", dm.ID)
+}
+
+// notifyDMParticipants sends an event to every current participant of a DM channel
+func notifyDMParticipants(dmID uuid.UUID, event string, data interface{}) {
+	if ws.GlobalHub == nil {
+		return
+	}
+	for _, id := range dmParticipantIDs(dmID) {
+		ws.GlobalHub.SendToUser(id, event, data)
+	}
+}
+
+func isDMParticipant(userID, dmID uuid.UUID) bool {
+	return access.IsDMParticipant(userID, dmID)
+}
+
+func dmParticipantIDs(dmID uuid.UUID) []uuid.UUID {
+	var ids []uuid.UUID
+	database.DB.Model(&models.DMParticipant{}).
+		Where("dm_channel_id = ?", dmID).
+		Pluck("user_id", &ids)
+	return ids
+}
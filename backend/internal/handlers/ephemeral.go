@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/ws"
+)
+
+// ephemeralMessageTTL is how long an ephemeral message is kept before the reaper removes it
+const ephemeralMessageTTL = 15 * time.Minute
+
+// visibleTo limits a message query to messages the user may see, hiding other people's ephemeral messages
+func visibleTo(userID uuid.UUID) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("visible_to_id IS NULL OR visible_to_id = ?", userID)
+	}
+}
+
+// sendEphemeralMessage stores a plaintext message that only the recipient can see and sends it
+// to their sessions. It is not broadcast to the channel and disappears after ephemeralMessageTTL.
+// msg must have ChannelID, AuthorID and Content set.
+func sendEphemeralMessage(msg *models.Message, recipientID uuid.UUID) error {
+	if msg.Type == "" {
+		msg.Type = "text"
+	}
+	msg.IsPlaintext = true
+	msg.IsEphemeral = true
+	msg.VisibleToID = &recipientID
+	msg.ExpiresAt = messageExpiry(int(ephemeralMessageTTL / time.Second))
+
+	if err := database.DB.Create(msg).Error; err != nil {
+		return err
+	}
+
+	database.DB.Preload("Author").First(msg, "id = ?", msg.ID)
+
+	if ws.GlobalHub != nil {
+		ws.GlobalHub.SendToUser(recipientID, ws.EventMessage, *msg)
+	}
+
+	return nil
+}
+
+// DismissMessage removes an ephemeral message for the user it was shown to
+func DismissMessage(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	channelID, err := uuid.Parse(c.Params("channelId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid channel ID",
+		})
+	}
+
+	messageID, err := uuid.Parse(c.Params("messageId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid message ID",
+		})
+	}
+
+	result := database.DB.Unscoped().
+		Where("id = ? AND channel_id = ? AND is_ephemeral = ? AND visible_to_id = ?", messageID, channelID, true, userID).
+		Delete(&models.Message{})
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Message not found",
+		})
+	}
+
+	// Remove it from the user's other sessions too
+	if ws.GlobalHub != nil {
+		ws.GlobalHub.SendToUser(userID, ws.EventMessageDelete, map[string]interface{}{
+			"message_id": messageID.String(),
+			"channel_id": channelID.String(),
+		})
+	}
+
+	return c.JSON(fiber.Map{"message": "Message dismissed"})
+}
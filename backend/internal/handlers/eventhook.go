@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/crypto"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/eventhooks"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// maxEventSubscriptions caps how many event subscriptions a server can have
+const maxEventSubscriptions = 10
+
+// validEventList returns a client-facing error if the list is empty or has unknown events
+func validEventList(events []string) string {
+	if len(events) == 0 {
+		return "At least one event is required"
+	}
+	for _, event := range events {
+		if !eventhooks.ValidEvent(event) {
+			return "Unknown event: " + event
+		}
+	}
+	return ""
+}
+
+// CreateEventSubscription registers an HTTPS endpoint for a server's events.
+// The signing secret is only shown in this response.
+func CreateEventSubscription(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	serverID, err := uuid.Parse(c.Params("serverId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid server ID",
+		})
+	}
+
+	if !hasPermission(userID, serverID, "admin") {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Insufficient permissions",
+		})
+	}
+
+	type CreateRequest struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	var req CreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if err := eventhooks.ValidateURL(req.URL); err != nil || len(req.URL) > 1024 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid URL: must be an absolute https URL on a public address",
+		})
+	}
+
+	if errMsg := validEventList(req.Events); errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	var count int64
+	database.DB.Model(&models.EventSubscription{}).Where("server_id = ?", serverID).Count(&count)
+	if count >= maxEventSubscriptions {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Servers can have at most " + strconv.Itoa(maxEventSubscriptions) + " event subscriptions",
+		})
+	}
+
+	secret, err := crypto.GenerateSecretToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate signing secret",
+		})
+	}
+
+	sub := models.EventSubscription{
+		ServerID:  serverID,
+		CreatorID: userID,
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    secret,
+		IsActive:  true,
+	}
+
+	if err := database.DB.Create(&sub).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create event subscription",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(sub)
+}
+
+// GetEventSubscriptions lists a server's event subscriptions, without their secrets
+func GetEventSubscriptions(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	serverID, err := uuid.Parse(c.Params("serverId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid server ID",
+		})
+	}
+
+	if !hasPermission(userID, serverID, "admin") {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Insufficient permissions",
+		})
+	}
+
+	var subs []models.EventSubscription
+	database.DB.Where("server_id = ?", serverID).Order("created_at ASC").Find(&subs)
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+
+	return c.JSON(subs)
+}
+
+// UpdateEventSubscription changes a subscription's URL or events, or re-enables it
+func UpdateEventSubscription(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	sub, errResp := eventSubscriptionForAdmin(c, userID)
+	if sub == nil {
+		return errResp
+	}
+
+	type UpdateRequest struct {
+		URL      *string  `json:"url"`
+		Events   []string `json:"events"`
+		IsActive *bool    `json:"is_active"`
+	}
+
+	var req UpdateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	updates := map[string]interface{}{}
+	if req.URL != nil {
+		if err := eventhooks.ValidateURL(*req.URL); err != nil || len(*req.URL) > 1024 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid URL: must be an absolute https URL on a public address",
+			})
+		}
+		updates["url"] = *req.URL
+	}
+	if req.Events != nil {
+		if errMsg := validEventList(req.Events); errMsg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": errMsg,
+			})
+		}
+		sub.Events = req.Events
+		database.DB.Model(sub).Select("events").Updates(sub)
+	}
+	if req.IsActive != nil {
+		updates["is_active"] = *req.IsActive
+		if *req.IsActive {
+			// Re-enabling starts the failure count over
+			updates["failure_count"] = 0
+			updates["disabled_at"] = nil
+		}
+	}
+
+	if len(updates) > 0 {
+		database.DB.Model(sub).Updates(updates)
+	}
+
+	database.DB.First(sub, "id = ?", sub.ID)
+	sub.Secret = ""
+
+	return c.JSON(sub)
+}
+
+// RotateEventSubscriptionSecret replaces a subscription's signing secret
+func RotateEventSubscriptionSecret(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	sub, errResp := eventSubscriptionForAdmin(c, userID)
+	if sub == nil {
+		return errResp
+	}
+
+	secret, err := crypto.GenerateSecretToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate signing secret",
+		})
+	}
+
+	database.DB.Model(sub).Update("secret", secret)
+	sub.Secret = secret
+
+	return c.JSON(sub)
+}
+
+// DeleteEventSubscription deletes a subscription along with its queued deliveries and log
+func DeleteEventSubscription(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	sub, errResp := eventSubscriptionForAdmin(c, userID)
+	if sub == nil {
+		return errResp
+	}
+
+	database.DB.Where("subscription_id = ?", sub.ID).Delete(&models.EventDelivery{})
+	database.DB.Delete(sub)
+
+	return c.JSON(fiber.Map{"message": "Event subscription deleted successfully"})
+}
+
+// GetEventDeliveries returns a subscription's delivery log, newest first
+func GetEventDeliveries(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	sub, errResp := eventSubscriptionForAdmin(c, userID)
+	if sub == nil {
+		return errResp
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit", "50"))
+	if limit > 100 {
+		limit = 100
+	}
+	if limit < 1 {
+		limit = 50
+	}
+
+	query := database.DB.Where("subscription_id = ?", sub.ID).Order("created_at DESC").Limit(limit)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var deliveries []models.EventDelivery
+	query.Find(&deliveries)
+
+	return c.JSON(deliveries)
+}
+
+// eventSubscriptionForAdmin loads the :subscriptionId subscription of the :serverId server
+// and checks the user is an admin there. On failure it returns nil and the error response to send.
+func eventSubscriptionForAdmin(c *fiber.Ctx, userID uuid.UUID) (*models.EventSubscription, error) {
+	serverID, err := uuid.Parse(c.Params("serverId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid server ID",
+		})
+	}
+
+	subID, err := uuid.Parse(c.Params("subscriptionId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid subscription ID",
+		})
+	}
+
+	if !hasPermission(userID, serverID, "admin") {
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Insufficient permissions",
+		})
+	}
+
+	var sub models.EventSubscription
+	if err := database.DB.First(&sub, "id = ? AND server_id = ?", subID, serverID).Error; err != nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Event subscription not found",
+		})
+	}
+
+	return &sub, nil
+}
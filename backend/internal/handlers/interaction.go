@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/crypto"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/eventhooks"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/ws"
+)
+
+// interactionLifetime is how long an application can answer and follow up on an interaction
+const interactionLifetime = 15 * time.Minute
+
+// interactionClient POSTs interactions to command callback URLs
+var interactionClient = eventhooks.NewClient(10 * time.Second)
+
+// validateCommandOptions checks invocation arguments against a command's options schema.
+// Numbers arrive from JSON as float64; integers must not have a fractional part.
+func validateCommandOptions(cmd *models.ApplicationCommand, serverID uuid.UUID, values map[string]interface{}) string {
+	known := make(map[string]bool)
+	for _, opt := range cmd.Options {
+		known[opt.Name] = true
+
+		value, ok := values[opt.Name]
+		if !ok || value == nil {
+			if opt.Required {
+				return "Missing required option: " + opt.Name
+			}
+			delete(values, opt.Name)
+			continue
+		}
+
+		switch opt.Type {
+		case "string":
+			s, ok := value.(string)
+			if !ok || len(s) > maxOptionStringLen {
+				return "Option " + opt.Name + " must be a string of at most " + strconv.Itoa(maxOptionStringLen) + " characters"
+			}
+			if len(opt.Choices) > 0 && !containsString(opt.Choices, s) {
+				return "Option " + opt.Name + " must be one of its choices"
+			}
+		case "integer":
+			n, ok := value.(float64)
+			if !ok || n != math.Trunc(n) {
+				return "Option " + opt.Name + " must be an integer"
+			}
+		case "number":
+			if _, ok := value.(float64); !ok {
+				return "Option " + opt.Name + " must be a number"
+			}
+		case "boolean":
+			if _, ok := value.(bool); !ok {
+				return "Option " + opt.Name + " must be a boolean"
+			}
+		case "user":
+			s, _ := value.(string)
+			id, err := uuid.Parse(s)
+			if err != nil || !isMember(id, serverID) {
+				return "Option " + opt.Name + " must be a member of this server"
+			}
+		case "channel":
+			s, _ := value.(string)
+			id, err := uuid.Parse(s)
+			var count int64
+			if err == nil {
+				database.DB.Model(&models.Channel{}).Where("id = ? AND server_id = ?", id, serverID).Count(&count)
+			}
+			if count == 0 {
+				return "Option " + opt.Name + " must be a channel in this server"
+			}
+		}
+	}
+
+	for name := range values {
+		if !known[name] {
+			return "Unknown option: " + name
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateInteraction invokes a slash command in a server channel. The interaction is sent
+// to the command's owner, who answers it through the interaction token.
+func CreateInteraction(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	channelID, err := uuid.Parse(c.Params("channelId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid channel ID",
+		})
+	}
+
+	type InvokeRequest struct {
+		Name    string                 `json:"name"`
+		Options map[string]interface{} `json:"options"`
+	}
+
+	var req InvokeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var channel models.Channel
+	if err := database.DB.First(&channel, "id = ?", channelID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+	}
+
+	if !isMember(userID, channel.ServerID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Not a member of this server",
+		})
+	}
+
+	var cmd models.ApplicationCommand
+	if err := database.DB.First(&cmd, "server_id = ? AND name = ?", channel.ServerID, req.Name).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown command",
+		})
+	}
+
+	if req.Options == nil {
+		req.Options = map[string]interface{}{}
+	}
+	if errMsg := validateCommandOptions(&cmd, channel.ServerID, req.Options); errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	// Without a callback URL the owner has to be connected to receive the interaction
+	if cmd.CallbackURL == "" && (ws.GlobalHub == nil || !ws.GlobalHub.IsOnline(cmd.OwnerID)) {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "The application is not available",
+		})
+	}
+
+	token, err := crypto.GenerateSecretToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate interaction token",
+		})
+	}
+
+	interaction := models.Interaction{
+		CommandID: cmd.ID,
+		ServerID:  channel.ServerID,
+		ChannelID: channel.ID,
+		UserID:    userID,
+		OwnerID:   cmd.OwnerID,
+		Name:      cmd.Name,
+		Options:   req.Options,
+		Status:    "pending",
+		TokenHash: crypto.HashToken(token),
+		ExpiresAt: time.Now().Add(interactionLifetime),
+	}
+
+	if err := database.DB.Create(&interaction).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create interaction",
+		})
+	}
+
+	dispatched := interaction
+	dispatched.Token = token
+	if cmd.CallbackURL != "" {
+		go postInteraction(&cmd, dispatched)
+	} else {
+		ws.GlobalHub.SendToUser(cmd.OwnerID, ws.EventInteractionCreate, dispatched)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(interaction)
+}
+
+// postInteraction sends an interaction to a command's callback URL, signed like event hook
+// deliveries. If the endpoint fails, the invoker gets an ephemeral error instead.
+func postInteraction(cmd *models.ApplicationCommand, interaction models.Interaction) {
+	dataBytes, _ := json.Marshal(interaction)
+	body, _ := json.Marshal(eventhooks.Payload{
+		Event:     ws.EventInteractionCreate,
+		Data:      dataBytes,
+		ChannelID: interaction.ChannelID.String(),
+		ServerID:  interaction.ServerID.String(),
+		Timestamp: time.Now().UnixMilli(),
+	})
+
+	err := func() error {
+		req, err := http.NewRequest(http.MethodPost, cmd.CallbackURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		timestamp := time.Now().Unix()
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "Shitcord-Interactions/1.0")
+		req.Header.Set(eventhooks.HeaderEvent, ws.EventInteractionCreate)
+		req.Header.Set(eventhooks.HeaderDelivery, interaction.ID.String())
+		req.Header.Set(eventhooks.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(eventhooks.HeaderSignature, eventhooks.Sign(cmd.Secret, timestamp, body))
+
+		resp, err := interactionClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("endpoint responded with %s", resp.Status)
+		}
+		return nil
+	}()
+	if err == nil {
+		return
+	}
+
+	log.Printf("Failed to deliver interaction %s for command %s: %v", interaction.ID, cmd.ID, err)
+
+	// Only tell the invoker if the application hasn't answered some other way
+	result := database.DB.Model(&models.Interaction{}).
+		Where("id = ? AND status = ?", interaction.ID, "pending").
+		Update("expires_at", time.Now())
+	if result.RowsAffected == 1 {
+		sendEphemeralReply(&interaction, "The application did not respond")
+	}
+}
+
+// interactionForToken loads the :interactionId interaction and checks the :token param.
+// On failure it returns nil and the error response to send.
+func interactionForToken(c *fiber.Ctx) (*models.Interaction, error) {
+	interactionID, err := uuid.Parse(c.Params("interactionId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown interaction",
+		})
+	}
+
+	var interaction models.Interaction
+	if err := database.DB.First(&interaction, "id = ?", interactionID).Error; err != nil || !crypto.TokenMatches(c.Params("token"), interaction.TokenHash) {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown interaction",
+		})
+	}
+
+	if time.Now().After(interaction.ExpiresAt) {
+		return nil, c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Interaction has expired",
+		})
+	}
+
+	return &interaction, nil
+}
+
+// RespondToInteraction is the initial response to an interaction: a channel message,
+// an ephemeral reply only the invoker sees, or a deferral to follow up on later.
+// This route is public; the interaction token is the only credential.
+func RespondToInteraction(c *fiber.Ctx) error {
+	interaction, errResp := interactionForToken(c)
+	if interaction == nil {
+		return errResp
+	}
+
+	type ResponseRequest struct {
+		Type     string                  `json:"type"` // message, ephemeral, deferred
+		Content  string                  `json:"content"`
+		Mentions *models.MentionMetadata `json:"mentions"`
+	}
+
+	var req ResponseRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Type != "message" && req.Type != "ephemeral" && req.Type != "deferred" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Response type must be message, ephemeral or deferred",
+		})
+	}
+	if req.Type != "deferred" {
+		if errMsg := validInteractionContent(req.Content); errMsg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": errMsg,
+			})
+		}
+	}
+
+	status := "responded"
+	if req.Type == "deferred" {
+		status = "deferred"
+	}
+
+	// Only the first response counts
+	result := database.DB.Model(&models.Interaction{}).
+		Where("id = ? AND status = ?", interaction.ID, "pending").
+		Update("status", status)
+	if result.RowsAffected != 1 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Interaction has already been responded to",
+		})
+	}
+	interaction.Status = status
+
+	switch req.Type {
+	case "deferred":
+		if ws.GlobalHub != nil {
+			ws.GlobalHub.SendToUser(interaction.UserID, ws.EventInteractionDefer, fiber.Map{
+				"interaction_id": interaction.ID.String(),
+				"channel_id":     interaction.ChannelID.String(),
+				"name":           interaction.Name,
+			})
+		}
+		return c.JSON(interaction)
+	case "ephemeral":
+		return respondEphemeral(c, interaction, req.Content)
+	default:
+		return postInteractionMessage(c, interaction, req.Content, req.Mentions)
+	}
+}
+
+// FollowUpInteraction posts another message for an interaction that has been answered or deferred
+func FollowUpInteraction(c *fiber.Ctx) error {
+	interaction, errResp := interactionForToken(c)
+	if interaction == nil {
+		return errResp
+	}
+
+	if interaction.Status == "pending" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Interaction has not been responded to yet",
+		})
+	}
+
+	type FollowUpRequest struct {
+		Content   string                  `json:"content"`
+		Ephemeral bool                    `json:"ephemeral"`
+		Mentions  *models.MentionMetadata `json:"mentions"`
+	}
+
+	var req FollowUpRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if errMsg := validInteractionContent(req.Content); errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	if interaction.Status == "deferred" {
+		database.DB.Model(interaction).Update("status", "responded")
+	}
+
+	if req.Ephemeral {
+		return respondEphemeral(c, interaction, req.Content)
+	}
+	return postInteractionMessage(c, interaction, req.Content, req.Mentions)
+}
+
+// validInteractionContent returns a client-facing error if a reply's content is unusable
+func validInteractionContent(content string) string {
+	if content == "" {
+		return "Message content cannot be empty"
+	}
+	if utf8.RuneCountInString(content) > maxPlaintextContent {
+		return "Message content must be at most 4000 characters"
+	}
+	return ""
+}
+
+// postInteractionMessage posts a plaintext reply to the channel as the command's owner
+func postInteractionMessage(c *fiber.Ctx, interaction *models.Interaction, content string, mentions *models.MentionMetadata) error {
+	cv, ok := loadConversation(interaction.ChannelID)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+	}
+
+	// The owner may have left the server since the command was registered
+	if !cv.canAccess(interaction.OwnerID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "The application can no longer post in this channel",
+		})
+	}
+
+	payload := SendMessageRequest{
+		Content:  content,
+		Type:     "text",
+		Mentions: mentions,
+	}
+	mentionRecipients, errMsg := payload.validate(interaction.OwnerID, cv)
+	if errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	msg := models.Message{
+		AuthorID:      interaction.OwnerID,
+		InteractionID: &interaction.ID,
+		IsPlaintext:   true,
+	}
+	if err := publishMessage(&msg, cv, &payload, mentionRecipients, uuid.Nil); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send message",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(msg)
+}
+
+// sendEphemeralReply sends a reply only the invoker sees
+func sendEphemeralReply(interaction *models.Interaction, content string) (*models.Message, error) {
+	msg := models.Message{
+		ChannelID:     interaction.ChannelID,
+		AuthorID:      interaction.OwnerID,
+		Content:       content,
+		InteractionID: &interaction.ID,
+	}
+	if err := sendEphemeralMessage(&msg, interaction.UserID); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// respondEphemeral sends an ephemeral reply and writes it as the response
+func respondEphemeral(c *fiber.Ctx, interaction *models.Interaction, content string) error {
+	msg, err := sendEphemeralReply(interaction, content)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send message",
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(msg)
+}
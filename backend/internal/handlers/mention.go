@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/ws"
+)
+
+// maxUserMentions caps how many users a single message can mention explicitly
+const maxUserMentions = 100
+
+// resolveMentions validates a message's mention metadata against the conversation
+// and returns the users to notify, mapped to the kind of mention that reached them.
+// The returned string is a client-facing error message when validation fails.
+func resolveMentions(authorID uuid.UUID, cv *conversation, meta *models.MentionMetadata) (map[uuid.UUID]string, string) {
+	recipients := map[uuid.UUID]string{}
+	if meta == nil {
+		return recipients, ""
+	}
+
+	if len(meta.Users) > maxUserMentions {
+		return nil, "Too many user mentions"
+	}
+
+	massMention := meta.Everyone || meta.Here || len(meta.Roles) > 0
+	if cv.isDM() {
+		if massMention {
+			return nil, "Role, @everyone and @here mentions are not allowed in direct messages"
+		}
+	} else if massMention && !hasPermission(authorID, cv.Channel.ServerID, "moderator") {
+		return nil, "Insufficient permissions to mention roles, @everyone or @here"
+	}
+
+	members := map[uuid.UUID]bool{}
+	for _, id := range cv.memberIDs() {
+		members[id] = true
+	}
+
+	// Broader mentions are applied first so a direct mention takes precedence
+	if meta.Everyone {
+		for id := range members {
+			recipients[id] = "everyone"
+		}
+	}
+
+	if meta.Here {
+		var onlineIDs []uuid.UUID
+		database.DB.Model(&models.ServerMember{}).
+			Joins("JOIN users ON users.id = server_members.user_id").
+			Where("server_members.server_id = ? AND users.status != ?", cv.Channel.ServerID, "offline").
+			Pluck("server_members.user_id", &onlineIDs)
+		for _, id := range onlineIDs {
+			recipients[id] = "here"
+		}
+	}
+
+	for _, role := range meta.Roles {
+		if _, ok := roleHierarchy[role]; !ok {
+			return nil, "Invalid role mention: " + role
+		}
+		var roleIDs []uuid.UUID
+		database.DB.Model(&models.ServerMember{}).
+			Where("server_id = ? AND role = ?", cv.Channel.ServerID, role).
+			Pluck("user_id", &roleIDs)
+		for _, id := range roleIDs {
+			recipients[id] = "role"
+		}
+	}
+
+	for _, id := range meta.Users {
+		if !members[id] {
+			return nil, "Mentioned user " + id.String() + " is not a member of this conversation"
+		}
+		recipients[id] = "user"
+	}
+
+	// Authors never get notified about their own mentions
+	delete(recipients, authorID)
+
+	return recipients, ""
+}
+
+// createMentions stores inbox entries for a message and notifies each recipient
+func createMentions(msg *models.Message, cv *conversation, recipients map[uuid.UUID]string) {
+	if len(recipients) == 0 {
+		return
+	}
+
+	mentions := make([]models.Mention, 0, len(recipients))
+	for userID, mentionType := range recipients {
+		mentions = append(mentions, models.Mention{
+			UserID:    userID,
+			MessageID: msg.ID,
+			ChannelID: msg.ChannelID,
+			ServerID:  cv.serverID(),
+			AuthorID:  msg.AuthorID,
+			Type:      mentionType,
+		})
+	}
+
+	if err := database.DB.Create(&mentions).Error; err != nil {
+		return
+	}
+
+	userIDs := make([]uuid.UUID, 0, len(mentions))
+	for _, mention := range mentions {
+		userIDs = append(userIDs, mention.UserID)
+	}
+	ws.IncrementMentionCounts(msg.ChannelID, userIDs)
+
+	if ws.GlobalHub != nil {
+		for _, mention := range mentions {
+			mention.Message = *msg
+			ws.GlobalHub.SendToUser(mention.UserID, ws.EventMentionCreate, mention)
+		}
+	}
+}
+
+// GetMyMentions returns the current user's mention inbox, newest first
+func GetMyMentions(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	limit, _ := strconv.Atoi(c.Query("limit", "25"))
+	if limit > 100 {
+		limit = 100
+	}
+	if limit < 1 {
+		limit = 25
+	}
+
+	query := database.DB.Where("user_id = ?", userID).
+		Preload("Message").
+		Preload("Message.Author").
+		Order("created_at DESC").
+		Limit(limit)
+
+	if c.Query("unread") == "true" {
+		query = query.Where("is_read = ?", false)
+	}
+
+	if serverID := c.Query("server_id"); serverID != "" {
+		if id, err := uuid.Parse(serverID); err == nil {
+			query = query.Where("server_id = ?", id)
+		}
+	}
+
+	if beforeID := c.Query("before"); beforeID != "" {
+		if id, err := uuid.Parse(beforeID); err == nil {
+			var before models.Mention
+			if database.DB.First(&before, "id = ? AND user_id = ?", id, userID).Error == nil {
+				query = query.Where("created_at < ?", before.CreatedAt)
+			}
+		}
+	}
+
+	var mentions []models.Mention
+	query.Find(&mentions)
+
+	return c.JSON(mentions)
+}
+
+// DeleteMyMention removes an entry from the current user's mention inbox
+func DeleteMyMention(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	mentionID, err := uuid.Parse(c.Params("mentionId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid mention ID",
+		})
+	}
+
+	result := database.DB.Where("id = ? AND user_id = ?", mentionID, userID).Delete(&models.Mention{})
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Mention not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{"message": "Mention dismissed"})
+}
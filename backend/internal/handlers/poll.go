@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/ws"
+)
+
+// Poll limits. Durations are in seconds.
+const (
+	maxPollAnswers      = 10
+	minPollDuration     = 60
+	maxPollDuration     = 4 * 7 * 24 * 60 * 60
+	defaultPollDuration = 24 * 60 * 60
+
+	// How often expired polls are checked for results to post
+	pollFinalizerInterval = 15 * time.Second
+)
+
+// errPollEnded is returned from a vote's transaction when the poll closed before the vote got its lock
+var errPollEnded = errors.New("poll has ended")
+
+// validatePoll checks a poll definition and fills in the default duration.
+// The returned string is a client-facing error message when validation fails.
+func validatePoll(spec *models.PollSpec) string {
+	if n := utf8.RuneCountInString(spec.Question); n < 1 || n > 300 {
+		return "Poll question must be between 1 and 300 characters"
+	}
+
+	if len(spec.Answers) < 2 || len(spec.Answers) > maxPollAnswers {
+		return "Polls must have between 2 and 10 answers"
+	}
+	for _, answer := range spec.Answers {
+		if n := utf8.RuneCountInString(answer); n < 1 || n > 100 {
+			return "Poll answers must be between 1 and 100 characters"
+		}
+	}
+
+	if spec.Duration == 0 {
+		spec.Duration = defaultPollDuration
+	}
+	if spec.Duration < minPollDuration || spec.Duration > maxPollDuration {
+		return "Poll duration must be between 1 minute and 4 weeks"
+	}
+
+	return ""
+}
+
+// newPoll builds the poll rows for a poll message
+func newPoll(msg *models.Message, spec *models.PollSpec) models.Poll {
+	poll := models.Poll{
+		MessageID:        msg.ID,
+		ChannelID:        msg.ChannelID,
+		Question:         spec.Question,
+		AllowMultiselect: spec.AllowMultiselect,
+		ExpiresAt:        time.Now().Add(time.Duration(spec.Duration) * time.Second),
+	}
+	for i, text := range spec.Answers {
+		poll.Answers = append(poll.Answers, models.PollAnswer{Position: i, Text: text})
+	}
+	return poll
+}
+
+// withPoll preloads a message's poll with its answers in display order
+func withPoll(db *gorm.DB) *gorm.DB {
+	return db.Preload("Poll").Preload("Poll.Answers", answersInOrder)
+}
+
+// withAnswers preloads a poll's answers in display order
+func withAnswers(db *gorm.DB) *gorm.DB {
+	return db.Preload("Answers", answersInOrder)
+}
+
+func answersInOrder(db *gorm.DB) *gorm.DB {
+	return db.Order("position ASC")
+}
+
+// attachPollVotes marks the poll answers the user has voted for
+func attachPollVotes(userID uuid.UUID, messages []models.Message) {
+	var pollIDs []uuid.UUID
+	for _, msg := range messages {
+		if msg.Poll != nil {
+			pollIDs = append(pollIDs, msg.Poll.ID)
+		}
+	}
+	if len(pollIDs) == 0 {
+		return
+	}
+
+	var answerIDs []uuid.UUID
+	database.DB.Model(&models.PollVote{}).
+		Where("poll_id IN ? AND user_id = ?", pollIDs, userID).
+		Pluck("answer_id", &answerIDs)
+
+	voted := map[uuid.UUID]bool{}
+	for _, id := range answerIDs {
+		voted[id] = true
+	}
+
+	for i := range messages {
+		if messages[i].Poll == nil {
+			continue
+		}
+		for j := range messages[i].Poll.Answers {
+			messages[i].Poll.Answers[j].MeVoted = voted[messages[i].Poll.Answers[j].ID]
+		}
+	}
+}
+
+// VotePoll records the current user's vote for a poll answer.
+// On single-choice polls it replaces any previous vote.
+func VotePoll(c *fiber.Ctx) error {
+	return changePollVote(c, true)
+}
+
+// UnvotePoll removes the current user's vote for a poll answer
+func UnvotePoll(c *fiber.Ctx) error {
+	return changePollVote(c, false)
+}
+
+// changePollVote adds or removes a vote, keeps the answer tallies in step and broadcasts POLL_VOTE
+func changePollVote(c *fiber.Ctx, add bool) error {
+	userID := middleware.GetUserID(c)
+	messageID, err := uuid.Parse(c.Params("messageId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid message ID",
+		})
+	}
+
+	answerID, err := uuid.Parse(c.Params("answerId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid answer ID",
+		})
+	}
+
+	var poll models.Poll
+	if err := database.DB.First(&poll, "message_id = ?", messageID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Poll not found",
+		})
+	}
+
+	cv, ok := loadConversation(poll.ChannelID)
+	if !ok || !cv.canAccess(userID) || c.Params("channelId") != poll.ChannelID.String() {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Poll not found",
+		})
+	}
+
+	// Deleting the message takes its poll with it
+	var msg models.Message
+	if err := database.DB.Select("id").First(&msg, "id = ?", poll.MessageID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Poll not found",
+		})
+	}
+
+	if poll.IsFinalized || !time.Now().Before(poll.ExpiresAt) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "This poll has ended",
+		})
+	}
+
+	var answer models.PollAnswer
+	if err := database.DB.First(&answer, "id = ? AND poll_id = ?", answerID, poll.ID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Answer not found",
+		})
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// Votes on a poll are serialized, so two at once can't both stick on a single-choice poll.
+		// The poll may have closed while this vote waited, and then the vote must not count.
+		var locked models.Poll
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, "id = ?", poll.ID).Error; err != nil {
+			return err
+		}
+		if locked.IsFinalized || !time.Now().Before(locked.ExpiresAt) {
+			return errPollEnded
+		}
+
+		if !add {
+			return removePollVotes(tx, poll.ID, userID, "answer_id = ?", answer.ID)
+		}
+
+		if !poll.AllowMultiselect {
+			if err := removePollVotes(tx, poll.ID, userID, "answer_id != ?", answer.ID); err != nil {
+				return err
+			}
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.PollVote{
+			PollID:   poll.ID,
+			AnswerID: answer.ID,
+			UserID:   userID,
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error // Already voted for this answer
+		}
+		return tx.Model(&answer).Update("vote_count", gorm.Expr("vote_count + 1")).Error
+	})
+	if errors.Is(err, errPollEnded) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "This poll has ended",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update vote",
+		})
+	}
+
+	withAnswers(database.DB).First(&poll, "id = ?", poll.ID)
+
+	// Live counts only; me_voted differs per viewer so it isn't broadcast
+	counts := make([]fiber.Map, 0, len(poll.Answers))
+	for _, a := range poll.Answers {
+		counts = append(counts, fiber.Map{"id": a.ID, "vote_count": a.VoteCount})
+	}
+
+	if ws.GlobalHub != nil {
+		ws.GlobalHub.BroadcastToChannel(poll.ChannelID.String(), ws.EventPollVote, fiber.Map{
+			"channel_id": poll.ChannelID,
+			"message_id": poll.MessageID,
+			"poll_id":    poll.ID,
+			"user_id":    userID,
+			"answer_id":  answer.ID,
+			"voted":      add,
+			"answers":    counts,
+		}, uuid.Nil)
+	}
+
+	attachPollVotes(userID, []models.Message{{Poll: &poll}})
+
+	return c.JSON(poll)
+}
+
+// removePollVotes deletes a user's votes matching the extra condition and decrements their tallies
+func removePollVotes(tx *gorm.DB, pollID, userID uuid.UUID, query string, args ...interface{}) error {
+	var votes []models.PollVote
+	tx.Where("poll_id = ? AND user_id = ?", pollID, userID).Where(query, args...).Find(&votes)
+
+	for _, vote := range votes {
+		result := tx.Delete(&vote)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		if err := tx.Model(&models.PollAnswer{}).Where("id = ?", vote.AnswerID).
+			Update("vote_count", gorm.Expr("vote_count - 1")).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePoll removes a poll and its votes along with its message
+func deletePoll(messageID uuid.UUID) {
+	var poll models.Poll
+	if err := database.DB.First(&poll, "message_id = ?", messageID).Error; err != nil {
+		return
+	}
+	database.DB.Where("poll_id = ?", poll.ID).Delete(&models.PollVote{})
+	database.DB.Where("poll_id = ?", poll.ID).Delete(&models.PollAnswer{})
+	database.DB.Delete(&poll)
+}
+
+// RunPollFinalizer posts results for polls once they expire. It never returns.
+func RunPollFinalizer() {
+	ticker := time.NewTicker(pollFinalizerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		finalizeExpiredPolls()
+	}
+}
+
+// finalizeExpiredPolls closes every expired poll and posts a results system message.
+// Each poll is claimed with a conditional update so only one instance posts its results.
+// The claim waits for votes that hold the poll's lock, and votes after it are refused, so
+// the answers are tallied once it succeeds.
+func finalizeExpiredPolls() {
+	var polls []models.Poll
+	database.DB.Where("is_finalized = ? AND expires_at <= ?", false, time.Now()).Find(&polls)
+
+	for _, poll := range polls {
+		result := database.DB.Model(&models.Poll{}).
+			Where("id = ? AND is_finalized = ?", poll.ID, false).
+			Update("is_finalized", true)
+		if result.RowsAffected != 1 {
+			continue
+		}
+		withAnswers(database.DB).First(&poll, "id = ?", poll.ID)
+
+		// Nothing to announce if the poll message was deleted in the meantime
+		var msg models.Message
+		if err := database.DB.First(&msg, "id = ?", poll.MessageID).Error; err != nil {
+			continue
+		}
+
+		totalVotes := 0
+		answers := make([]fiber.Map, 0, len(poll.Answers))
+		for _, answer := range poll.Answers {
+			totalVotes += answer.VoteCount
+			answers = append(answers, fiber.Map{
+				"id":         answer.ID,
+				"text":       answer.Text,
+				"vote_count": answer.VoteCount,
+			})
+		}
+
+		createSystemMessage(poll.ChannelID, msg.AuthorID, map[string]interface{}{
+			"event":       "poll_results",
+			"poll_id":     poll.ID,
+			"message_id":  poll.MessageID,
+			"question":    poll.Question,
+			"answers":     answers,
+			"total_votes": totalVotes,
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// Storage quotas cap the bytes a user has uploaded, counting thumbnails, and the bytes of
+// attachments posted in a server. Quotas are in bytes; 0 means unlimited.
+
+// quotaFromEnv reads a quota in MB, where 0 turns the quota off
+func quotaFromEnv(key string, fallbackMB int64) int64 {
+	if n, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil && n >= 0 {
+		return n << 20
+	}
+	return fallbackMB << 20
+}
+
+// userStorageQuota returns a user's quota: their override, or USER_STORAGE_QUOTA_MB (1GB by default)
+func userStorageQuota(user *models.User) int64 {
+	if user.StorageQuotaMB > 0 {
+		return user.StorageQuotaMB << 20
+	}
+	return quotaFromEnv("USER_STORAGE_QUOTA_MB", 1024)
+}
+
+// serverStorageQuota returns a server's quota: its override, or SERVER_STORAGE_QUOTA_MB (unlimited by default)
+func serverStorageQuota(server *models.Server) int64 {
+	if server.StorageQuotaMB > 0 {
+		return server.StorageQuotaMB << 20
+	}
+	return quotaFromEnv("SERVER_STORAGE_QUOTA_MB", 0)
+}
+
+// userStorageUsed returns the bytes a user's uploads take up, and the bytes reserved by their
+// resumable uploads that haven't finished yet
+func userStorageUsed(userID uuid.UUID) (used, pending int64) {
+	database.DB.Model(&models.Attachment{}).Where("uploader_id = ?", userID).
+		Select("COALESCE(SUM(size), 0)").Scan(&used)
+	database.DB.Model(&models.UploadSession{}).
+		Where("uploader_id = ? AND attachment_id IS NULL AND expires_at > ?", userID, time.Now()).
+		Select("COALESCE(SUM(length), 0)").Scan(&pending)
+	return used, pending
+}
+
+func serverStorageUsed(serverID uuid.UUID) int64 {
+	var used int64
+	database.DB.Model(&models.Attachment{}).Where("server_id = ?", serverID).
+		Select("COALESCE(SUM(size), 0)").Scan(&used)
+	return used
+}
+
+func formatMB(bytes int64) string {
+	return fmt.Sprintf("%.1fMB", float64(bytes)/(1<<20))
+}
+
+// checkUserQuota returns a client-facing error if storing size more bytes would put the user
+// over their quota. reserved is the part of their pending uploads that is this upload.
+func checkUserQuota(userID uuid.UUID, size, reserved int64) string {
+	var user models.User
+	if err := database.DB.Select("id", "storage_quota_mb").First(&user, "id = ?", userID).Error; err != nil {
+		return "User not found"
+	}
+	quota := userStorageQuota(&user)
+	if quota == 0 {
+		return ""
+	}
+	used, pending := userStorageUsed(userID)
+	if used+pending-reserved+size > quota {
+		return fmt.Sprintf("Storage quota exceeded: you are using %s of %s. Delete some uploads to free up space.", formatMB(used), formatMB(quota))
+	}
+	return ""
+}
+
+// checkServerQuota returns a client-facing error if posting size more bytes in a
+// conversation would put its server over quota
+func checkServerQuota(cv *conversation, size int64) string {
+	if cv == nil || cv.serverID() == nil {
+		return ""
+	}
+	var server models.Server
+	if err := database.DB.Select("id", "storage_quota_mb").First(&server, "id = ?", *cv.serverID()).Error; err != nil {
+		return ""
+	}
+	quota := serverStorageQuota(&server)
+	if quota == 0 {
+		return ""
+	}
+	if used := serverStorageUsed(server.ID); used+size > quota {
+		return fmt.Sprintf("This server is out of storage: it is using %s of %s", formatMB(used), formatMB(quota))
+	}
+	return ""
+}
+
+// checkStorageQuotas checks a new upload against the uploader's quota and, if it is meant
+// for a server channel, the server's
+func checkStorageQuotas(userID uuid.UUID, cv *conversation, size, reserved int64) string {
+	if errMsg := checkUserQuota(userID, size, reserved); errMsg != "" {
+		return errMsg
+	}
+	return checkServerQuota(cv, size)
+}
+
+// GetMyStorage reports how much upload storage the current user is using
+func GetMyStorage(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var user models.User
+	if err := database.DB.First(&user, "id = ?", userID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	used, pending := userStorageUsed(userID)
+
+	type typeUsage struct {
+		Type  string `json:"type"`
+		Count int64  `json:"count"`
+		Bytes int64  `json:"bytes"`
+	}
+	var byType []typeUsage
+	database.DB.Model(&models.Attachment{}).
+		Select("type, COUNT(*) AS count, COALESCE(SUM(size), 0) AS bytes").
+		Where("uploader_id = ? AND parent_id IS NULL", userID).
+		Group("type").Order("bytes DESC").Scan(&byType)
+
+	var thumbnails int64
+	database.DB.Model(&models.Attachment{}).Where("uploader_id = ? AND parent_id IS NOT NULL", userID).
+		Select("COALESCE(SUM(size), 0)").Scan(&thumbnails)
+
+	return c.JSON(fiber.Map{
+		"used":       used,
+		"pending":    pending,
+		"quota":      userStorageQuota(&user),
+		"by_type":    byType,
+		"thumbnails": thumbnails,
+	})
+}
+
+// GetStorageReport lists the users and servers using the most upload storage (admin only)
+func GetStorageReport(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 50)
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	var total struct {
+		Files int64
+		Bytes int64
+	}
+	database.DB.Model(&models.Attachment{}).Select("COUNT(*) AS files, COALESCE(SUM(size), 0) AS bytes").Scan(&total)
+
+	// Identical files are stored once, so storage holds less than the uploads add up to
+	var stored, legacy int64
+	database.DB.Model(&models.Blob{}).Select("COALESCE(SUM(size), 0)").Scan(&stored)
+	database.DB.Model(&models.Attachment{}).Where("blob_hash IS NULL OR blob_hash = ''").Select("COALESCE(SUM(size), 0)").Scan(&legacy)
+
+	type userUsage struct {
+		UserID   uuid.UUID `json:"user_id"`
+		Username string    `json:"username"`
+		Files    int64     `json:"files"`
+		Used     int64     `json:"used"`
+		Quota    int64     `json:"quota"`
+		QuotaMB  int64     `json:"-"`
+	}
+	var users []userUsage
+	database.DB.Table("attachments").
+		Select("attachments.uploader_id AS user_id, users.username, users.storage_quota_mb AS quota_mb, COUNT(*) AS files, SUM(attachments.size) AS used").
+		Joins("JOIN users ON users.id = attachments.uploader_id").
+		Group("attachments.uploader_id, users.username, users.storage_quota_mb").
+		Order("used DESC").Limit(limit).Scan(&users)
+	for i := range users {
+		users[i].Quota = userStorageQuota(&models.User{StorageQuotaMB: users[i].QuotaMB})
+	}
+
+	type serverUsage struct {
+		ServerID uuid.UUID `json:"server_id"`
+		Name     string    `json:"name"`
+		Files    int64     `json:"files"`
+		Used     int64     `json:"used"`
+		Quota    int64     `json:"quota"`
+		QuotaMB  int64     `json:"-"`
+	}
+	var servers []serverUsage
+	database.DB.Table("attachments").
+		Select("attachments.server_id, servers.name, servers.storage_quota_mb AS quota_mb, COUNT(*) AS files, SUM(attachments.size) AS used").
+		Joins("JOIN servers ON servers.id = attachments.server_id").
+		Group("attachments.server_id, servers.name, servers.storage_quota_mb").
+		Order("used DESC").Limit(limit).Scan(&servers)
+	for i := range servers {
+		servers[i].Quota = serverStorageQuota(&models.Server{StorageQuotaMB: servers[i].QuotaMB})
+	}
+
+	return c.JSON(fiber.Map{
+		"total_files":  total.Files,
+		"total_bytes":  total.Bytes,
+		"stored_bytes": stored + legacy,
+		"users":        users,
+		"servers":      servers,
+	})
+}
+
+type setQuotaRequest struct {
+	QuotaMB int64 `json:"quota_mb"` // 0 goes back to the instance default
+}
+
+// SetUserStorageQuota overrides a user's storage quota (admin only)
+func SetUserStorageQuota(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var req setQuotaRequest
+	if err := c.BodyParser(&req); err != nil || req.QuotaMB < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "quota_mb must be 0 or more",
+		})
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, "id = ?", userID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	database.DB.Model(&user).Update("storage_quota_mb", req.QuotaMB)
+
+	used, _ := userStorageUsed(userID)
+	return c.JSON(fiber.Map{
+		"user_id": user.ID,
+		"used":    used,
+		"quota":   userStorageQuota(&user),
+	})
+}
+
+// SetServerStorageQuota overrides a server's storage quota (admin only)
+func SetServerStorageQuota(c *fiber.Ctx) error {
+	serverID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid server ID",
+		})
+	}
+
+	var req setQuotaRequest
+	if err := c.BodyParser(&req); err != nil || req.QuotaMB < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "quota_mb must be 0 or more",
+		})
+	}
+
+	var server models.Server
+	if err := database.DB.First(&server, "id = ?", serverID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Server not found",
+		})
+	}
+	database.DB.Model(&server).Update("storage_quota_mb", req.QuotaMB)
+
+	return c.JSON(fiber.Map{
+		"server_id": server.ID,
+		"used":      serverStorageUsed(server.ID),
+		"quota":     serverStorageQuota(&server),
+	})
+}
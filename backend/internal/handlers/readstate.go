@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/ws"
+)
+
+// AckMessage marks a channel as read up to the given message
+func AckMessage(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	channelID, err := uuid.Parse(c.Params("channelId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid channel ID",
+		})
+	}
+
+	messageID, err := uuid.Parse(c.Params("messageId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid message ID",
+		})
+	}
+
+	cv, ok := loadConversation(channelID)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+	}
+
+	if !cv.canAccess(userID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You do not have access to this channel",
+		})
+	}
+
+	state, err := ws.AckMessage(userID, channelID, messageID)
+	if err == ws.ErrMessageNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Message not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update read state",
+		})
+	}
+
+	return c.JSON(state)
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// attachReceipts fills in delivered/read receipts for DM messages that requested them.
+// Receipts are derived from each recipient's read state, and recipients who turned
+// receipts off are left out.
+func attachReceipts(channelID uuid.UUID, messages []models.Message) {
+	requested := false
+	for _, msg := range messages {
+		if msg.RequestReceipts {
+			requested = true
+			break
+		}
+	}
+	if !requested {
+		return
+	}
+
+	var states []models.ReadState
+	database.DB.Joins("JOIN users ON users.id = read_states.user_id").
+		Where("read_states.channel_id = ? AND users.send_receipts = ?", channelID, true).
+		Find(&states)
+
+	for i := range messages {
+		msg := &messages[i]
+		if !msg.RequestReceipts {
+			continue
+		}
+
+		msg.Receipts = []models.MessageReceipt{}
+		for _, state := range states {
+			if state.UserID == msg.AuthorID {
+				continue
+			}
+			if state.LastMessageAt != nil && !state.LastMessageAt.Before(msg.CreatedAt) {
+				msg.Receipts = append(msg.Receipts, models.MessageReceipt{UserID: state.UserID, Status: "read"})
+			} else if state.DeliveredAt != nil && !state.DeliveredAt.Before(msg.CreatedAt) {
+				msg.Receipts = append(msg.Receipts, models.MessageReceipt{UserID: state.UserID, Status: "delivered"})
+			}
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/filetype"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/storage"
+)
+
+// Resumable uploads implement the core tus 1.0.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, termination and expiration extensions. PATCH bodies are streamed straight
+// to storage, one object per chunk, so neither the request body limit nor memory caps a chunk.
+const (
+	tusVersion = "1.0.0"
+	// uploadSessionLifetime is how long an upload can sit idle before it is discarded
+	uploadSessionLifetime = 24 * time.Hour
+	// maxActiveUploadSessions caps unfinished uploads per user, since each one holds staging space
+	maxActiveUploadSessions = 5
+	// uploadSessionReaperInterval is how often expired uploads are cleaned up
+	uploadSessionReaperInterval = 10 * time.Minute
+	// uploadLockLease is how long a PATCH holds its upload. A request that runs longer can be
+	// taken over by a retry, and then its chunk isn't recorded.
+	uploadLockLease = 15 * time.Minute
+)
+
+// stagingKey returns a new storage key for a chunk of an upload. Every write gets its own key,
+// so a retried chunk never overwrites one that was already recorded.
+func stagingKey(id uuid.UUID) string {
+	return "staging/" + id.String() + "/" + uuid.New().String()
+}
+
+// lockUploadSession takes the upload's lease in the database, so only one request writes to
+// it at a time across all server processes. It returns false if another request holds it.
+func lockUploadSession(id uuid.UUID) (time.Time, bool) {
+	now := time.Now()
+	until := now.Add(uploadLockLease).Truncate(time.Microsecond)
+	res := database.DB.Model(&models.UploadSession{}).
+		Where("id = ? AND (locked_until IS NULL OR locked_until < ?)", id, now).
+		Update("locked_until", until)
+	return until, res.Error == nil && res.RowsAffected == 1
+}
+
+// unlockUploadSession releases the lease unless it expired and another request took it
+func unlockUploadSession(id uuid.UUID, until time.Time) {
+	database.DB.Model(&models.UploadSession{}).Where("id = ? AND locked_until = ?", id, until).
+		Update("locked_until", nil)
+}
+
+// checkTusVersion rejects requests for a protocol version we don't speak. It returns false
+// after writing the response.
+func checkTusVersion(c *fiber.Ctx) bool {
+	c.Set("Tus-Resumable", tusVersion)
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+			"error": "Unsupported tus version",
+		})
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated keys, each followed by
+// a space and its base64-encoded value
+func parseTusMetadata(header string) (map[string]string, bool) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, false
+		}
+		meta[key] = string(value)
+	}
+	return meta, true
+}
+
+func setUploadExpires(c *fiber.Ctx, session *models.UploadSession) {
+	c.Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// ResumableUploadOptions describes what the tus endpoint supports
+func ResumableUploadOptions(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", "creation,termination,expiration")
+	c.Set("Tus-Max-Size", strconv.FormatInt(maxUploadLimit(), 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// CreateResumableUpload starts a resumable upload. Upload-Metadata must include the filename
+// and may include the purpose and the channel_id whose upload limit applies.
+func CreateResumableUpload(c *fiber.Ctx) error {
+	if !checkTusVersion(c) {
+		return nil
+	}
+	userID := middleware.GetUserID(c)
+
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Upload-Length must be a positive number",
+		})
+	}
+
+	meta, ok := parseTusMetadata(c.Get("Upload-Metadata"))
+	if !ok || meta["filename"] == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Upload-Metadata must include a filename",
+		})
+	}
+	purpose := meta["purpose"]
+	if purpose == "" {
+		purpose = "attachment"
+	}
+	if errMsg := checkUploadPurpose(purpose); errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+	ext := strings.ToLower(filepath.Ext(meta["filename"]))
+	if !filetype.Allowed(ext) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("File type '%s' is not allowed", ext),
+		})
+	}
+
+	cv, ok := uploadConversation(c, meta["channel_id"])
+	if !ok {
+		return nil
+	}
+	if limit := uploadLimit(userID, cv); length > limit {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("File too large. Maximum size is %dMB", limit>>20),
+		})
+	}
+	if errMsg := checkStorageQuotas(userID, cv, length, 0); errMsg != "" {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	var active int64
+	database.DB.Model(&models.UploadSession{}).
+		Where("uploader_id = ? AND attachment_id IS NULL AND expires_at > ?", userID, time.Now()).
+		Count(&active)
+	if active >= maxActiveUploadSessions {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": fmt.Sprintf("You can have at most %d uploads in progress", maxActiveUploadSessions),
+		})
+	}
+
+	session := models.UploadSession{
+		ID:         uuid.New(),
+		UploaderID: userID,
+		Filename:   meta["filename"],
+		Purpose:    purpose,
+		Length:     length,
+		Chunks:     []string{},
+		ExpiresAt:  time.Now().Add(uploadSessionLifetime),
+	}
+	if cv != nil {
+		id := cv.id()
+		session.ChannelID = &id
+	}
+
+	if err := database.DB.Create(&session).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start upload",
+		})
+	}
+
+	setUploadExpires(c, &session)
+	c.Location("/api/v1/upload/resumable/" + session.ID.String())
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// uploadSessionForRequest loads the caller's upload session from the URL. It returns nil
+// after writing an error response.
+func uploadSessionForRequest(c *fiber.Ctx) (*models.UploadSession, error) {
+	id, err := uuid.Parse(c.Params("uploadId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Upload not found",
+		})
+	}
+
+	var session models.UploadSession
+	if err := database.DB.Where("id = ? AND uploader_id = ?", id, middleware.GetUserID(c)).First(&session).Error; err != nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Upload not found",
+		})
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "Upload has expired",
+		})
+	}
+	return &session, nil
+}
+
+// HeadResumableUpload reports how much of an upload the server has, so a client can resume
+func HeadResumableUpload(c *fiber.Ctx) error {
+	if !checkTusVersion(c) {
+		return nil
+	}
+	session, err := uploadSessionForRequest(c)
+	if session == nil {
+		return err
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	c.Set("Cache-Control", "no-store")
+	setUploadExpires(c, session)
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// PatchResumableUpload appends a chunk at Upload-Offset. The chunk that completes the upload
+// also stores it; GET the upload afterwards for the attachment.
+func PatchResumableUpload(c *fiber.Ctx) error {
+	if !checkTusVersion(c) {
+		return nil
+	}
+	if c.Get(fiber.HeaderContentType) != "application/offset+octet-stream" {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Content-Type must be application/offset+octet-stream",
+		})
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Upload-Offset must be a number",
+		})
+	}
+
+	session, err := uploadSessionForRequest(c)
+	if session == nil {
+		return err
+	}
+
+	until, ok := lockUploadSession(session.ID)
+	if !ok {
+		return c.Status(fiber.StatusLocked).JSON(fiber.Map{
+			"error": "Another request is writing to this upload",
+		})
+	}
+	defer unlockUploadSession(session.ID, until)
+
+	// Re-read under the lock in case a request that just finished moved the offset
+	if err := database.DB.First(session, "id = ?", session.ID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Upload not found",
+		})
+	}
+	if session.AttachmentID != nil || offset != session.Offset {
+		c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Upload-Offset does not match the upload",
+		})
+	}
+
+	size := int64(c.Request().Header.ContentLength())
+	if size < 0 {
+		return c.Status(fiber.StatusLengthRequired).JSON(fiber.Map{
+			"error": "Content-Length is required",
+		})
+	}
+	if offset+size > session.Length {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Chunk goes past Upload-Length",
+		})
+	}
+
+	if size > 0 {
+		body := c.Context().RequestBodyStream()
+		if body == nil {
+			body = bytes.NewReader(c.Body())
+		}
+		key := stagingKey(session.ID)
+		if err := storage.Default.Put(c.Context(), key, &exactReader{r: body, n: size}, size, "application/octet-stream"); err != nil {
+			log.Printf("Failed to store chunk for upload %s: %v", session.ID, err)
+			storage.Default.Delete(context.Background(), key)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to save chunk",
+			})
+		}
+
+		// Only record the chunk if nothing else did in the meantime, e.g. a retry that took
+		// over after our lease ran out
+		res := database.DB.Model(&models.UploadSession{}).
+			Where(map[string]interface{}{"id": session.ID, "offset": offset}).
+			Where("attachment_id IS NULL").
+			Updates(models.UploadSession{
+				Offset:    offset + size,
+				Chunks:    append(session.Chunks, key),
+				ExpiresAt: time.Now().Add(uploadSessionLifetime),
+			})
+		if res.Error != nil || res.RowsAffected != 1 {
+			storage.Default.Delete(context.Background(), key)
+			database.DB.First(session, "id = ?", session.ID)
+			c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Upload-Offset does not match the upload",
+			})
+		}
+		if err := database.DB.First(session, "id = ?", session.ID).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Upload not found",
+			})
+		}
+	}
+
+	if session.Offset == session.Length {
+		if att, err := finishResumableUpload(c, session); att == nil {
+			return err
+		}
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	setUploadExpires(c, session)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// finishResumableUpload stores a completed upload like a single-shot one. If the file is
+// rejected the upload is discarded, since resending the same bytes can't fix it.
+func finishResumableUpload(c *fiber.Ctx, session *models.UploadSession) (*models.Attachment, error) {
+	src := &stagedUpload{ctx: c.Context(), keys: session.Chunks}
+	defer src.Close()
+
+	// Other uploads may have finished since this one started
+	var cv *conversation
+	if session.ChannelID != nil {
+		cv, _ = loadConversation(*session.ChannelID)
+	}
+	if errMsg := checkStorageQuotas(session.UploaderID, cv, session.Length, session.Length); errMsg != "" {
+		discardUploadSession(session)
+		return nil, c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	att, err := storeUpload(c, session.Filename, session.Purpose, src, session.Length)
+	if att == nil {
+		discardUploadSession(session)
+		return nil, err
+	}
+
+	deleteChunks(session)
+	session.AttachmentID, session.Chunks = &att.ID, []string{}
+	database.DB.Model(session).Select("attachment_id", "chunks").Updates(session)
+	return att, nil
+}
+
+// exactReader reads n bytes of a request body, failing if the client stops short so a
+// truncated chunk is never stored
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// stagedUpload reads an upload's chunks back from storage one after another. It can only
+// seek back to the start, which is all storing an upload needs.
+type stagedUpload struct {
+	ctx  context.Context
+	keys []string
+	next int
+	cur  io.ReadCloser
+}
+
+func (s *stagedUpload) Read(p []byte) (int, error) {
+	for {
+		if s.cur == nil {
+			if s.next == len(s.keys) {
+				return 0, io.EOF
+			}
+			r, err := storage.Default.Open(s.ctx, s.keys[s.next])
+			if err != nil {
+				return 0, err
+			}
+			s.cur, s.next = r, s.next+1
+		}
+		n, err := s.cur.Read(p)
+		if err == io.EOF {
+			s.cur.Close()
+			s.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *stagedUpload) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("staged uploads can only be rewound")
+	}
+	s.Close()
+	s.next = 0
+	return 0, nil
+}
+
+func (s *stagedUpload) Close() error {
+	if s.cur == nil {
+		return nil
+	}
+	err := s.cur.Close()
+	s.cur = nil
+	return err
+}
+
+// GetResumableUpload reports an upload's progress, and the stored attachment once it is complete
+func GetResumableUpload(c *fiber.Ctx) error {
+	session, err := uploadSessionForRequest(c)
+	if session == nil {
+		return err
+	}
+
+	resp := fiber.Map{
+		"id":         session.ID,
+		"filename":   session.Filename,
+		"purpose":    session.Purpose,
+		"length":     session.Length,
+		"offset":     session.Offset,
+		"progress":   float64(session.Offset) / float64(session.Length),
+		"expires_at": session.ExpiresAt,
+	}
+	if session.AttachmentID != nil {
+		var att models.Attachment
+		if err := database.DB.Preload("Thumbnails", func(db *gorm.DB) *gorm.DB {
+			return db.Order("width")
+		}).First(&att, "id = ?", *session.AttachmentID).Error; err == nil {
+			resp["attachment"] = uploadResponse(&att)
+		}
+	}
+	return c.JSON(resp)
+}
+
+// DeleteResumableUpload cancels an upload. A completed upload's attachment is kept.
+func DeleteResumableUpload(c *fiber.Ctx) error {
+	if !checkTusVersion(c) {
+		return nil
+	}
+	session, err := uploadSessionForRequest(c)
+	if session == nil {
+		return err
+	}
+
+	discardUploadSession(session)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func discardUploadSession(session *models.UploadSession) {
+	database.DB.Delete(session)
+	deleteChunks(session)
+}
+
+// deleteChunks removes an upload's staged chunks from storage
+func deleteChunks(session *models.UploadSession) {
+	for _, key := range session.Chunks {
+		if err := storage.Default.Delete(context.Background(), key); err != nil {
+			log.Printf("Failed to remove chunk %s of upload %s: %v", key, session.ID, err)
+		}
+	}
+}
+
+// RunUploadSessionReaper discards expired resumable uploads in the background. It never returns.
+func RunUploadSessionReaper() {
+	ticker := time.NewTicker(uploadSessionReaperInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var sessions []models.UploadSession
+		database.DB.Where("expires_at <= ?", time.Now()).Find(&sessions)
+		for i := range sessions {
+			discardUploadSession(&sessions[i])
+		}
+	}
+}
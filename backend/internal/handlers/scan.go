@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/scanner"
+	"github.com/shitcord/backend/internal/storage"
+)
+
+// scanFailOpen reports whether uploads are accepted when the scanner can't be reached
+func scanFailOpen() bool {
+	return os.Getenv("UPLOAD_SCAN_FAIL_OPEN") == "true"
+}
+
+// scanUpload runs an upload through the malware scanner and records the verdict. Infected
+// files are quarantined and rejected. src is rewound afterwards. The returned scan has no
+// ID if scanning is off; it returns nil after writing an error response.
+func scanUpload(c *fiber.Ctx, filename, ext string, src io.ReadSeeker, size int64) (*models.UploadScan, error) {
+	if err := rewind(c, src); err != nil {
+		return nil, err
+	}
+	if !scanner.Enabled() {
+		return &models.UploadScan{}, nil
+	}
+
+	scan := &models.UploadScan{
+		ID:         uuid.New(),
+		UploaderID: middleware.GetUserID(c),
+		Filename:   filename,
+		Size:       size,
+	}
+	result, err := scanner.Default.Scan(c.Context(), src)
+	if err := rewind(c, src); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case err != nil:
+		log.Printf("Failed to scan upload %s: %v", filename, err)
+		scan.Status, scan.Error = "failed", err.Error()
+		database.DB.Create(scan)
+		if !scanFailOpen() {
+			return nil, c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "Uploads can't be checked for malware right now. Try again later.",
+			})
+		}
+		return scan, nil
+
+	case result.Infected:
+		scan.Status, scan.Signature = "infected", result.Signature
+		scan.QuarantineKey = fmt.Sprintf("quarantine/%s%s", scan.ID, ext)
+		if err := storage.Default.Put(c.Context(), scan.QuarantineKey, src, size, "application/octet-stream"); err != nil {
+			log.Printf("Failed to quarantine upload %s: %v", filename, err)
+			scan.QuarantineKey = ""
+		}
+		database.DB.Create(scan)
+		log.Printf("Rejected upload %s from %s: %s", filename, scan.UploaderID, result.Signature)
+		return nil, c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": fmt.Sprintf("File was rejected because it contains malware (%s)", result.Signature),
+		})
+	}
+
+	scan.Status = "clean"
+	database.DB.Create(scan)
+	return scan, nil
+}
+
+// rewind seeks src back to its start. It returns an error response if it can't.
+func rewind(c *fiber.Ctx, src io.Seeker) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read file",
+		})
+	}
+	return nil
+}
+
+// GetUploadScans lists malware scan results, newest first, optionally filtered by ?status (admin only)
+func GetUploadScans(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 50)
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	q := database.DB.Preload("Uploader").Order("created_at DESC").Limit(limit)
+	if status := c.Query("status"); status != "" {
+		q = q.Where("status = ?", status)
+	}
+	var scans []models.UploadScan
+	if err := q.Find(&scans).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch scans",
+		})
+	}
+
+	type statusCount struct {
+		Status string `json:"status"`
+		Count  int64  `json:"count"`
+	}
+	var counts []statusCount
+	database.DB.Model(&models.UploadScan{}).Select("status, COUNT(*) AS count").Group("status").Scan(&counts)
+
+	return c.JSON(fiber.Map{
+		"enabled": scanner.Enabled(),
+		"counts":  counts,
+		"scans":   scans,
+	})
+}
+
+// DeleteQuarantinedUpload deletes an infected file from quarantine, keeping the scan result (admin only)
+func DeleteQuarantinedUpload(c *fiber.Ctx) error {
+	scanID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid scan ID",
+		})
+	}
+
+	var scan models.UploadScan
+	if err := database.DB.First(&scan, "id = ?", scanID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Scan not found",
+		})
+	}
+	if scan.QuarantineKey == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Nothing is quarantined for this scan",
+		})
+	}
+
+	if err := storage.Default.Delete(c.Context(), scan.QuarantineKey); err != nil {
+		log.Printf("Failed to delete quarantined upload %s: %v", scan.QuarantineKey, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete file",
+		})
+	}
+	database.DB.Model(&scan).Update("quarantine_key", "")
+
+	return c.JSON(fiber.Map{"message": "Quarantined file deleted"})
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/scanner"
+	"github.com/shitcord/backend/internal/storage"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// setupUploads points the database, storage and scanner at throwaway instances and returns
+// an app serving UploadFile as the returned user
+func setupUploads(t *testing.T, scan scanner.Scanner) (*fiber.App, uuid.UUID) {
+	t.Helper()
+	dir := t.TempDir()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevDB, prevStorage, prevScanner := database.DB, storage.Default, scanner.Default
+	t.Cleanup(func() {
+		database.DB, storage.Default, scanner.Default = prevDB, prevStorage, prevScanner
+	})
+	database.DB = db
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	storage.Default = storage.NewLocal(filepath.Join(dir, "uploads"), "/uploads", []byte("signing-key"))
+	scanner.Default = scan
+
+	user := models.User{Username: "uploader", Email: "uploader@example.com", PasswordHash: "x", IsApproved: true}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/upload", func(c *fiber.Ctx) error {
+		c.Locals("userID", user.ID)
+		return c.Next()
+	}, UploadFile)
+	return app, user.ID
+}
+
+func upload(t *testing.T, app *fiber.App, filename, contents string) (int, string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write([]byte(contents))
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(resp.Body)
+	json.Unmarshal(data, &out)
+	return resp.StatusCode, out.Error
+}
+
+func countAttachments(t *testing.T) int64 {
+	t.Helper()
+	var count int64
+	database.DB.Model(&models.Attachment{}).Count(&count)
+	return count
+}
+
+func TestUploadScanning(t *testing.T) {
+	tests := []struct {
+		name        string
+		scanner     scanner.Scanner
+		failOpen    bool
+		contents    string
+		wantStatus  int
+		wantScan    string // Recorded verdict, "" for none
+		wantStored  bool
+		quarantined bool
+	}{
+		{"scanning off", scanner.Noop{}, false, eicar, fiber.StatusCreated, "", true, false},
+		{"clean", &scanner.Fake{}, false, "hello", fiber.StatusCreated, "clean", true, false},
+		{"infected", &scanner.Fake{}, false, "prefix " + eicar, fiber.StatusUnprocessableEntity, "infected", false, true},
+		{"custom pattern", &scanner.Fake{Patterns: map[string]string{"evil": "Test.Evil"}}, false, "so evil", fiber.StatusUnprocessableEntity, "infected", false, true},
+		{"scanner down", &scanner.Fake{Err: errors.New("connection refused")}, false, "hello", fiber.StatusServiceUnavailable, "failed", false, false},
+		{"scanner down, fail open", &scanner.Fake{Err: errors.New("connection refused")}, true, "hello", fiber.StatusCreated, "failed", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, userID := setupUploads(t, tt.scanner)
+			if tt.failOpen {
+				t.Setenv("UPLOAD_SCAN_FAIL_OPEN", "true")
+			}
+
+			status, errMsg := upload(t, app, "notes.txt", tt.contents)
+			if status != tt.wantStatus {
+				t.Fatalf("status %d (%s), want %d", status, errMsg, tt.wantStatus)
+			}
+			if stored := countAttachments(t) == 1; stored != tt.wantStored {
+				t.Fatalf("stored = %v, want %v", stored, tt.wantStored)
+			}
+
+			var scans []models.UploadScan
+			database.DB.Find(&scans)
+			if tt.wantScan == "" {
+				if len(scans) != 0 {
+					t.Fatalf("recorded %d scans with scanning off", len(scans))
+				}
+				return
+			}
+			if len(scans) != 1 {
+				t.Fatalf("recorded %d scans, want 1", len(scans))
+			}
+			scan := scans[0]
+			if scan.Status != tt.wantScan || scan.UploaderID != userID || scan.Filename != "notes.txt" {
+				t.Fatalf("scan recorded as %s for %s (%s)", scan.Status, scan.UploaderID, scan.Filename)
+			}
+			if tt.wantStored != (scan.AttachmentID != nil) {
+				t.Fatalf("scan attachment = %v, want stored = %v", scan.AttachmentID, tt.wantStored)
+			}
+
+			if !tt.quarantined {
+				if scan.QuarantineKey != "" {
+					t.Fatalf("quarantined as %s", scan.QuarantineKey)
+				}
+				return
+			}
+			if !strings.HasPrefix(scan.QuarantineKey, "quarantine/") || scan.Signature == "" {
+				t.Fatalf("infected upload quarantined as %q with signature %q", scan.QuarantineKey, scan.Signature)
+			}
+			r, err := storage.Default.Open(context.Background(), scan.QuarantineKey)
+			if err != nil {
+				t.Fatalf("quarantined file: %v", err)
+			}
+			defer r.Close()
+			if data, _ := io.ReadAll(r); string(data) != tt.contents {
+				t.Fatalf("quarantined %q, want %q", data, tt.contents)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/ws"
+)
+
+const (
+	// maxScheduleAhead is how far in the future a message can be scheduled
+	maxScheduleAhead = 365 * 24 * time.Hour
+	// maxPendingScheduled caps how many scheduled messages a user can have waiting
+	maxPendingScheduled = 100
+
+	// The scheduler polls for due messages every schedulerInterval. A claimed message is
+	// leased for schedulerLease so another instance can pick it up if this one dies mid-send.
+	schedulerInterval  = 5 * time.Second
+	schedulerLease     = time.Minute
+	schedulerBatchSize = 100
+)
+
+// scheduledPayload turns a stored scheduled message back into the request SendMessage accepts
+func scheduledPayload(sm *models.ScheduledMessage) *SendMessageRequest {
+	return &SendMessageRequest{
+		Content:          sm.Content,
+		Nonce:            sm.Nonce,
+		EncryptionHeader: sm.EncryptionHeader,
+		Type:             sm.Type,
+		AttachmentURL:    sm.AttachmentURL,
+		ReplyToID:        sm.ReplyToID,
+		Mentions:         sm.Mentions,
+		RequestReceipts:  sm.RequestReceipts,
+		Poll:             sm.Poll,
+	}
+}
+
+// validSendAt returns a client-facing error if a send time is in the past or too far ahead
+func validSendAt(sendAt time.Time) string {
+	if !sendAt.After(time.Now()) {
+		return "send_at must be in the future"
+	}
+	if sendAt.After(time.Now().Add(maxScheduleAhead)) {
+		return "Messages can be scheduled at most a year ahead"
+	}
+	return ""
+}
+
+// notClaimed matches scheduled messages no instance is currently sending
+const notClaimed = "(claimed_until IS NULL OR claimed_until < ?)"
+
+// CreateScheduledMessage stores a message payload to be posted to a channel later
+func CreateScheduledMessage(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	channelID, err := uuid.Parse(c.Params("channelId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid channel ID",
+		})
+	}
+
+	type ScheduleRequest struct {
+		SendMessageRequest
+		SendAt time.Time `json:"send_at"`
+	}
+
+	var req ScheduleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if errMsg := validSendAt(req.SendAt); errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	cv, ok := loadConversation(channelID)
+	if !ok || !cv.canAccess(userID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+	}
+
+	// Validate now so users find out about problems while they can still fix them.
+	// Mentions are resolved again when the message is actually sent.
+	if _, errMsg := req.validate(userID, cv); errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	var pending int64
+	database.DB.Model(&models.ScheduledMessage{}).Where("author_id = ? AND status = ?", userID, "pending").Count(&pending)
+	if pending >= maxPendingScheduled {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Too many scheduled messages",
+		})
+	}
+
+	sm := models.ScheduledMessage{
+		ChannelID:        channelID,
+		AuthorID:         userID,
+		Content:          req.Content,
+		Nonce:            req.Nonce,
+		EncryptionHeader: req.EncryptionHeader,
+		Type:             req.Type,
+		AttachmentURL:    req.AttachmentURL,
+		ReplyToID:        req.ReplyToID,
+		Mentions:         req.Mentions,
+		RequestReceipts:  req.RequestReceipts,
+		Poll:             req.Poll,
+		SendAt:           req.SendAt,
+		Status:           "pending",
+	}
+
+	if err := database.DB.Create(&sm).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to schedule message",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(sm)
+}
+
+// GetScheduledMessages returns the current user's pending and failed scheduled messages
+func GetScheduledMessages(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	query := database.DB.Where("author_id = ?", userID).Order("send_at ASC")
+
+	if channelID := c.Query("channel_id"); channelID != "" {
+		if id, err := uuid.Parse(channelID); err == nil {
+			query = query.Where("channel_id = ?", id)
+		}
+	}
+
+	var scheduled []models.ScheduledMessage
+	query.Find(&scheduled)
+
+	return c.JSON(scheduled)
+}
+
+// UpdateScheduledMessage edits the payload or send time of a scheduled message.
+// Rescheduling a failed message puts it back in the queue.
+func UpdateScheduledMessage(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	scheduledID, err := uuid.Parse(c.Params("scheduledId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid scheduled message ID",
+		})
+	}
+
+	var sm models.ScheduledMessage
+	if err := database.DB.First(&sm, "id = ? AND author_id = ?", scheduledID, userID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Scheduled message not found",
+		})
+	}
+
+	type UpdateRequest struct {
+		Content          *string                 `json:"content"`
+		Nonce            string                  `json:"nonce"`
+		EncryptionHeader string                  `json:"encryption_header"`
+		AttachmentURL    *string                 `json:"attachment_url"`
+		Mentions         *models.MentionMetadata `json:"mentions"`
+		SendAt           *time.Time              `json:"send_at"`
+	}
+
+	var req UpdateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Content, nonce and header are encrypted together, so they're replaced together
+	payload := scheduledPayload(&sm)
+	updates := map[string]interface{}{}
+	if req.Content != nil {
+		payload.Content = *req.Content
+		payload.Nonce = req.Nonce
+		payload.EncryptionHeader = req.EncryptionHeader
+		updates["content"] = *req.Content
+		updates["nonce"] = req.Nonce
+		updates["encryption_header"] = req.EncryptionHeader
+	}
+	if req.AttachmentURL != nil {
+		payload.AttachmentURL = *req.AttachmentURL
+		updates["attachment_url"] = *req.AttachmentURL
+	}
+	if req.Mentions != nil {
+		payload.Mentions = req.Mentions
+		// Map updates skip the field serializer, so encode it the way the column stores it
+		mentions, _ := json.Marshal(req.Mentions)
+		updates["mentions"] = string(mentions)
+	}
+	if req.SendAt != nil {
+		if errMsg := validSendAt(*req.SendAt); errMsg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": errMsg,
+			})
+		}
+		updates["send_at"] = *req.SendAt
+		updates["status"] = "pending"
+		updates["error"] = ""
+	}
+
+	if len(updates) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No fields to update",
+		})
+	}
+
+	cv, ok := loadConversation(sm.ChannelID)
+	if !ok || !cv.canAccess(userID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+	}
+
+	if _, errMsg := payload.validate(userID, cv); errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	// Only touch the row if the scheduler isn't sending it right now
+	result := database.DB.Model(&sm).Where(notClaimed, time.Now()).Updates(updates)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update scheduled message",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Scheduled message is already being sent",
+		})
+	}
+
+	database.DB.First(&sm, "id = ?", sm.ID)
+
+	return c.JSON(sm)
+}
+
+// DeleteScheduledMessage cancels a scheduled message
+func DeleteScheduledMessage(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	scheduledID, err := uuid.Parse(c.Params("scheduledId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid scheduled message ID",
+		})
+	}
+
+	var sm models.ScheduledMessage
+	if err := database.DB.First(&sm, "id = ? AND author_id = ?", scheduledID, userID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Scheduled message not found",
+		})
+	}
+
+	result := database.DB.Where("id = ? AND "+notClaimed, sm.ID, time.Now()).Delete(&models.ScheduledMessage{})
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Scheduled message is already being sent",
+		})
+	}
+
+	return c.JSON(fiber.Map{"message": "Scheduled message cancelled"})
+}
+
+// RunMessageScheduler posts scheduled messages once they're due. It never returns.
+// Several instances can run it against the same database: each message is claimed
+// with a conditional update first, and the posted message reuses the scheduled ID,
+// so a message is never posted twice even if an instance dies halfway through.
+func RunMessageScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		dispatchScheduledMessages()
+	}
+}
+
+// dispatchScheduledMessages claims and sends every due scheduled message
+func dispatchScheduledMessages() {
+	now := time.Now()
+
+	var ids []uuid.UUID
+	database.DB.Model(&models.ScheduledMessage{}).
+		Where("status = ? AND send_at <= ? AND "+notClaimed, "pending", now, now).
+		Order("send_at ASC").
+		Limit(schedulerBatchSize).
+		Pluck("id", &ids)
+
+	for _, id := range ids {
+		claimedAt := time.Now()
+		result := database.DB.Model(&models.ScheduledMessage{}).
+			Where("id = ? AND status = ? AND "+notClaimed, id, "pending", claimedAt).
+			Update("claimed_until", claimedAt.Add(schedulerLease))
+		if result.RowsAffected != 1 {
+			continue // Another instance got it, or it was edited or cancelled
+		}
+
+		// Reload after claiming so a last-second edit is what gets sent
+		var sm models.ScheduledMessage
+		if err := database.DB.First(&sm, "id = ?", id).Error; err != nil {
+			continue
+		}
+		sendScheduledMessage(&sm)
+	}
+}
+
+// sendScheduledMessage posts a claimed scheduled message as its author
+func sendScheduledMessage(sm *models.ScheduledMessage) {
+	// A previous attempt already posted it but died before cleaning up
+	var existing int64
+	database.DB.Unscoped().Model(&models.Message{}).Where("id = ?", sm.ID).Count(&existing)
+	if existing > 0 {
+		database.DB.Delete(sm)
+		return
+	}
+
+	cv, ok := loadConversation(sm.ChannelID)
+	if !ok {
+		failScheduledMessage(sm, "Channel no longer exists")
+		return
+	}
+	if !cv.canAccess(sm.AuthorID) {
+		failScheduledMessage(sm, "You no longer have access to this channel")
+		return
+	}
+
+	req := scheduledPayload(sm)
+	mentionRecipients, errMsg := req.validate(sm.AuthorID, cv)
+	if errMsg != "" {
+		failScheduledMessage(sm, errMsg)
+		return
+	}
+
+	// The author's own sessions get the broadcast too, since no REST response carries it
+	msg := models.Message{ID: sm.ID, AuthorID: sm.AuthorID}
+	if err := publishMessage(&msg, cv, req, mentionRecipients, uuid.Nil); err != nil {
+		log.Printf("Failed to send scheduled message %s: %v", sm.ID, err)
+		failScheduledMessage(sm, "Failed to send message")
+		return
+	}
+
+	database.DB.Delete(sm)
+}
+
+// failScheduledMessage keeps a scheduled message around as failed and tells its author
+func failScheduledMessage(sm *models.ScheduledMessage, reason string) {
+	database.DB.Model(sm).Updates(map[string]interface{}{
+		"status":        "failed",
+		"error":         reason,
+		"claimed_until": nil,
+	})
+
+	if ws.GlobalHub != nil {
+		ws.GlobalHub.SendToUser(sm.AuthorID, ws.EventScheduledUpdate, sm)
+	}
+}
@@ -1,13 +1,16 @@
 package handlers
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 
+	"github.com/shitcord/backend/internal/access"
 	"github.com/shitcord/backend/internal/crypto"
 	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/eventhooks"
 	"github.com/shitcord/backend/internal/middleware"
 	"github.com/shitcord/backend/internal/models"
 	"github.com/shitcord/backend/internal/ws"
@@ -155,6 +158,8 @@ func UpdateServer(c *fiber.Ctx) error {
 		Description *string `json:"description"`
 		IconURL     *string `json:"icon_url"`
 		IsPrivate   *bool   `json:"is_private"`
+		// Replaces all of the server's upload limits; an empty object clears them
+		UploadLimits *map[string]int64 `json:"upload_limits"`
 	}
 
 	var req UpdateRequest
@@ -177,6 +182,19 @@ func UpdateServer(c *fiber.Ctx) error {
 	if req.IsPrivate != nil {
 		updates["is_private"] = *req.IsPrivate
 	}
+	if req.UploadLimits != nil {
+		if errMsg := validateUploadLimits(*req.UploadLimits); errMsg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": errMsg,
+			})
+		}
+		// Map updates skip the JSON serializer, so the column is written already encoded
+		updates["upload_limits"] = nil
+		if len(*req.UploadLimits) > 0 {
+			encoded, _ := json.Marshal(*req.UploadLimits)
+			updates["upload_limits"] = string(encoded)
+		}
+	}
 
 	var server models.Server
 	database.DB.Model(&server).Where("id = ?", serverID).Updates(updates)
@@ -265,6 +283,10 @@ func JoinServer(c *fiber.Ctx) error {
 			"member":    member,
 		}, uuid.Nil)
 	}
+	eventhooks.Emit(serverID, "", eventhooks.EventMemberJoin, map[string]interface{}{
+		"server_id": serverID,
+		"member":    member,
+	})
 
 	return c.JSON(fiber.Map{"message": "Joined server successfully"})
 }
@@ -295,15 +317,17 @@ func LeaveServer(c *fiber.Ctx) error {
 	database.DB.Where("server_id = ? AND user_id = ?", serverID, userID).Delete(&models.ServerMember{})
 
 	// Broadcast MEMBER_LEAVE to server members
+	var user models.User
+	database.DB.First(&user, "id = ?", userID)
+	leave := map[string]interface{}{
+		"server_id": serverID,
+		"user_id":   userID,
+		"username":  user.Username,
+	}
 	if ws.GlobalHub != nil {
-		var user models.User
-		database.DB.First(&user, "id = ?", userID)
-		ws.GlobalHub.BroadcastToServer(serverID.String(), ws.EventMemberLeave, map[string]interface{}{
-			"server_id": serverID,
-			"user_id":   userID,
-			"username":  user.Username,
-		}, uuid.Nil)
+		ws.GlobalHub.BroadcastToServer(serverID.String(), ws.EventMemberLeave, leave, uuid.Nil)
 	}
+	eventhooks.Emit(serverID, "", eventhooks.EventMemberLeave, leave)
 
 	return c.JSON(fiber.Map{"message": "Left server successfully"})
 }
@@ -364,6 +388,12 @@ func KickMember(c *fiber.Ctx) error {
 
 	database.DB.Where("server_id = ? AND user_id = ?", serverID, targetID).Delete(&models.ServerMember{})
 
+	eventhooks.Emit(serverID, "", eventhooks.EventMemberKick, map[string]interface{}{
+		"server_id":    serverID,
+		"user_id":      targetID,
+		"moderator_id": userID,
+	})
+
 	return c.JSON(fiber.Map{"message": "Member kicked successfully"})
 }
 
@@ -472,6 +502,10 @@ func JoinByInvite(c *fiber.Ctx) error {
 			"member":    member,
 		}, uuid.Nil)
 	}
+	eventhooks.Emit(serverID, "", eventhooks.EventMemberJoin, map[string]interface{}{
+		"server_id": serverID,
+		"member":    member,
+	})
 
 	return c.JSON(fiber.Map{
 		"message": "Joined server successfully",
@@ -481,12 +515,16 @@ func JoinByInvite(c *fiber.Ctx) error {
 
 // Helper functions
 
+// roleHierarchy ranks server member roles from most to least privileged
+var roleHierarchy = map[string]int{
+	"owner":     4,
+	"admin":     3,
+	"moderator": 2,
+	"member":    1,
+}
+
 func isMember(userID, serverID uuid.UUID) bool {
-	var count int64
-	database.DB.Model(&models.ServerMember{}).
-		Where("user_id = ? AND server_id = ?", userID, serverID).
-		Count(&count)
-	return count > 0
+	return access.IsMember(userID, serverID)
 }
 
 func hasPermission(userID, serverID uuid.UUID, minRole string) bool {
@@ -495,13 +533,6 @@ func hasPermission(userID, serverID uuid.UUID, minRole string) bool {
 		return false
 	}
 
-	roleHierarchy := map[string]int{
-		"owner":     4,
-		"admin":     3,
-		"moderator": 2,
-		"member":    1,
-	}
-
 	userLevel := roleHierarchy[member.Role]
 	requiredLevel := roleHierarchy[minRole]
 
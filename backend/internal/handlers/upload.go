@@ -1,16 +1,116 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/blobstore"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/filetype"
+	"github.com/shitcord/backend/internal/imaging"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
 )
 
+// maxImageBytes is the largest image that is decoded to strip its metadata and render thumbnails
+const maxImageBytes = 64 << 20
+
+// defaultUploadLimit returns the upload size limit in bytes outside servers that set their own
+func defaultUploadLimit() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("MAX_UPLOAD_SIZE_MB"), 10, 64); err == nil && n > 0 {
+		return n << 20
+	}
+	return 50 << 20
+}
+
+// maxUploadLimit returns the largest upload size limit in bytes a server may set
+func maxUploadLimit() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("MAX_SERVER_UPLOAD_SIZE_MB"), 10, 64); err == nil && n > 0 {
+		return max(n<<20, defaultUploadLimit())
+	}
+	return max(1<<30, defaultUploadLimit())
+}
+
+// uploadLimit returns the largest file a user may post in a conversation. Servers can set
+// limits per role; a member gets the largest one set for their role or any role below it.
+// A nil conversation means the upload isn't for a particular channel yet.
+func uploadLimit(userID uuid.UUID, cv *conversation) int64 {
+	limit := defaultUploadLimit()
+	if cv == nil || cv.serverID() == nil {
+		return limit
+	}
+
+	var server models.Server
+	if err := database.DB.Select("id", "upload_limits").First(&server, "id = ?", *cv.serverID()).Error; err != nil || len(server.UploadLimits) == 0 {
+		return limit
+	}
+	var member models.ServerMember
+	if err := database.DB.Where("user_id = ? AND server_id = ?", userID, server.ID).First(&member).Error; err != nil {
+		return limit
+	}
+
+	level := roleHierarchy[member.Role]
+	best := int64(0)
+	for role, mb := range server.UploadLimits {
+		if roleHierarchy[role] <= level && mb > best {
+			best = mb
+		}
+	}
+	if best == 0 {
+		return limit
+	}
+	return min(best<<20, maxUploadLimit())
+}
+
+// validateUploadLimits checks a server's per-role upload limits
+func validateUploadLimits(limits map[string]int64) string {
+	maxMB := maxUploadLimit() >> 20
+	for role, mb := range limits {
+		if _, ok := roleHierarchy[role]; !ok {
+			return fmt.Sprintf("Unknown role '%s' in upload limits", role)
+		}
+		if mb < 1 || mb > maxMB {
+			return fmt.Sprintf("Upload limits must be between 1 and %d MB", maxMB)
+		}
+	}
+	return ""
+}
+
+// uploadConversation resolves the optional channel an upload is meant for, which decides
+// its size limit. It returns false after writing an error response.
+func uploadConversation(c *fiber.Ctx, channelID string) (*conversation, bool) {
+	if channelID == "" {
+		return nil, true
+	}
+	id, err := uuid.Parse(channelID)
+	if err != nil {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid channel ID",
+		})
+		return nil, false
+	}
+	cv, ok := loadConversation(id)
+	if !ok || !cv.canAccess(middleware.GetUserID(c)) {
+		c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+		return nil, false
+	}
+	return cv, true
+}
+
 // UploadFile handles file uploads and returns the URL
 func UploadFile(c *fiber.Ctx) error {
 	file, err := c.FormFile("file")
@@ -20,77 +120,227 @@ func UploadFile(c *fiber.Ctx) error {
 		})
 	}
 
-	// 50MB limit
-	if file.Size > 50*1024*1024 {
+	cv, ok := uploadConversation(c, c.FormValue("channel_id"))
+	if !ok {
+		return nil
+	}
+	userID := middleware.GetUserID(c)
+	if limit := uploadLimit(userID, cv); file.Size > limit {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("File too large. Maximum size is %dMB", limit>>20),
+		})
+	}
+	if errMsg := checkStorageQuotas(userID, cv, file.Size, 0); errMsg != "" {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	src, err := file.Open()
+	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "File too large. Maximum size is 50MB",
+			"error": "Failed to read file",
 		})
 	}
+	defer src.Close()
 
-	// Validate extension
-	ext := strings.ToLower(filepath.Ext(file.Filename))
-	allowedExts := map[string]bool{
-		".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
-		".mp4": true, ".webm": true, ".mov": true,
-		".mp3": true, ".ogg": true, ".wav": true, ".flac": true,
-		".pdf": true, ".txt": true, ".md": true, ".csv": true,
-		".zip": true, ".tar": true, ".gz": true, ".7z": true, ".rar": true,
-		".doc": true, ".docx": true, ".xls": true, ".xlsx": true, ".pptx": true,
-		".json": true, ".xml": true, ".yaml": true, ".yml": true,
-		".go": true, ".py": true, ".js": true, ".ts": true, ".rs": true,
-		".c": true, ".cpp": true, ".h": true, ".java": true, ".rb": true,
-		".svg": true, ".ico": true, ".bmp": true, ".tiff": true,
+	att, err := storeUpload(c, file.Filename, c.FormValue("purpose", "attachment"), src, file.Size)
+	if att == nil {
+		return err
 	}
+	return c.Status(fiber.StatusCreated).JSON(uploadResponse(att))
+}
 
-	if !allowedExts[ext] {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+// checkUploadPurpose validates what an upload is for. Avatars and icons are served publicly,
+// everything else only to people who can see it.
+func checkUploadPurpose(purpose string) string {
+	if purpose != "attachment" && purpose != "avatar" && purpose != "icon" {
+		return "Purpose must be attachment, avatar or icon"
+	}
+	return ""
+}
+
+// storeUpload checks a file's type against its contents, strips image metadata, stores it with
+// its thumbnails and records the attachment. Contents that are already stored are shared
+// rather than written again. It returns nil after writing an error response.
+func storeUpload(c *fiber.Ctx, filename, purpose string, src io.ReadSeeker, size int64) (*models.Attachment, error) {
+	if errMsg := checkUploadPurpose(purpose); errMsg != "" {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	if !filetype.Allowed(ext) {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": fmt.Sprintf("File type '%s' is not allowed", ext),
 		})
 	}
 
-	// Create uploads directory structure: uploads/YYYY/MM/
-	now := time.Now()
-	dir := fmt.Sprintf("./uploads/%d/%02d", now.Year(), now.Month())
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create upload directory",
+	// The contents must agree with the extension; the client's Content-Type is ignored
+	head := make([]byte, filetype.SniffLen)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to read file",
 		})
 	}
+	head = head[:n]
 
-	// Generate unique filename
-	id := uuid.New().String()
-	filename := fmt.Sprintf("%s%s", id, ext)
-	path := filepath.Join(dir, filename)
+	ft, err := filetype.Detect(ext, head)
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("File contents do not match the '%s' extension", ext),
+		})
+	}
+	fileType := ft.Category
 
-	// Save the file
-	if err := c.SaveFile(file, path); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to save file",
+	if purpose != "attachment" && (fileType != "image" || !ft.Inline) {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Avatars and icons must be images",
 		})
 	}
 
-	// Determine file type category
-	fileType := "file"
-	imageExts := map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".svg": true, ".bmp": true, ".ico": true}
-	videoExts := map[string]bool{".mp4": true, ".webm": true, ".mov": true}
-	audioExts := map[string]bool{".mp3": true, ".ogg": true, ".wav": true, ".flac": true}
+	// Nothing is stored until the malware scanner has seen all of it
+	scan, err := scanUpload(c, filename, ext, src, size)
+	if scan == nil {
+		return nil, err
+	}
 
-	if imageExts[ext] {
-		fileType = "image"
-	} else if videoExts[ext] {
-		fileType = "video"
-	} else if audioExts[ext] {
-		fileType = "audio"
+	// Each upload gets its own URL, laid out as /uploads/YYYY/MM/<uuid><ext>
+	now := time.Now()
+	base := fmt.Sprintf("%d/%02d/%s", now.Year(), now.Month(), uuid.New().String())
+	url := "/uploads/" + base + ext
+
+	contentType := ft.MIME
+	var body io.Reader = src
+	var hash string
+
+	// Images are stored without their metadata, and with their dimensions and thumbnails
+	var img *imaging.Result
+	if fileType == "image" {
+		if size > maxImageBytes {
+			return nil, c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error": fmt.Sprintf("Images can be at most %dMB", maxImageBytes>>20),
+			})
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Failed to read file",
+			})
+		}
+		img, err = imaging.Process(ext, data)
+		switch {
+		case err == nil:
+			data = img.Data
+		case errors.Is(err, imaging.ErrUnsupported):
+			img = nil
+		case errors.Is(err, imaging.ErrTooLarge):
+			return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Images can be at most %d megapixels", imaging.MaxPixels/1_000_000),
+			})
+		default:
+			return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Image could not be read",
+			})
+		}
+		body, size = bytes.NewReader(data), int64(len(data))
+		hash = blobstore.HashBytes(data)
 	}
 
-	// Return the URL (strip leading ./)
-	url := "/" + strings.TrimPrefix(path, "./")
+	// Contents are stored by hash, so they're hashed exactly as they will be stored
+	if hash == "" {
+		if hash, err = blobstore.Hash(src); err != nil {
+			return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Failed to read file",
+			})
+		}
+		body = src
+	}
 
-	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"url":           url,
-		"filename":      file.Filename,
-		"size":          file.Size,
-		"type":          fileType,
-		"content_type":  file.Header.Get("Content-Type"),
-	})
+	if err := blobstore.Put(c.Context(), hash, body, size, contentType); err != nil {
+		log.Printf("Failed to store upload %s: %v", url, err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save file",
+		})
+	}
+	stored := []string{hash}
+	discard := func() {
+		for _, h := range stored {
+			blobstore.Release(context.Background(), h)
+		}
+	}
+
+	att := models.Attachment{
+		UploaderID:  middleware.GetUserID(c),
+		Purpose:     purpose,
+		URL:         url,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		Type:        fileType,
+		BlobHash:    hash,
+	}
+	if img != nil {
+		att.Width, att.Height = img.Width, img.Height
+		for _, t := range img.Thumbnails {
+			thumbURL := fmt.Sprintf("/uploads/%s_%d%s", base, t.Size, t.Ext)
+			thumbHash := blobstore.HashBytes(t.Data)
+			if err := blobstore.Put(c.Context(), thumbHash, bytes.NewReader(t.Data), int64(len(t.Data)), t.MIME); err != nil {
+				log.Printf("Failed to store thumbnail %s: %v", thumbURL, err)
+				discard()
+				return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to save file",
+				})
+			}
+			stored = append(stored, thumbHash)
+			att.Thumbnails = append(att.Thumbnails, models.Attachment{
+				UploaderID:  att.UploaderID,
+				Purpose:     "thumbnail",
+				URL:         thumbURL,
+				Filename:    filename,
+				ContentType: t.MIME,
+				Size:        int64(len(t.Data)),
+				Type:        "image",
+				Width:       t.Width,
+				Height:      t.Height,
+				BlobHash:    thumbHash,
+			})
+		}
+	}
+
+	if err := database.DB.Create(&att).Error; err != nil {
+		discard()
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save file",
+		})
+	}
+	if scan.ID != uuid.Nil {
+		database.DB.Model(scan).Update("attachment_id", att.ID)
+	}
+	return &att, nil
+}
+
+// uploadResponse describes a stored upload to the client that uploaded it
+func uploadResponse(att *models.Attachment) fiber.Map {
+	signUpload(att)
+	resp := fiber.Map{
+		"id":           att.ID,
+		"url":          att.URL,
+		"filename":     att.Filename,
+		"size":         att.Size,
+		"type":         att.Type,
+		"content_type": att.ContentType,
+		"purpose":      att.Purpose,
+	}
+	if att.SignedURL != "" {
+		resp["signed_url"] = att.SignedURL
+	}
+	if att.Width > 0 {
+		resp["width"] = att.Width
+		resp["height"] = att.Height
+		resp["thumbnails"] = att.Thumbnails
+	}
+	return resp
 }
@@ -1,44 +1,96 @@
 package handlers
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 
 	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/eventhooks"
 	"github.com/shitcord/backend/internal/middleware"
 	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/sfu"
 	"github.com/shitcord/backend/internal/ws"
 )
 
-// GetICEServers returns the STUN/TURN server configuration for WebRTC
-func GetICEServers(c *fiber.Ctx) error {
-	iceServers := []fiber.Map{}
+// iceURLs reads a comma-separated list of stun:, stuns:, turn: or turns: URLs
+func iceURLs(key, fallback string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		value = fallback
+	}
+	var urls []string
+	for _, u := range strings.Split(value, ",") {
+		u = strings.TrimSpace(u)
+		scheme, _, _ := strings.Cut(u, ":")
+		switch scheme {
+		case "stun", "stuns", "turn", "turns":
+			urls = append(urls, u)
+		case "":
+		default:
+			log.Printf("Ignoring %s entry %q: not a STUN or TURN URL", key, u)
+		}
+	}
+	return urls
+}
 
-	// STUN server
-	stunServer := os.Getenv("STUN_SERVER")
-	if stunServer == "" {
-		stunServer = "stun:stun.l.google.com:19302"
+// turnCredentialTTL returns how long TURN credentials stay valid: TURN_TTL_SECONDS, 24 hours by default
+func turnCredentialTTL() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("TURN_TTL_SECONDS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
 	}
-	iceServers = append(iceServers, fiber.Map{
-		"urls": stunServer,
-	})
+	return 24 * time.Hour
+}
+
+// turnCredentials makes short-lived TURN credentials with the TURN REST API scheme that
+// coturn's use-auth-secret understands: the username is "<expiry>:<user ID>" and the
+// password is the base64 HMAC-SHA1 of it, keyed with the secret shared with the TURN server
+func turnCredentials(secret string, userID uuid.UUID, ttl time.Duration) (username, credential string) {
+	username = fmt.Sprintf("%d:%s", time.Now().Add(ttl).Unix(), userID)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// GetICEServers returns the STUN/TURN server configuration for WebRTC. With TURN_SECRET set,
+// each user gets their own TURN credentials that expire after ttl seconds; clients should
+// fetch new ones before then. A ttl of 0 means the credentials don't expire.
+func GetICEServers(c *fiber.Ctx) error {
+	iceServers := []fiber.Map{}
 
-	// TURN server (critical for mobile / symmetric NAT)
-	turnServer := os.Getenv("TURN_SERVER")
-	turnUsername := os.Getenv("TURN_USERNAME")
-	turnPassword := os.Getenv("TURN_PASSWORD")
-	if turnServer != "" {
+	if stun := iceURLs("STUN_SERVER", "stun:stun.l.google.com:19302"); len(stun) > 0 {
 		iceServers = append(iceServers, fiber.Map{
-			"urls":       turnServer,
-			"username":   turnUsername,
-			"credential": turnPassword,
+			"urls": stun,
 		})
 	}
 
+	// TURN servers (critical for mobile / symmetric NAT)
+	ttl := time.Duration(0)
+	if turn := iceURLs("TURN_SERVER", ""); len(turn) > 0 {
+		server := fiber.Map{"urls": turn}
+		if secret := os.Getenv("TURN_SECRET"); secret != "" {
+			ttl = turnCredentialTTL()
+			server["username"], server["credential"] = turnCredentials(secret, middleware.GetUserID(c), ttl)
+		} else {
+			// Static credentials are shared by everyone and never expire; prefer TURN_SECRET
+			server["username"] = os.Getenv("TURN_USERNAME")
+			server["credential"] = os.Getenv("TURN_PASSWORD")
+		}
+		iceServers = append(iceServers, server)
+	}
+
 	return c.JSON(fiber.Map{
 		"ice_servers": iceServers,
+		"ttl":         int(ttl.Seconds()),
 	})
 }
 
@@ -71,13 +123,33 @@ func JoinVoiceChannel(c *fiber.Ctx) error {
 		})
 	}
 
-	// Remove from any existing voice channel
-	database.DB.Where("user_id = ?", userID).Delete(&models.VoiceState{})
+	// The gateway session from READY ties the voice state to that connection, so the user
+	// leaves voice if it drops for good
+	var body struct {
+		SessionID string `json:"session_id"`
+	}
+	c.BodyParser(&body)
+
+	// A moderator's server mute and deafen stay on the member until they are lifted
+	var member models.ServerMember
+	database.DB.Where("user_id = ? AND server_id = ?", userID, channel.ServerID).First(&member)
 
 	voiceState := models.VoiceState{
-		UserID:    userID,
-		ChannelID: channelID,
-		ServerID:  channel.ServerID,
+		UserID:         userID,
+		ChannelID:      channelID,
+		ServerID:       channel.ServerID,
+		ServerMuted:    member.ServerMuted,
+		ServerDeafened: member.ServerDeafened,
+	}
+
+	// Remove from any existing voice channel
+	var previous models.VoiceState
+	if err := database.DB.First(&previous, "user_id = ?", userID).Error; err == nil {
+		ws.RemoveVoiceState(&previous, userID)
+	}
+	sfu.Default.Leave(userID)
+	if sessionID, err := uuid.Parse(body.SessionID); err == nil {
+		voiceState.SessionID = &sessionID
 	}
 
 	if err := database.DB.Create(&voiceState).Error; err != nil {
@@ -101,13 +173,44 @@ func JoinVoiceChannel(c *fiber.Ctx) error {
 			"voice_state": voiceState,
 		}, userID)
 	}
+	eventhooks.Emit(channel.ServerID, channelID.String(), eventhooks.EventVoiceJoin, map[string]interface{}{
+		"channel_id":  channelID,
+		"server_id":   channel.ServerID,
+		"voice_state": voiceState,
+	})
 
+	// With the SFU on, clients connect to the server with SFU_JOIN instead of to each participant
 	return c.JSON(fiber.Map{
 		"voice_state":  voiceState,
 		"participants": participants,
+		"sfu":          sfu.Enabled(),
 	})
 }
 
+// UpdateVoiceState changes the current user's mute, deafen, streaming and video flags
+func UpdateVoiceState(c *fiber.Ctx) error {
+	var update ws.VoiceStateUpdate
+	if err := c.BodyParser(&update); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	state, err := ws.UpdateVoiceState(middleware.GetUserID(c), update)
+	if err == ws.ErrNotInVoice {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "You are not in a voice channel",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update voice state",
+		})
+	}
+
+	return c.JSON(state)
+}
+
 // LeaveVoiceChannel removes a user from a voice channel
 func LeaveVoiceChannel(c *fiber.Ctx) error {
 	userID := middleware.GetUserID(c)
@@ -118,10 +221,12 @@ func LeaveVoiceChannel(c *fiber.Ctx) error {
 		})
 	}
 
-	database.DB.Where("user_id = ? AND channel_id = ?", userID, channelID).Delete(&models.VoiceState{})
-
-	// Broadcast VOICE_STATE_LEAVE to the channel
-	if ws.GlobalHub != nil {
+	var voiceState models.VoiceState
+	if err := database.DB.First(&voiceState, "user_id = ? AND channel_id = ?", userID, channelID).Error; err == nil {
+		ws.RemoveVoiceState(&voiceState, userID)
+		sfu.Default.Leave(userID)
+	} else if ws.GlobalHub != nil {
+		// Let the channel drop the user even if the state is already gone
 		ws.GlobalHub.BroadcastToChannel(channelID.String(), ws.EventVoiceLeave, map[string]interface{}{
 			"channel_id": channelID,
 			"user_id":    userID,
@@ -130,3 +235,107 @@ func LeaveVoiceChannel(c *fiber.Ctx) error {
 
 	return c.JSON(fiber.Map{"message": "Left voice channel"})
 }
+
+// voiceStateForModerator loads the voice state of the :userId member in the :serverId server
+// and checks the user is a moderator there. On failure it returns nil and the error response
+// to send.
+func voiceStateForModerator(c *fiber.Ctx, userID uuid.UUID) (*models.VoiceState, error) {
+	serverID, err := uuid.Parse(c.Params("serverId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid server ID",
+		})
+	}
+
+	targetID, err := uuid.Parse(c.Params("userId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if !hasPermission(userID, serverID, "moderator") {
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Insufficient permissions",
+		})
+	}
+
+	// Can't moderate the owner
+	var server models.Server
+	database.DB.First(&server, "id = ?", serverID)
+	if server.OwnerID == targetID {
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Cannot moderate the server owner",
+		})
+	}
+
+	var state models.VoiceState
+	if err := database.DB.First(&state, "user_id = ? AND server_id = ?", targetID, serverID).Error; err != nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User is not in a voice channel of this server",
+		})
+	}
+	return &state, nil
+}
+
+// ModerateVoiceMember server-mutes or server-deafens a member in voice, or moves them to
+// another voice channel of the server
+func ModerateVoiceMember(c *fiber.Ctx) error {
+	var mod ws.VoiceModeration
+	if err := c.BodyParser(&mod); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	userID := middleware.GetUserID(c)
+	state, errResp := voiceStateForModerator(c, userID)
+	if state == nil {
+		return errResp
+	}
+
+	if mod.ChannelID != nil {
+		var channel models.Channel
+		if err := database.DB.First(&channel, "id = ? AND server_id = ?", *mod.ChannelID, state.ServerID).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Channel not found",
+			})
+		}
+		if channel.Type != "voice" && channel.Type != "video" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "This is not a voice/video channel",
+			})
+		}
+	}
+
+	from := state.ChannelID
+	state, err := ws.ModerateVoiceState(state, mod, userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update voice state",
+		})
+	}
+
+	// A moved user reconnects to the SFU in their new channel
+	if state.ChannelID != from {
+		sfu.Default.Leave(state.UserID)
+	} else {
+		sfu.Default.SetServerVoice(state.UserID, state.ServerMuted, state.ServerDeafened)
+	}
+
+	return c.JSON(state)
+}
+
+// DisconnectVoiceMember takes a member out of voice
+func DisconnectVoiceMember(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	state, errResp := voiceStateForModerator(c, userID)
+	if state == nil {
+		return errResp
+	}
+
+	ws.DisconnectVoiceState(state, userID)
+	sfu.Default.Leave(state.UserID)
+
+	return c.JSON(fiber.Map{"message": "Member disconnected from voice"})
+}
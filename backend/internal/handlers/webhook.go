@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/crypto"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/middleware"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// maxPlaintextContent caps the length of plaintext messages from webhooks and applications
+const maxPlaintextContent = 4000
+
+// channelForAdmin parses the :serverId/:channelId params and checks the user can manage the channel.
+// On failure it returns a nil channel and the error response to send.
+func channelForAdmin(c *fiber.Ctx, userID uuid.UUID) (*models.Channel, error) {
+	serverID, err := uuid.Parse(c.Params("serverId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid server ID",
+		})
+	}
+
+	channelID, err := uuid.Parse(c.Params("channelId"))
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid channel ID",
+		})
+	}
+
+	if !hasPermission(userID, serverID, "admin") {
+		return nil, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Insufficient permissions",
+		})
+	}
+
+	var channel models.Channel
+	if err := database.DB.Where("id = ? AND server_id = ?", channelID, serverID).First(&channel).Error; err != nil {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+	}
+
+	return &channel, nil
+}
+
+// CreateWebhook creates a webhook for a channel. The token is only shown in this response.
+func CreateWebhook(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	channel, errResp := channelForAdmin(c, userID)
+	if channel == nil {
+		return errResp
+	}
+
+	type CreateRequest struct {
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+
+	var req CreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if len(req.Name) < 1 || len(req.Name) > 80 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Webhook name must be between 1 and 80 characters",
+		})
+	}
+
+	token, err := crypto.GenerateSecretToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate webhook token",
+		})
+	}
+
+	webhook := models.Webhook{
+		ChannelID: channel.ID,
+		ServerID:  channel.ServerID,
+		CreatorID: userID,
+		Name:      req.Name,
+		AvatarURL: req.AvatarURL,
+		TokenHash: crypto.HashToken(token),
+	}
+
+	if err := database.DB.Create(&webhook).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create webhook",
+		})
+	}
+
+	webhook.Token = token
+	return c.Status(fiber.StatusCreated).JSON(webhook)
+}
+
+// GetWebhooks lists a channel's webhooks, without their tokens
+func GetWebhooks(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	channel, errResp := channelForAdmin(c, userID)
+	if channel == nil {
+		return errResp
+	}
+
+	var webhooks []models.Webhook
+	database.DB.Where("channel_id = ?", channel.ID).Preload("Creator").Order("created_at ASC").Find(&webhooks)
+
+	return c.JSON(webhooks)
+}
+
+// RotateWebhookToken replaces a webhook's token, invalidating the old one
+func RotateWebhookToken(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	channel, errResp := channelForAdmin(c, userID)
+	if channel == nil {
+		return errResp
+	}
+
+	webhookID, err := uuid.Parse(c.Params("webhookId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid webhook ID",
+		})
+	}
+
+	var webhook models.Webhook
+	if err := database.DB.First(&webhook, "id = ? AND channel_id = ?", webhookID, channel.ID).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	token, err := crypto.GenerateSecretToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate webhook token",
+		})
+	}
+
+	database.DB.Model(&webhook).Update("token_hash", crypto.HashToken(token))
+
+	webhook.Token = token
+	return c.JSON(webhook)
+}
+
+// DeleteWebhook deletes a webhook. Messages it already posted are kept.
+func DeleteWebhook(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	channel, errResp := channelForAdmin(c, userID)
+	if channel == nil {
+		return errResp
+	}
+
+	webhookID, err := uuid.Parse(c.Params("webhookId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid webhook ID",
+		})
+	}
+
+	result := database.DB.Where("id = ? AND channel_id = ?", webhookID, channel.ID).Delete(&models.Webhook{})
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{"message": "Webhook deleted successfully"})
+}
+
+// ExecuteWebhook posts a plaintext message to the webhook's channel.
+// This route is public; the token in the URL is the only credential.
+func ExecuteWebhook(c *fiber.Ctx) error {
+	webhookID, err := uuid.Parse(c.Params("webhookId"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown webhook",
+		})
+	}
+
+	var webhook models.Webhook
+	if err := database.DB.First(&webhook, "id = ?", webhookID).Error; err != nil || !crypto.TokenMatches(c.Params("token"), webhook.TokenHash) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown webhook",
+		})
+	}
+
+	// Webhooks act with their creator's permissions, so they stop working once the creator
+	// leaves the server or is no longer an admin there
+	if !hasPermission(webhook.CreatorID, webhook.ServerID, "admin") {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "The webhook's creator can no longer manage this channel",
+		})
+	}
+
+	type ExecuteRequest struct {
+		Content   string                  `json:"content"`
+		Username  string                  `json:"username"`
+		AvatarURL string                  `json:"avatar_url"`
+		Mentions  *models.MentionMetadata `json:"mentions"`
+	}
+
+	var req ExecuteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if utf8.RuneCountInString(req.Content) > maxPlaintextContent {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Message content must be at most 4000 characters",
+		})
+	}
+
+	if req.Username == "" {
+		req.Username = webhook.Name
+	}
+	if len(req.Username) > 80 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Username must be at most 80 characters",
+		})
+	}
+	if req.AvatarURL == "" {
+		req.AvatarURL = webhook.AvatarURL
+	}
+
+	cv, ok := loadConversation(webhook.ChannelID)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Channel not found",
+		})
+	}
+
+	// Mentions are checked with the creator's permissions, e.g. for @everyone
+	payload := SendMessageRequest{
+		Content:  req.Content,
+		Type:     "text",
+		Mentions: req.Mentions,
+	}
+	mentionRecipients, errMsg := payload.validate(webhook.CreatorID, cv)
+	if errMsg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": errMsg,
+		})
+	}
+
+	msg := models.Message{
+		AuthorID:        webhook.CreatorID,
+		WebhookID:       &webhook.ID,
+		AuthorName:      req.Username,
+		AuthorAvatarURL: req.AvatarURL,
+		IsPlaintext:     true,
+	}
+	if err := publishMessage(&msg, cv, &payload, mentionRecipients, uuid.Nil); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send message",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(msg)
+}
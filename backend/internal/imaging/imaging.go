@@ -0,0 +1,202 @@
+// Package imaging prepares uploaded images before they are stored: it removes metadata
+// such as EXIF GPS coordinates, reads the dimensions and renders thumbnails.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	_ "image/gif"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/tiff"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels guards against images that are small on disk but huge once decoded
+const MaxPixels = 50_000_000
+
+// ThumbnailSizes are the longest sides thumbnails are rendered at. Sizes that aren't
+// smaller than the original are skipped.
+var ThumbnailSizes = []int{160, 320, 640}
+
+var (
+	// ErrUnsupported means the format can't be decoded here; the file is stored as is
+	ErrUnsupported = errors.New("image format is not supported")
+	// ErrTooLarge means the image has more than MaxPixels pixels
+	ErrTooLarge = errors.New("image dimensions are too large")
+)
+
+// Thumbnail is a scaled-down copy of an image
+type Thumbnail struct {
+	Size   int // Longest side it was rendered for
+	Width  int
+	Height int
+	Ext    string
+	MIME   string
+	Data   []byte
+}
+
+// Result is an image ready to be stored
+type Result struct {
+	Data       []byte // The file without metadata
+	Width      int
+	Height     int
+	Thumbnails []Thumbnail
+}
+
+// Process strips metadata from an image and renders its thumbnails. ext is the file's
+// extension, which has already been checked against its contents.
+func Process(ext string, data []byte) (*Result, error) {
+	ext = strings.ToLower(ext)
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	switch ext {
+	case ".jpg", ".png", ".gif", ".webp", ".bmp", ".tiff":
+	default:
+		return nil, ErrUnsupported
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	orientation := 1
+	switch ext {
+	case ".jpg":
+		data, orientation, err = stripJPEG(data)
+	case ".png":
+		data, err = stripPNG(data)
+	case ".webp":
+		data, err = stripWebP(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// Stripping EXIF loses the orientation tag, so the rotation is applied to the pixels instead
+	if orientation > 1 && orientation <= 8 {
+		img = orient(img, orientation)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+
+	// TIFF keeps its metadata in the same directory as the pixels, so it is rewritten
+	if ext == ".tiff" {
+		var buf bytes.Buffer
+		if err := tiff.Encode(&buf, img, &tiff.Options{Compression: tiff.Deflate}); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+
+	bounds := img.Bounds()
+	res := &Result{Data: data, Width: bounds.Dx(), Height: bounds.Dy()}
+
+	// Each size is scaled from the next larger one, which is much cheaper than scaling
+	// every size from the full image
+	src := img
+	for i := len(ThumbnailSizes) - 1; i >= 0; i-- {
+		size := ThumbnailSizes[i]
+		if size >= res.Width && size >= res.Height {
+			continue
+		}
+		thumb, err := thumbnail(src, res.Width, res.Height, size)
+		if err != nil {
+			return nil, err
+		}
+		res.Thumbnails = append([]Thumbnail{thumb.Thumbnail}, res.Thumbnails...)
+		src = thumb.img
+	}
+	return res, nil
+}
+
+type renderedThumbnail struct {
+	Thumbnail
+	img image.Image
+}
+
+func thumbnail(src image.Image, width, height, size int) (*renderedThumbnail, error) {
+	w, h := size, height*size/width
+	if height > width {
+		w, h = width*size/height, size
+	}
+	w, h = max(w, 1), max(h, 1)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	t := &renderedThumbnail{Thumbnail: Thumbnail{Size: size, Width: w, Height: h}, img: dst}
+	var buf bytes.Buffer
+	if dst.Opaque() {
+		t.Ext, t.MIME = ".jpg", "image/jpeg"
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 82}); err != nil {
+			return nil, err
+		}
+	} else {
+		t.Ext, t.MIME = ".png", "image/png"
+		if err := png.Encode(&buf, dst); err != nil {
+			return nil, err
+		}
+	}
+	t.Data = buf.Bytes()
+	return t, nil
+}
+
+// orient applies an EXIF orientation (2-8) to the pixels
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // mirrored, rotated 90° counter-clockwise
+				sx, sy = y, x
+			case 6: // rotated 90° counter-clockwise
+				sx, sy = y, h-1-x
+			case 7: // mirrored, rotated 90° clockwise
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated 90° clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,165 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errCorrupt = errors.New("image is corrupt")
+
+// stripJPEG drops EXIF, XMP, IPTC and comment segments without re-encoding and returns
+// the EXIF orientation so the caller can apply it. JFIF, ICC profile and Adobe segments
+// are kept because they affect how the pixels are decoded.
+func stripJPEG(data []byte) ([]byte, int, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, 0, errCorrupt
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	orientation := 1
+
+	for i := 2; ; {
+		if i+4 > len(data) || data[i] != 0xff {
+			return nil, 0, errCorrupt
+		}
+		marker := data[i+1]
+		// Padding before a marker
+		if marker == 0xff {
+			i++
+			continue
+		}
+		// Start of scan: the rest is entropy-coded image data
+		if marker == 0xda {
+			out.Write(data[i:])
+			return out.Bytes(), orientation, nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, 0, errCorrupt
+		}
+		segment := data[i:end]
+
+		switch {
+		case marker == 0xe1:
+			if o := exifOrientation(segment[4:]); o != 0 {
+				orientation = o
+			}
+		case marker == 0xe0, marker == 0xe2, marker == 0xee:
+			out.Write(segment)
+		case marker >= 0xe3 && marker <= 0xef, marker == 0xfe:
+			// Other application segments and comments
+		default:
+			out.Write(segment)
+		}
+		i = end
+	}
+}
+
+// exifOrientation reads the orientation tag from an APP1 EXIF payload, or returns 0
+func exifOrientation(app1 []byte) int {
+	if !bytes.HasPrefix(app1, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := app1[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// pngMetadataChunks are the ancillary chunks that carry text, EXIF or timestamps
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+// stripPNG drops metadata chunks without re-encoding
+func stripPNG(data []byte) ([]byte, error) {
+	const sig = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(sig)) {
+		return nil, errCorrupt
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(sig)
+
+	for i := len(sig); i < len(data); {
+		if i+8 > len(data) {
+			return nil, errCorrupt
+		}
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length // length, type, data, CRC
+		if length < 0 || end > len(data) {
+			return nil, errCorrupt
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// stripWebP drops the EXIF and XMP chunks and clears their flags in the VP8X header
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errCorrupt
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errCorrupt
+		}
+		fourcc := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2 // chunks are padded to an even length
+		if size < 0 || end > len(data) {
+			if end == len(data)+1 {
+				end = len(data) // tolerate a missing final pad byte
+			} else {
+				return nil, errCorrupt
+			}
+		}
+
+		switch fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[i:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x04 | 0x08 // XMP and EXIF present flags
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(result)-8))
+	return result, nil
+}
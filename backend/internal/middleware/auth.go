@@ -46,6 +46,21 @@ func AuthRequired() fiber.Handler {
 	}
 }
 
+// OptionalAuth sets the user from a valid bearer token if there is one, but lets
+// anonymous requests through. Handlers see uuid.Nil from GetUserID when nobody is signed in.
+func OptionalAuth() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		parts := strings.SplitN(c.Get("Authorization"), " ", 2)
+		if len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" {
+			if claims, err := validateToken(parts[1]); err == nil {
+				c.Locals("userID", claims.UserID)
+				c.Locals("username", claims.Username)
+			}
+		}
+		return c.Next()
+	}
+}
+
 // AuthWSUpgrade validates JWT for WebSocket upgrade requests
 func AuthWSUpgrade() fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// BodyLimit rejects request bodies larger than limit bytes. The app streams request bodies
+// so resumable uploads can pass chunks straight to storage, and fasthttp doesn't enforce its
+// own limit on streamed bodies; routes for which skip returns true read the stream themselves.
+func BodyLimit(limit int, skip func(c *fiber.Ctx) bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if skip != nil && skip(c) {
+			return c.Next()
+		}
+
+		tooLarge := func() error {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error": fmt.Sprintf("Request body too large. Maximum size is %dMB", limit>>20),
+			})
+		}
+		if c.Request().Header.ContentLength() > limit {
+			return tooLarge()
+		}
+
+		// Chunked bodies have no length up front, so read them here, a byte past the limit
+		if stream := c.Context().RequestBodyStream(); stream != nil && c.Request().Header.ContentLength() < 0 {
+			body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Failed to read request body",
+				})
+			}
+			if len(body) > limit {
+				return tooLarge()
+			}
+			c.Request().SetBodyRaw(body)
+		}
+		return c.Next()
+	}
+}
@@ -9,20 +9,22 @@ import (
 
 // User represents a Shitcord user account
 type User struct {
-	ID           uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
-	Username     string         `gorm:"uniqueIndex;size:32;not null" json:"username"`
-	Email        string         `gorm:"uniqueIndex;size:255;not null" json:"email"`
-	PasswordHash string         `gorm:"not null" json:"-"`
-	DisplayName  string         `gorm:"size:64" json:"display_name"`
-	AvatarURL    string         `gorm:"size:512" json:"avatar_url"`
-	Status       string         `gorm:"size:16;default:'offline'" json:"status"` // online, offline, idle, dnd
-	Bio          string         `gorm:"size:512" json:"bio"`
-	PublicKey    string         `gorm:"type:text" json:"public_key"` // E2E encryption public key
-	IsApproved   bool           `gorm:"default:false" json:"is_approved"`
-	IsAdmin      bool           `gorm:"default:false" json:"is_admin"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+	ID             uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
+	Username       string         `gorm:"uniqueIndex;size:32;not null" json:"username"`
+	Email          string         `gorm:"uniqueIndex;size:255;not null" json:"email"`
+	PasswordHash   string         `gorm:"not null" json:"-"`
+	DisplayName    string         `gorm:"size:64" json:"display_name"`
+	AvatarURL      string         `gorm:"size:512" json:"avatar_url"`
+	Status         string         `gorm:"size:16;default:'offline'" json:"status"` // online, offline, idle, dnd
+	Bio            string         `gorm:"size:512" json:"bio"`
+	PublicKey      string         `gorm:"type:text" json:"public_key"` // E2E encryption public key
+	IsApproved     bool           `gorm:"default:false" json:"is_approved"`
+	IsAdmin        bool           `gorm:"default:false" json:"is_admin"`
+	SendReceipts   bool           `gorm:"default:true" json:"send_receipts"` // Privacy: share delivered/read receipts in DMs
+	StorageQuotaMB int64          `gorm:"default:0" json:"-"`                // Upload storage quota override; 0 uses the instance default
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
 
 	// Relations
 	OwnedServers []Server       `gorm:"foreignKey:OwnerID" json:"-"`
@@ -59,16 +61,18 @@ func (k *UserPublicKey) BeforeCreate(tx *gorm.DB) error {
 
 // Server represents a server (like a Discord guild)
 type Server struct {
-	ID          uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
-	Name        string         `gorm:"size:100;not null" json:"name"`
-	Description string         `gorm:"size:1024" json:"description"`
-	IconURL     string         `gorm:"size:512" json:"icon_url"`
-	OwnerID     uuid.UUID      `gorm:"type:uuid;not null" json:"owner_id"`
-	InviteCode  string         `gorm:"uniqueIndex;size:16" json:"invite_code"`
-	IsPrivate   bool           `gorm:"default:false" json:"is_private"`
-	CreatedAt   time.Time      `json:"created_at"`
-	UpdatedAt   time.Time      `json:"updated_at"`
-	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+	ID             uuid.UUID        `gorm:"type:uuid;primaryKey" json:"id"`
+	Name           string           `gorm:"size:100;not null" json:"name"`
+	Description    string           `gorm:"size:1024" json:"description"`
+	IconURL        string           `gorm:"size:512" json:"icon_url"`
+	OwnerID        uuid.UUID        `gorm:"type:uuid;not null" json:"owner_id"`
+	InviteCode     string           `gorm:"uniqueIndex;size:16" json:"invite_code"`
+	IsPrivate      bool             `gorm:"default:false" json:"is_private"`
+	UploadLimits   map[string]int64 `gorm:"type:text;serializer:json" json:"upload_limits,omitempty"` // Upload size limits in MB by member role
+	StorageQuotaMB int64            `gorm:"default:0" json:"-"`                                       // Upload storage quota override; 0 uses the instance default
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt   `gorm:"index" json:"-"`
 
 	// Relations
 	Owner    User           `gorm:"foreignKey:OwnerID" json:"owner,omitempty"`
@@ -92,6 +96,10 @@ type ServerMember struct {
 	Nickname string    `gorm:"size:64" json:"nickname"`
 	JoinedAt time.Time `json:"joined_at"`
 
+	// Set by moderators and applied whenever the member joins voice in the server
+	ServerMuted    bool `gorm:"default:false" json:"server_muted"`
+	ServerDeafened bool `gorm:"default:false" json:"server_deafened"`
+
 	Server Server `gorm:"foreignKey:ServerID" json:"-"`
 	User   User   `gorm:"foreignKey:UserID" json:"user,omitempty"`
 }
@@ -108,16 +116,17 @@ func (m *ServerMember) BeforeCreate(tx *gorm.DB) error {
 
 // Channel represents a channel within a server
 type Channel struct {
-	ID        uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
-	ServerID  uuid.UUID      `gorm:"type:uuid;not null;index" json:"server_id"`
-	Name      string         `gorm:"size:100;not null" json:"name"`
-	Topic     string         `gorm:"size:1024" json:"topic"`
-	Type      string         `gorm:"size:16;default:'text'" json:"type"` // text, voice, video
-	Position  int            `gorm:"default:0" json:"position"`
-	IsPrivate bool           `gorm:"default:false" json:"is_private"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID         uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
+	ServerID   uuid.UUID      `gorm:"type:uuid;not null;index" json:"server_id"`
+	Name       string         `gorm:"size:100;not null" json:"name"`
+	Topic      string         `gorm:"size:1024" json:"topic"`
+	Type       string         `gorm:"size:16;default:'text'" json:"type"` // text, voice, video
+	Position   int            `gorm:"default:0" json:"position"`
+	IsPrivate  bool           `gorm:"default:false" json:"is_private"`
+	MessageTTL int            `gorm:"default:0" json:"message_ttl"` // Disappearing messages timer in seconds, 0 = off
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
 
 	Server   Server    `gorm:"foreignKey:ServerID" json:"-"`
 	Messages []Message `gorm:"foreignKey:ChannelID" json:"-"`
@@ -130,16 +139,23 @@ func (c *Channel) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
-// DMChannel represents a direct message channel between two users
+// DMChannel represents a direct message channel, either between two users or a group DM.
+// Membership always lives in Participants; User1/User2 are only set on 1:1 DMs to keep them unique.
 type DMChannel struct {
-	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	User1ID   uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_dm_users" json:"user1_id"`
-	User2ID   uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_dm_users" json:"user2_id"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	User1ID    *uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_dm_users" json:"user1_id,omitempty"`
+	User2ID    *uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_dm_users" json:"user2_id,omitempty"`
+	IsGroup    bool       `gorm:"default:false" json:"is_group"`
+	OwnerID    *uuid.UUID `gorm:"type:uuid" json:"owner_id,omitempty"` // Group DMs only
+	Name       string     `gorm:"size:100" json:"name"`
+	IconURL    string     `gorm:"size:512" json:"icon_url"`
+	MessageTTL int        `gorm:"default:0" json:"message_ttl"` // Disappearing messages timer in seconds, 0 = off
+	CreatedAt  time.Time  `json:"created_at"`
 
-	User1    User      `gorm:"foreignKey:User1ID" json:"user1,omitempty"`
-	User2    User      `gorm:"foreignKey:User2ID" json:"user2,omitempty"`
-	Messages []Message `gorm:"foreignKey:ChannelID" json:"-"`
+	User1        *User           `gorm:"foreignKey:User1ID" json:"user1,omitempty"`
+	User2        *User           `gorm:"foreignKey:User2ID" json:"user2,omitempty"`
+	Participants []DMParticipant `gorm:"foreignKey:DMChannelID" json:"participants,omitempty"`
+	Messages     []Message       `gorm:"foreignKey:ChannelID" json:"-"`
 }
 
 func (d *DMChannel) BeforeCreate(tx *gorm.DB) error {
@@ -149,25 +165,59 @@ func (d *DMChannel) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// DMParticipant is a user's membership in a DM channel
+type DMParticipant struct {
+	ID          uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	DMChannelID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_dm_participant" json:"dm_channel_id"`
+	UserID      uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_dm_participant;index" json:"user_id"`
+	JoinedAt    time.Time `json:"joined_at"`
+
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (p *DMParticipant) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	if p.JoinedAt.IsZero() {
+		p.JoinedAt = time.Now()
+	}
+	return nil
+}
+
 // Message represents a chat message (content is E2E encrypted)
 type Message struct {
-	ID               uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
-	ChannelID        uuid.UUID      `gorm:"type:uuid;not null;index" json:"channel_id"`
-	AuthorID         uuid.UUID      `gorm:"type:uuid;not null" json:"author_id"`
-	Content          string         `gorm:"type:text;not null" json:"content"`                    // Encrypted content
-	Nonce            string         `gorm:"type:text" json:"nonce"`                               // Encryption nonce
-	EncryptionHeader string         `gorm:"type:text" json:"encryption_header"`                   // Key exchange header
-	Type             string         `gorm:"size:16;default:'text'" json:"type"`                   // text, image, file, system
-	AttachmentURL    string         `gorm:"size:512" json:"attachment_url,omitempty"`
-	ReplyToID        *uuid.UUID     `gorm:"type:uuid" json:"reply_to_id,omitempty"`
-	IsEdited         bool           `gorm:"default:false" json:"is_edited"`
-	IsPinned         bool           `gorm:"default:false" json:"is_pinned"`
-	CreatedAt        time.Time      `json:"created_at"`
-	UpdatedAt        time.Time      `json:"updated_at"`
-	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`
-
-	Author  User     `gorm:"foreignKey:AuthorID" json:"author,omitempty"`
-	ReplyTo *Message `gorm:"foreignKey:ReplyToID" json:"reply_to,omitempty"`
+	ID               uuid.UUID        `gorm:"type:uuid;primaryKey" json:"id"`
+	ChannelID        uuid.UUID        `gorm:"type:uuid;not null;index" json:"channel_id"`
+	AuthorID         uuid.UUID        `gorm:"type:uuid;not null" json:"author_id"`
+	Content          string           `gorm:"type:text;not null" json:"content"`  // Encrypted content
+	Nonce            string           `gorm:"type:text" json:"nonce"`             // Encryption nonce
+	EncryptionHeader string           `gorm:"type:text" json:"encryption_header"` // Key exchange header
+	Type             string           `gorm:"size:16;default:'text'" json:"type"` // text, image, file, poll, system
+	AttachmentURL    string           `gorm:"size:512" json:"attachment_url,omitempty"`
+	AttachmentSigned string           `gorm:"-" json:"attachment_signed_url,omitempty"` // Short-lived URL for AttachmentURL
+	Attachment       *Attachment      `gorm:"-" json:"attachment,omitempty"`            // Dimensions and thumbnails of an uploaded AttachmentURL
+	ReplyToID        *uuid.UUID       `gorm:"type:uuid" json:"reply_to_id,omitempty"`
+	Mentions         *MentionMetadata `gorm:"type:text;serializer:json" json:"mentions,omitempty"` // Plaintext mention metadata
+	RequestReceipts  bool             `gorm:"default:false" json:"request_receipts"`               // DM delivered/read receipts opt-in
+	IsEdited         bool             `gorm:"default:false" json:"is_edited"`
+	IsPinned         bool             `gorm:"default:false" json:"is_pinned"`
+	ExpiresAt        *time.Time       `gorm:"index" json:"expires_at,omitempty"`           // Set when the channel has disappearing messages on
+	WebhookID        *uuid.UUID       `gorm:"type:uuid;index" json:"webhook_id,omitempty"` // Posted by a webhook rather than a user
+	AuthorName       string           `gorm:"size:80" json:"author_name,omitempty"`        // Webhook username override
+	AuthorAvatarURL  string           `gorm:"size:512" json:"author_avatar_url,omitempty"` // Webhook avatar override
+	IsPlaintext      bool             `gorm:"default:false" json:"is_plaintext"`           // Content is not E2E encrypted
+	InteractionID    *uuid.UUID       `gorm:"type:uuid" json:"interaction_id,omitempty"`   // Reply to a slash command
+	IsEphemeral      bool             `gorm:"default:false" json:"is_ephemeral"`           // Only shown to VisibleToID
+	VisibleToID      *uuid.UUID       `gorm:"type:uuid;index" json:"visible_to_id,omitempty"`
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+	DeletedAt        gorm.DeletedAt   `gorm:"index" json:"-"`
+
+	Author   User             `gorm:"foreignKey:AuthorID" json:"author,omitempty"`
+	ReplyTo  *Message         `gorm:"foreignKey:ReplyToID" json:"reply_to,omitempty"`
+	Poll     *Poll            `gorm:"foreignKey:MessageID" json:"poll,omitempty"`
+	Receipts []MessageReceipt `gorm:"-" json:"receipts,omitempty"`
 }
 
 func (m *Message) BeforeCreate(tx *gorm.DB) error {
@@ -177,16 +227,391 @@ func (m *Message) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// MessageReceipt is the delivery status of a DM message for one recipient.
+// Receipts aren't stored per message; they're derived from each recipient's ReadState.
+type MessageReceipt struct {
+	UserID uuid.UUID `json:"user_id"`
+	Status string    `json:"status"` // delivered, read
+}
+
+// MentionMetadata is the plaintext list of mentions a client attaches to a message.
+// The server can't parse mentions out of E2E encrypted content, so clients send them alongside it.
+type MentionMetadata struct {
+	Users    []uuid.UUID `json:"users,omitempty"`
+	Roles    []string    `json:"roles,omitempty"` // owner, admin, moderator, member
+	Everyone bool        `json:"everyone,omitempty"`
+	Here     bool        `json:"here,omitempty"`
+}
+
+// PollSpec is the plaintext poll definition a client sends with a poll message.
+// Polls aren't encrypted so the server can tally votes.
+type PollSpec struct {
+	Question         string   `json:"question"`
+	Answers          []string `json:"answers"`
+	AllowMultiselect bool     `json:"allow_multiselect"`
+	Duration         int      `json:"duration"` // Seconds until voting closes
+}
+
+// Poll is the voting state attached to a poll message
+type Poll struct {
+	ID               uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	MessageID        uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"message_id"`
+	ChannelID        uuid.UUID `gorm:"type:uuid;not null;index" json:"channel_id"`
+	Question         string    `gorm:"size:300;not null" json:"question"`
+	AllowMultiselect bool      `gorm:"default:false" json:"allow_multiselect"`
+	ExpiresAt        time.Time `gorm:"not null;index" json:"expires_at"`
+	IsFinalized      bool      `gorm:"default:false;index" json:"is_finalized"` // Results have been posted
+	CreatedAt        time.Time `json:"created_at"`
+
+	Answers []PollAnswer `gorm:"foreignKey:PollID" json:"answers"`
+}
+
+func (p *Poll) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
+
+// PollAnswer is one option in a poll, with its running tally
+type PollAnswer struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	PollID    uuid.UUID `gorm:"type:uuid;not null;index" json:"poll_id"`
+	Position  int       `gorm:"not null" json:"position"`
+	Text      string    `gorm:"size:100;not null" json:"text"`
+	VoteCount int       `gorm:"default:0" json:"vote_count"`
+	MeVoted   bool      `gorm:"-" json:"me_voted"`
+}
+
+func (a *PollAnswer) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return nil
+}
+
+// PollVote is a user's vote for one poll answer
+type PollVote struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	PollID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_poll_vote" json:"poll_id"`
+	AnswerID  uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_poll_vote" json:"answer_id"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_poll_vote;index" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (v *PollVote) BeforeCreate(tx *gorm.DB) error {
+	if v.ID == uuid.Nil {
+		v.ID = uuid.New()
+	}
+	return nil
+}
+
+// Mention is a notification inbox entry for a user mentioned in a message
+type Mention struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	MessageID uuid.UUID  `gorm:"type:uuid;not null;index" json:"message_id"`
+	ChannelID uuid.UUID  `gorm:"type:uuid;not null" json:"channel_id"`
+	ServerID  *uuid.UUID `gorm:"type:uuid" json:"server_id,omitempty"`
+	AuthorID  uuid.UUID  `gorm:"type:uuid;not null" json:"author_id"`
+	Type      string     `gorm:"size:16;not null" json:"type"` // user, role, everyone, here
+	IsRead    bool       `gorm:"default:false" json:"is_read"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	Message Message `gorm:"foreignKey:MessageID" json:"message,omitempty"`
+}
+
+func (m *Mention) BeforeCreate(tx *gorm.DB) error {
+	if m.ID == uuid.Nil {
+		m.ID = uuid.New()
+	}
+	return nil
+}
+
+// ReadState tracks how far a user has read in a channel or DM
+type ReadState struct {
+	ID            uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID        uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_read_state_user_channel" json:"user_id"`
+	ChannelID     uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_read_state_user_channel" json:"channel_id"`
+	LastMessageID *uuid.UUID `gorm:"type:uuid" json:"last_message_id,omitempty"`
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"` // CreatedAt of the last read message
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`    // CreatedAt of the last message delivered to a session
+	MentionCount  int        `gorm:"default:0" json:"mention_count"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func (r *ReadState) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+// Attachment is an uploaded file. Message attachments are only served to people who can
+// see the channel they were posted in; avatars and icons are public.
+type Attachment struct {
+	ID          uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UploaderID  uuid.UUID  `gorm:"type:uuid;not null;index" json:"uploader_id"`
+	ChannelID   *uuid.UUID `gorm:"type:uuid;index" json:"channel_id,omitempty"` // Set once posted in a message
+	MessageID   *uuid.UUID `gorm:"type:uuid;index" json:"message_id,omitempty"`
+	ServerID    *uuid.UUID `gorm:"type:uuid;index" json:"server_id,omitempty"`           // Server whose storage it counts against, once posted there
+	Purpose     string     `gorm:"size:16;not null;default:'attachment'" json:"purpose"` // attachment, avatar, icon, thumbnail
+	URL         string     `gorm:"size:512;not null;uniqueIndex" json:"url"`             // /uploads/... path
+	Filename    string     `gorm:"size:255" json:"filename"`                             // Original file name
+	ContentType string     `gorm:"size:128" json:"content_type"`
+	Size        int64      `json:"size"`
+	Type        string     `gorm:"size:16" json:"type"`                        // image, video, audio, file
+	Width       int        `json:"width,omitempty"`                            // Images only
+	Height      int        `json:"height,omitempty"`                           // Images only
+	ParentID    *uuid.UUID `gorm:"type:uuid;index" json:"parent_id,omitempty"` // Set on thumbnails; access follows the parent
+	BlobHash    string     `gorm:"size:64;index" json:"-"`                     // Stored contents; empty for files uploaded before deduplication
+	CreatedAt   time.Time  `json:"created_at"`
+
+	Thumbnails []Attachment `gorm:"foreignKey:ParentID" json:"thumbnails,omitempty"`
+	SignedURL  string       `gorm:"-" json:"signed_url,omitempty"` // Short-lived URL for non-public uploads
+}
+
+func (a *Attachment) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return nil
+}
+
+// Blob is a stored file, shared by every attachment with the same contents.
+// It is deleted when the last attachment referencing it is.
+type Blob struct {
+	Hash        string    `gorm:"size:64;primaryKey" json:"hash"` // Hex SHA-256 of the contents
+	Key         string    `gorm:"size:512;not null" json:"key"`   // Storage key
+	Size        int64     `json:"size"`
+	ContentType string    `gorm:"size:128" json:"content_type"`
+	RefCount    int       `gorm:"not null;default:0" json:"ref_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"` // Last time a reference was added
+}
+
+// UploadSession is a resumable (tus) upload in progress. Each chunk is staged as its own
+// storage object until Offset reaches Length, then the file is stored like a single-shot upload.
+type UploadSession struct {
+	ID           uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UploaderID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"uploader_id"`
+	ChannelID    *uuid.UUID `gorm:"type:uuid" json:"channel_id,omitempty"` // Channel whose upload limit applies
+	Filename     string     `gorm:"size:255;not null" json:"filename"`
+	Purpose      string     `gorm:"size:16;not null;default:'attachment'" json:"purpose"`
+	Length       int64      `gorm:"not null" json:"length"`
+	Offset       int64      `gorm:"not null;default:0" json:"offset"`
+	AttachmentID *uuid.UUID `gorm:"type:uuid" json:"attachment_id,omitempty"` // Set once the upload is complete
+	Chunks       []string   `gorm:"type:text;serializer:json" json:"-"`       // Storage keys of the chunks so far, in order
+	LockedUntil  *time.Time `json:"-"`                                        // Lease held by the request writing a chunk
+	ExpiresAt    time.Time  `gorm:"not null;index" json:"expires_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+func (u *UploadSession) BeforeCreate(tx *gorm.DB) error {
+	if u.ID == uuid.Nil {
+		u.ID = uuid.New()
+	}
+	return nil
+}
+
+// UploadScan is the malware scanner's verdict on an upload. Infected files are moved to
+// quarantine instead of being stored, and kept there until an admin deletes them.
+type UploadScan struct {
+	ID            uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UploaderID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"uploader_id"`
+	AttachmentID  *uuid.UUID `gorm:"type:uuid;index" json:"attachment_id,omitempty"` // Set once a clean upload is stored
+	Filename      string     `gorm:"size:255" json:"filename"`
+	Size          int64      `json:"size"`
+	Status        string     `gorm:"size:16;not null;index" json:"status"` // clean, infected, failed
+	Signature     string     `gorm:"size:255" json:"signature,omitempty"`  // What the scanner found
+	Error         string     `gorm:"size:512" json:"error,omitempty"`      // Why the scan failed
+	QuarantineKey string     `gorm:"size:512" json:"quarantine_key,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+
+	Uploader User `gorm:"foreignKey:UploaderID" json:"uploader,omitempty"`
+}
+
+func (s *UploadScan) BeforeCreate(tx *gorm.DB) error {
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+	return nil
+}
+
+// Webhook lets an external service post plaintext messages into a channel with a secret token
+type Webhook struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	ChannelID uuid.UUID `gorm:"type:uuid;not null;index" json:"channel_id"`
+	ServerID  uuid.UUID `gorm:"type:uuid;not null;index" json:"server_id"`
+	CreatorID uuid.UUID `gorm:"type:uuid;not null" json:"creator_id"`
+	Name      string    `gorm:"size:80;not null" json:"name"`
+	AvatarURL string    `gorm:"size:512" json:"avatar_url"`
+	TokenHash string    `gorm:"size:64;not null" json:"-"`
+	Token     string    `gorm:"-" json:"token,omitempty"` // Only returned on create and rotate
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Creator User `gorm:"foreignKey:CreatorID" json:"creator,omitempty"`
+}
+
+func (w *Webhook) BeforeCreate(tx *gorm.DB) error {
+	if w.ID == uuid.Nil {
+		w.ID = uuid.New()
+	}
+	return nil
+}
+
+// CommandOption describes one argument of an application command
+type CommandOption struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Type        string   `json:"type"` // string, integer, number, boolean, user, channel
+	Required    bool     `json:"required"`
+	Choices     []string `json:"choices,omitempty"` // Allowed values for string options
+}
+
+// ApplicationCommand is a slash command registered on a server. Invocations are
+// dispatched to the owning account over the hub, or POSTed to CallbackURL if set.
+type ApplicationCommand struct {
+	ID          uuid.UUID       `gorm:"type:uuid;primaryKey" json:"id"`
+	ServerID    uuid.UUID       `gorm:"type:uuid;not null;uniqueIndex:idx_command_server_name" json:"server_id"`
+	OwnerID     uuid.UUID       `gorm:"type:uuid;not null;index" json:"owner_id"` // Account that handles the command
+	Name        string          `gorm:"size:32;not null;uniqueIndex:idx_command_server_name" json:"name"`
+	Description string          `gorm:"size:100" json:"description"`
+	Options     []CommandOption `gorm:"type:text;serializer:json" json:"options"`
+	CallbackURL string          `gorm:"size:1024" json:"callback_url,omitempty"`
+	Secret      string          `gorm:"size:64;not null" json:"secret,omitempty"` // Signs callback requests, only returned on create
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+
+	Owner User `gorm:"foreignKey:OwnerID" json:"owner,omitempty"`
+}
+
+func (a *ApplicationCommand) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = uuid.New()
+	}
+	return nil
+}
+
+// Interaction is one invocation of an application command. The owner answers it
+// with the interaction token until it expires.
+type Interaction struct {
+	ID        uuid.UUID              `gorm:"type:uuid;primaryKey" json:"id"`
+	CommandID uuid.UUID              `gorm:"type:uuid;not null;index" json:"command_id"`
+	ServerID  uuid.UUID              `gorm:"type:uuid;not null" json:"server_id"`
+	ChannelID uuid.UUID              `gorm:"type:uuid;not null" json:"channel_id"`
+	UserID    uuid.UUID              `gorm:"type:uuid;not null" json:"user_id"`  // Invoker
+	OwnerID   uuid.UUID              `gorm:"type:uuid;not null" json:"owner_id"` // Account answering it
+	Name      string                 `gorm:"size:32;not null" json:"name"`
+	Options   map[string]interface{} `gorm:"type:text;serializer:json" json:"options"`
+	Status    string                 `gorm:"size:16;default:'pending'" json:"status"` // pending, deferred, responded
+	TokenHash string                 `gorm:"size:64;not null" json:"-"`
+	Token     string                 `gorm:"-" json:"token,omitempty"` // Only sent to the owner
+	ExpiresAt time.Time              `json:"expires_at"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+func (i *Interaction) BeforeCreate(tx *gorm.DB) error {
+	if i.ID == uuid.Nil {
+		i.ID = uuid.New()
+	}
+	return nil
+}
+
+// EventSubscription delivers a server's events to an external HTTPS endpoint
+type EventSubscription struct {
+	ID           uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	ServerID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"server_id"`
+	CreatorID    uuid.UUID  `gorm:"type:uuid;not null" json:"creator_id"`
+	URL          string     `gorm:"size:1024;not null" json:"url"`
+	Events       []string   `gorm:"type:text;serializer:json" json:"events"`
+	Secret       string     `gorm:"size:64;not null" json:"secret,omitempty"` // HMAC key, only returned on create and rotate
+	IsActive     bool       `gorm:"default:true" json:"is_active"`
+	FailureCount int        `gorm:"default:0" json:"failure_count"` // Consecutive failed attempts
+	DisabledAt   *time.Time `json:"disabled_at,omitempty"`          // Set when disabled after repeated failures
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+func (e *EventSubscription) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
+
+// EventDelivery is one queued or attempted delivery of an event to a subscription.
+// The rows double as the delivery log.
+type EventDelivery struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	SubscriptionID uuid.UUID  `gorm:"type:uuid;not null;index" json:"subscription_id"`
+	Event          string     `gorm:"size:64;not null" json:"event"`
+	Payload        string     `gorm:"type:text;not null" json:"payload"`
+	Status         string     `gorm:"size:16;default:'pending';index" json:"status"` // pending, succeeded, failed
+	Attempts       int        `gorm:"default:0" json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"index" json:"next_attempt_at"`
+	ClaimedUntil   *time.Time `json:"-"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `gorm:"size:512" json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+func (d *EventDelivery) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return nil
+}
+
+// ScheduledMessage is an encrypted message payload waiting to be posted at SendAt.
+// Once posted, the message reuses the scheduled message's ID so it can never be sent twice.
+type ScheduledMessage struct {
+	ID               uuid.UUID        `gorm:"type:uuid;primaryKey" json:"id"`
+	ChannelID        uuid.UUID        `gorm:"type:uuid;not null;index" json:"channel_id"`
+	AuthorID         uuid.UUID        `gorm:"type:uuid;not null;index" json:"author_id"`
+	Content          string           `gorm:"type:text;not null" json:"content"`  // Encrypted content
+	Nonce            string           `gorm:"type:text" json:"nonce"`             // Encryption nonce
+	EncryptionHeader string           `gorm:"type:text" json:"encryption_header"` // Key exchange header
+	Type             string           `gorm:"size:16;default:'text'" json:"type"`
+	AttachmentURL    string           `gorm:"size:512" json:"attachment_url,omitempty"`
+	ReplyToID        *uuid.UUID       `gorm:"type:uuid" json:"reply_to_id,omitempty"`
+	Mentions         *MentionMetadata `gorm:"type:text;serializer:json" json:"mentions,omitempty"`
+	RequestReceipts  bool             `gorm:"default:false" json:"request_receipts"`
+	Poll             *PollSpec        `gorm:"type:text;serializer:json" json:"poll,omitempty"`
+	SendAt           time.Time        `gorm:"not null;index" json:"send_at"`
+	Status           string           `gorm:"size:16;default:'pending';index" json:"status"` // pending, sent, failed
+	Error            string           `gorm:"size:255" json:"error,omitempty"`
+	ClaimedUntil     *time.Time       `json:"-"` // Lease held by the instance currently sending it
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+}
+
+func (s *ScheduledMessage) BeforeCreate(tx *gorm.DB) error {
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+	return nil
+}
+
 // VoiceState tracks users in voice/video channels
 type VoiceState struct {
-	ID          uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	UserID      uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"user_id"`
-	ChannelID   uuid.UUID `gorm:"type:uuid;not null" json:"channel_id"`
-	ServerID    uuid.UUID `gorm:"type:uuid;not null" json:"server_id"`
-	IsMuted     bool      `gorm:"default:false" json:"is_muted"`
-	IsDeafened  bool      `gorm:"default:false" json:"is_deafened"`
-	IsStreaming bool      `gorm:"default:false" json:"is_streaming"`
-	JoinedAt    time.Time `json:"joined_at"`
+	ID          uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID      uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex" json:"user_id"`
+	ChannelID   uuid.UUID  `gorm:"type:uuid;not null" json:"channel_id"`
+	ServerID    uuid.UUID  `gorm:"type:uuid;not null" json:"server_id"`
+	IsMuted     bool       `gorm:"default:false" json:"is_muted"`
+	IsDeafened  bool       `gorm:"default:false" json:"is_deafened"`
+	IsStreaming bool       `gorm:"default:false" json:"is_streaming"`
+	IsVideo     bool       `gorm:"default:false" json:"is_video"`
+	SessionID   *uuid.UUID `gorm:"type:uuid" json:"-"` // Gateway session the user is in voice from, if known
+	JoinedAt    time.Time  `json:"joined_at"`
+
+	// Set by moderators, separately from the user's own flags
+	ServerMuted    bool `gorm:"default:false" json:"server_muted"`
+	ServerDeafened bool `gorm:"default:false" json:"server_deafened"`
 
 	User    User    `gorm:"foreignKey:UserID" json:"user,omitempty"`
 	Channel Channel `gorm:"foreignKey:ChannelID" json:"-"`
@@ -0,0 +1,122 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is how much of a file goes into each INSTREAM chunk
+const clamdChunkSize = 64 << 10
+
+// Clamd scans files with a ClamAV daemon, streaming them over its TCP INSTREAM command.
+// clamd rejects streams longer than its StreamMaxLength (25MB by default), so raise that
+// to the largest upload allowed.
+type Clamd struct {
+	Address string        // host:port clamd listens on
+	Timeout time.Duration // Limit for a whole scan
+}
+
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	d := net.Dialer{Deadline: deadline}
+	conn, err := d.DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to clamd: %w", err)
+	}
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// reply reads clamd's null-terminated response
+func reply(conn net.Conn) (string, error) {
+	line, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading clamd reply: %w", err)
+	}
+	return strings.TrimSpace(strings.TrimSuffix(line, "\x00")), nil
+}
+
+// Ping checks that clamd is reachable
+func (c *Clamd) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	resp, err := reply(conn)
+	if err != nil {
+		return err
+	}
+	if resp != "PONG" {
+		return fmt.Errorf("unexpected clamd reply %q", resp)
+	}
+	return nil
+}
+
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	// Each chunk is prefixed with its length; a zero length ends the stream. clamd hangs
+	// up early when the stream is too long, in which case its reply says why.
+	buf := make([]byte, 4+clamdChunkSize)
+	var writeErr error
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, writeErr = conn.Write(buf[:4+n]); writeErr != nil {
+				break
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if writeErr == nil {
+		_, writeErr = conn.Write([]byte{0, 0, 0, 0})
+	}
+
+	resp, err := reply(conn)
+	if err != nil {
+		if writeErr != nil {
+			return nil, fmt.Errorf("streaming to clamd: %w", writeErr)
+		}
+		return nil, err
+	}
+
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or "<reason> ERROR"
+	resp = strings.TrimPrefix(resp, "stream: ")
+	switch {
+	case resp == "OK":
+		return &Result{}, nil
+	case strings.HasSuffix(resp, " FOUND"):
+		return &Result{Infected: true, Signature: strings.TrimSuffix(resp, " FOUND")}, nil
+	default:
+		return nil, fmt.Errorf("clamd: %s", resp)
+	}
+}
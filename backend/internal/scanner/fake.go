@@ -0,0 +1,36 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// eicar is the standard antivirus test file, which every scanner reports as infected
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// Fake flags files containing the EICAR test string or any of Patterns, for tests and for
+// trying out scanning without running clamd
+type Fake struct {
+	Patterns map[string]string // Content to look for, mapped to the signature to report
+	Err      error             // Returned instead of a verdict, to simulate an unavailable scanner
+}
+
+func (f *Fake) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if bytes.Contains(data, []byte(eicar)) {
+		return &Result{Infected: true, Signature: "Eicar-Signature"}, nil
+	}
+	for pattern, signature := range f.Patterns {
+		if bytes.Contains(data, []byte(pattern)) {
+			return &Result{Infected: true, Signature: signature}, nil
+		}
+	}
+	return &Result{}, nil
+}
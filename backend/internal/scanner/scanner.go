@@ -0,0 +1,73 @@
+// Package scanner checks uploads for malware before they are stored.
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Result is a scanner's verdict on a file
+type Result struct {
+	Infected  bool
+	Signature string // What was found, if infected
+}
+
+// Scanner checks a file's contents for malware
+type Scanner interface {
+	// Scan reads r to the end and reports whether it is infected. An error means the
+	// file could not be checked, not that it is unsafe.
+	Scan(ctx context.Context, r io.Reader) (*Result, error)
+}
+
+// Noop passes every file without looking at it
+type Noop struct{}
+
+func (Noop) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	return &Result{}, nil
+}
+
+// Default is the scanner uploads go through, set up by Init
+var Default Scanner = Noop{}
+
+// Enabled reports whether uploads are actually scanned
+func Enabled() bool {
+	_, noop := Default.(Noop)
+	return !noop
+}
+
+// Init configures Default from the environment. UPLOAD_SCANNER selects "none" (the default),
+// "clamd" or "fake".
+func Init() error {
+	switch driver := getEnv("UPLOAD_SCANNER", "none"); driver {
+	case "none":
+		Default = Noop{}
+	case "clamd":
+		timeout := 2 * time.Minute
+		if n, err := strconv.Atoi(os.Getenv("CLAMD_TIMEOUT_SECONDS")); err == nil && n > 0 {
+			timeout = time.Duration(n) * time.Second
+		}
+		clamd := &Clamd{Address: getEnv("CLAMD_ADDRESS", "localhost:3310"), Timeout: timeout}
+		// clamd may come up after us; uploads fail until it does
+		if err := clamd.Ping(context.Background()); err != nil {
+			log.Printf("Warning: clamd at %s is not reachable: %v", clamd.Address, err)
+		}
+		Default = clamd
+	case "fake":
+		Default = &Fake{}
+	default:
+		return fmt.Errorf("unknown UPLOAD_SCANNER %q", driver)
+	}
+	return nil
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,317 @@
+package sfu
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// layerTimeout is how long a simulcast layer can go without packets before subscribers are
+// moved to another; browsers stop sending their top layers when bandwidth drops
+const layerTimeout = 2 * time.Second
+
+// layerRanks orders the simulcast layers clients send, by their RIDs
+var layerRanks = map[string]int{"l": 0, "m": 1, "h": 2}
+
+func isLayer(rid string) bool {
+	_, ok := layerRanks[rid]
+	return ok
+}
+
+// layer is one simulcast encoding of a track, or the only one of a track without simulcast
+type layer struct {
+	rid   string
+	track *webrtc.TrackRemote
+	last  atomic.Int64 // When the last packet arrived, in Unix nanoseconds
+}
+
+// source is a track a peer publishes, forwarded to everyone else in its room
+type source struct {
+	id        string
+	publisher *peer
+	kind      webrtc.RTPCodecType
+	codec     webrtc.RTPCodecParameters
+	done      chan struct{}
+
+	mu          sync.RWMutex
+	layers      map[string]*layer
+	subscribers map[*downTrack]bool
+}
+
+func newSource(p *peer, id string, track *webrtc.TrackRemote) *source {
+	return &source{
+		id:          id,
+		publisher:   p,
+		kind:        track.Kind(),
+		codec:       track.Codec(),
+		done:        make(chan struct{}),
+		layers:      make(map[string]*layer),
+		subscribers: make(map[*downTrack]bool),
+	}
+}
+
+func (src *source) addLayer(track *webrtc.TrackRemote) *layer {
+	l := &layer{rid: track.RID(), track: track}
+	src.mu.Lock()
+	src.layers[l.rid] = l
+	src.mu.Unlock()
+	src.selectLayers()
+	return l
+}
+
+// removeLayer drops an ended layer and returns how many are left
+func (src *source) removeLayer(l *layer) int {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.layers[l.rid] == l {
+		delete(src.layers, l.rid)
+	}
+	return len(src.layers)
+}
+
+func (src *source) addSubscriber(dt *downTrack) {
+	src.mu.Lock()
+	src.subscribers[dt] = true
+	src.mu.Unlock()
+	src.selectLayers()
+}
+
+func (src *source) removeSubscriber(dt *downTrack) {
+	src.mu.Lock()
+	delete(src.subscribers, dt)
+	src.mu.Unlock()
+}
+
+func (src *source) subscriberList() []*downTrack {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+	list := make([]*downTrack, 0, len(src.subscribers))
+	for dt := range src.subscribers {
+		list = append(list, dt)
+	}
+	return list
+}
+
+// stop ends the source's layer watcher. Called with sfu.mu held, so only once.
+func (src *source) stop() {
+	select {
+	case <-src.done:
+	default:
+		close(src.done)
+	}
+}
+
+// forward sends every packet of a layer to the subscribers receiving it, until it ends
+func (src *source) forward(l *layer) {
+	for {
+		pkt, _, err := l.track.ReadRTP()
+		if err != nil {
+			return
+		}
+		l.last.Store(time.Now().UnixNano())
+
+		audio := src.kind == webrtc.RTPCodecTypeAudio
+		if audio && src.publisher.serverMuted.Load() {
+			continue
+		}
+		src.mu.RLock()
+		for dt := range src.subscribers {
+			if audio && dt.sub.serverDeafened.Load() {
+				continue
+			}
+			dt.write(l.rid, pkt)
+		}
+		src.mu.RUnlock()
+	}
+}
+
+// watch moves subscribers between layers as they start and stop being sent
+func (src *source) watch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-src.done:
+			return
+		case <-ticker.C:
+			src.selectLayers()
+		}
+	}
+}
+
+// selectLayers points each subscriber at the live layer closest to the one it wants, asking
+// the publisher for a keyframe to switch on
+func (src *source) selectLayers() {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	for dt := range src.subscribers {
+		dt.mu.Lock()
+		best, bestScore := "", -1
+		for rid, l := range src.layers {
+			// A layer with no packets yet has only just arrived
+			if last := l.last.Load(); last != 0 && now-last > int64(layerTimeout) && len(src.layers) > 1 {
+				continue
+			}
+			// Prefer the wanted layer, then lower ones, then higher ones
+			diff := layerRanks[rid] - layerRanks[dt.want]
+			score := -diff * 2
+			if diff > 0 {
+				score = diff*2 + 1
+			}
+			if bestScore < 0 || score < bestScore {
+				best, bestScore = rid, score
+			}
+		}
+		switching := bestScore >= 0 && (best != dt.target || dt.current != dt.target || !dt.started)
+		if switching {
+			dt.target = best
+		}
+		dt.mu.Unlock()
+		if switching {
+			src.requestKeyframe(best)
+		}
+	}
+}
+
+// requestKeyframe asks the publisher for a keyframe on a layer. Called with src.mu held.
+func (src *source) requestKeyframe(rid string) {
+	l := src.layers[rid]
+	if l == nil || src.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	if err := src.publisher.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(l.track.SSRC())},
+	}); err != nil {
+		log.Printf("SFU: failed to request keyframe: %v", err)
+	}
+}
+
+// downTrack sends one layer of a source to a subscriber. Layers have their own sequence
+// numbers and timestamps, so packets are renumbered to keep them continuous across a switch,
+// which only happens on a keyframe.
+type downTrack struct {
+	src    *source
+	sub    *peer
+	local  *webrtc.TrackLocalStaticRTP
+	sender *webrtc.RTPSender
+
+	mu        sync.Mutex
+	want      string // Layer the subscriber asked for
+	target    string // Layer to switch to at the next keyframe
+	current   string // Layer being forwarded
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastAt    time.Time
+}
+
+func newDownTrack(src *source, sub *peer, local *webrtc.TrackLocalStaticRTP, sender *webrtc.RTPSender, want string) *downTrack {
+	return &downTrack{src: src, sub: sub, local: local, sender: sender, want: want}
+}
+
+func (dt *downTrack) setWant(rid string) {
+	dt.mu.Lock()
+	dt.want = rid
+	dt.mu.Unlock()
+}
+
+func (dt *downTrack) write(rid string, pkt *rtp.Packet) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	if rid != dt.current || !dt.started {
+		if rid != dt.target || (dt.src.kind == webrtc.RTPCodecTypeVideo && !isKeyframe(pkt.Payload)) {
+			return
+		}
+		dt.current = rid
+		if dt.started {
+			dt.seqOffset = dt.lastSeq + 1 - pkt.SequenceNumber
+			elapsed := uint32(time.Since(dt.lastAt).Seconds() * float64(dt.src.codec.ClockRate))
+			if elapsed == 0 {
+				elapsed = 1
+			}
+			dt.tsOffset = dt.lastTS + elapsed - pkt.Timestamp
+		}
+	}
+
+	out := *pkt
+	// Header extension IDs were negotiated with the publisher, not the subscriber
+	out.Header.Extension = false
+	out.Header.Extensions = nil
+	out.SequenceNumber = pkt.SequenceNumber + dt.seqOffset
+	out.Timestamp = pkt.Timestamp + dt.tsOffset
+	if !dt.started || int16(out.SequenceNumber-dt.lastSeq) > 0 {
+		dt.lastSeq, dt.lastTS, dt.lastAt = out.SequenceNumber, out.Timestamp, time.Now()
+	}
+	dt.started = true
+
+	// Fails only once the subscriber is gone, which removes this track
+	dt.local.WriteRTP(&out)
+}
+
+// readRTCP passes the subscriber's keyframe requests on to the publisher. Reading RTCP also
+// keeps the sender's NACK and report interceptors running.
+func (dt *downTrack) readRTCP() {
+	for {
+		pkts, _, err := dt.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				dt.mu.Lock()
+				rid := dt.current
+				dt.mu.Unlock()
+				dt.src.mu.RLock()
+				dt.src.requestKeyframe(rid)
+				dt.src.mu.RUnlock()
+			}
+		}
+	}
+}
+
+// isKeyframe reports whether a VP8 RTP payload starts a keyframe
+func isKeyframe(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	// Payload descriptor: only the first packet of partition 0 has the frame header
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		i = 2
+		if ext&0x80 != 0 { // PictureID, one or two bytes
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 { // TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 { // TID/KEYIDX
+			i++
+		}
+	}
+	// The frame header's inverse key frame flag
+	return len(payload) > i && payload[i]&0x01 == 0
+}
@@ -0,0 +1,140 @@
+package sfu
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+
+	"github.com/shitcord/backend/internal/ws"
+)
+
+// defaultLayer is the simulcast layer sent until a subscriber asks for another
+const defaultLayer = "h"
+
+// peer is one user's connection to the SFU. The client offers it once, with the tracks it
+// sends; after that the server offers whenever tracks from others come or go.
+type peer struct {
+	sfu       *SFU
+	userID    uuid.UUID
+	channelID uuid.UUID
+	session   *ws.Client
+	pc        *webrtc.PeerConnection
+
+	// Guarded by sfu.mu
+	room    *room
+	sources map[string]*source     // Tracks this peer sends, by track ID
+	subs    map[*source]*downTrack // Tracks this peer is sent
+	layers  map[uuid.UUID]string   // Layer wanted of each publisher
+	closed  bool
+
+	negMu       sync.Mutex
+	renegotiate bool // Tracks changed while an offer was waiting for an answer
+
+	// Moderators' server mute and deafen, enforced by not forwarding audio
+	serverMuted    atomic.Bool
+	serverDeafened atomic.Bool
+}
+
+func (s *SFU) newPeer(client *ws.Client, channelID uuid.UUID) (*peer, error) {
+	pc, err := s.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	p := &peer{
+		sfu:       s,
+		userID:    client.ID,
+		channelID: channelID,
+		session:   client,
+		pc:        pc,
+		sources:   make(map[string]*source),
+		subs:      make(map[*source]*downTrack),
+		layers:    make(map[uuid.UUID]string),
+	}
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			p.send(ws.EventSFUICE, map[string]interface{}{"candidate": c.ToJSON()})
+		}
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.remove(p)
+		}
+	})
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		s.publish(p, track)
+	})
+	return p, nil
+}
+
+func (p *peer) send(event string, data map[string]interface{}) {
+	data["channel_id"] = p.channelID
+	ws.GlobalHub.SendToSession(p.session, event, data)
+}
+
+// answer accepts the client's initial offer
+func (p *peer) answer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	p.negMu.Lock()
+	defer p.negMu.Unlock()
+
+	if err := p.pc.SetRemoteDescription(offer); err != nil {
+		return nil, err
+	}
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+	return p.pc.LocalDescription(), nil
+}
+
+// negotiate offers the client the tracks it is now sent. If an offer is already waiting for
+// an answer, another is made once it arrives.
+func (p *peer) negotiate() {
+	p.negMu.Lock()
+	defer p.negMu.Unlock()
+
+	if p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+	if p.pc.SignalingState() != webrtc.SignalingStateStable {
+		p.renegotiate = true
+		return
+	}
+	offer, err := p.pc.CreateOffer(nil)
+	if err == nil {
+		err = p.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("SFU: failed to renegotiate with %s: %v", p.session.Username, err)
+		return
+	}
+	p.send(ws.EventSFUOffer, map[string]interface{}{"sdp": p.pc.LocalDescription()})
+}
+
+// setAnswer accepts the client's answer to the last offer
+func (p *peer) setAnswer(answer webrtc.SessionDescription) error {
+	p.negMu.Lock()
+	err := p.pc.SetRemoteDescription(answer)
+	again := p.renegotiate
+	p.renegotiate = false
+	p.negMu.Unlock()
+
+	if again {
+		p.negotiate()
+	}
+	return err
+}
+
+// layerFor returns the layer the peer wants of a publisher's video. Called with sfu.mu held.
+func (p *peer) layerFor(publisherID uuid.UUID) string {
+	if rid, ok := p.layers[publisherID]; ok {
+		return rid
+	}
+	return defaultLayer
+}
@@ -0,0 +1,406 @@
+// Package sfu is an optional selective forwarding unit for voice channels. Instead of
+// connecting to every other participant, each client sends its audio and video to the
+// server once and receives everyone else's over that same peer connection. Video is sent
+// as simulcast, and each subscriber is forwarded the layer it asks for, or the closest one
+// being sent. Media is relayed packet by packet from memory; each hop is DTLS-SRTP
+// encrypted and nothing is recorded.
+package sfu
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/ws"
+)
+
+// SFU keeps one peer connection per user in a voice channel. Who may join a room is
+// decided by their VoiceState, so clients join over REST first.
+type SFU struct {
+	api   *webrtc.API
+	mu    sync.Mutex // Guards rooms, peers and everything they publish and subscribe to
+	rooms map[uuid.UUID]*room
+	peers map[uuid.UUID]*peer // By user ID
+}
+
+// room is the set of peers in one voice channel
+type room struct {
+	channelID uuid.UUID
+	peers     map[uuid.UUID]*peer
+}
+
+// Default is the SFU voice channels use, or nil if they connect peer-to-peer
+var Default *SFU
+
+// Enabled reports whether voice channels go through the SFU
+func Enabled() bool {
+	return Default != nil
+}
+
+// Init sets up Default if VOICE_SFU is "true". SFU_PUBLIC_IP is the address clients reach
+// the server on when it is behind NAT, and SFU_UDP_PORT_MIN and SFU_UDP_PORT_MAX limit the
+// ports media uses so they can be opened in a firewall.
+func Init() error {
+	if os.Getenv("VOICE_SFU") != "true" {
+		return nil
+	}
+
+	m := &webrtc.MediaEngine{}
+	// Every subscriber gets exactly the packets the publisher sent, so all clients have to
+	// use the same codecs
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return err
+	}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: []webrtc.RTCPFeedback{
+			{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack", Parameter: "pli"},
+		}},
+		PayloadType: 96,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return err
+	}
+
+	se := webrtc.SettingEngine{}
+	if ips := os.Getenv("SFU_PUBLIC_IP"); ips != "" {
+		se.SetNAT1To1IPs(strings.Split(ips, ","), webrtc.ICECandidateTypeHost)
+	}
+	portMin, _ := strconv.Atoi(os.Getenv("SFU_UDP_PORT_MIN"))
+	portMax, _ := strconv.Atoi(os.Getenv("SFU_UDP_PORT_MAX"))
+	if portMin > 0 || portMax > 0 {
+		if err := se.SetEphemeralUDPPortRange(uint16(portMin), uint16(portMax)); err != nil {
+			return fmt.Errorf("SFU_UDP_PORT_MIN/SFU_UDP_PORT_MAX: %w", err)
+		}
+	}
+
+	Default = &SFU{
+		api:   webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry), webrtc.WithSettingEngine(se)),
+		rooms: make(map[uuid.UUID]*room),
+		peers: make(map[uuid.UUID]*peer),
+	}
+	ws.SFU = Default
+	return nil
+}
+
+// HandleSignal handles an SFU_* event from a client
+func (s *SFU) HandleSignal(client *ws.Client, event string, data json.RawMessage) {
+	var payload struct {
+		ChannelID string                    `json:"channel_id"`
+		SDP       webrtc.SessionDescription `json:"sdp"`
+		Candidate webrtc.ICECandidateInit   `json:"candidate"`
+		UserID    string                    `json:"user_id"`
+		Layer     string                    `json:"layer"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return
+	}
+
+	if event == ws.EventSFUJoin {
+		channelID, err := uuid.Parse(payload.ChannelID)
+		if err != nil {
+			return
+		}
+		if err := s.join(client, channelID, payload.SDP); err != nil {
+			log.Printf("SFU: %s could not join %s: %v", client.Username, channelID, err)
+			ws.GlobalHub.SendToSession(client, ws.EventSFUError, map[string]interface{}{
+				"channel_id": channelID,
+				"error":      err.Error(),
+			})
+		}
+		return
+	}
+
+	s.mu.Lock()
+	p := s.peers[client.ID]
+	s.mu.Unlock()
+	// Signaling from another of the user's sessions is for a connection that was replaced
+	if p == nil || p.session != client {
+		return
+	}
+
+	switch event {
+	case ws.EventSFUAnswer:
+		if err := p.setAnswer(payload.SDP); err != nil {
+			log.Printf("SFU: bad answer from %s: %v", client.Username, err)
+		}
+	case ws.EventSFUICE:
+		if err := p.pc.AddICECandidate(payload.Candidate); err != nil {
+			log.Printf("SFU: bad ICE candidate from %s: %v", client.Username, err)
+		}
+	case ws.EventSFULayer:
+		if publisherID, err := uuid.Parse(payload.UserID); err == nil && isLayer(payload.Layer) {
+			s.setLayer(p, publisherID, payload.Layer)
+		}
+	case ws.EventSFULeave:
+		s.remove(p)
+	}
+}
+
+// SessionClosed drops the peer connection a disconnected session had
+func (s *SFU) SessionClosed(client *ws.Client) {
+	s.mu.Lock()
+	p := s.peers[client.ID]
+	s.mu.Unlock()
+	if p != nil && p.session == client {
+		s.remove(p)
+	}
+}
+
+// Leave drops a user's peer connection, e.g. when their VoiceState goes away. It does
+// nothing on a nil SFU.
+func (s *SFU) Leave(userID uuid.UUID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	p := s.peers[userID]
+	s.mu.Unlock()
+	if p != nil {
+		s.remove(p)
+	}
+}
+
+// SetServerVoice applies a moderator's server mute and deafen to a user's connection: the
+// audio they send isn't forwarded while muted, nor is anyone's audio sent to them while
+// deafened. It does nothing on a nil SFU.
+func (s *SFU) SetServerVoice(userID uuid.UUID, muted, deafened bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	p := s.peers[userID]
+	s.mu.Unlock()
+	if p != nil {
+		p.serverMuted.Store(muted)
+		p.serverDeafened.Store(deafened)
+	}
+}
+
+// join answers a client's offer and adds it to the room for a voice channel it has joined
+func (s *SFU) join(client *ws.Client, channelID uuid.UUID, offer webrtc.SessionDescription) error {
+	var state models.VoiceState
+	if err := database.DB.First(&state, "user_id = ? AND channel_id = ?", client.ID, channelID).Error; err != nil {
+		return fmt.Errorf("not in this voice channel")
+	}
+	if offer.Type != webrtc.SDPTypeOffer {
+		return fmt.Errorf("expected an offer")
+	}
+
+	// A user has one connection; joining again, from any session, replaces it
+	s.Leave(client.ID)
+
+	p, err := s.newPeer(client, channelID)
+	if err != nil {
+		return err
+	}
+	p.serverMuted.Store(state.ServerMuted)
+	p.serverDeafened.Store(state.ServerDeafened)
+	answer, err := p.answer(offer)
+	if err != nil {
+		p.pc.Close()
+		return err
+	}
+	p.send(ws.EventSFUAnswer, map[string]interface{}{"sdp": answer})
+
+	// Other peers' tracks are offered once the client's own offer is settled
+	s.mu.Lock()
+	if old := s.peers[client.ID]; old != nil {
+		s.mu.Unlock()
+		p.pc.Close()
+		return fmt.Errorf("joined from another session")
+	}
+	r := s.rooms[channelID]
+	if r == nil {
+		r = &room{channelID: channelID, peers: make(map[uuid.UUID]*peer)}
+		s.rooms[channelID] = r
+	}
+	s.peers[client.ID] = p
+	p.room = r
+	r.peers[client.ID] = p
+
+	changed := map[*peer]bool{}
+	for _, other := range r.peers {
+		if other == p {
+			continue
+		}
+		for _, src := range other.sources {
+			if s.subscribe(p, src) {
+				changed[p] = true
+			}
+		}
+		// Tracks that arrived before the peer was in the room
+		for _, src := range p.sources {
+			if s.subscribe(other, src) {
+				changed[other] = true
+			}
+		}
+	}
+	size := len(r.peers)
+	s.mu.Unlock()
+
+	for peer := range changed {
+		peer.negotiate()
+	}
+	log.Printf("SFU: %s joined voice channel %s (%d in room)", client.Username, channelID, size)
+	return nil
+}
+
+// remove closes a peer and takes its tracks away from everyone it was sending to
+func (s *SFU) remove(p *peer) {
+	s.mu.Lock()
+	if p.closed {
+		s.mu.Unlock()
+		return
+	}
+	p.closed = true
+	if s.peers[p.userID] == p {
+		delete(s.peers, p.userID)
+	}
+
+	changed := map[*peer]bool{}
+	for _, src := range p.sources {
+		for _, sub := range s.unpublish(src) {
+			changed[sub] = true
+		}
+	}
+	for src, dt := range p.subs {
+		src.removeSubscriber(dt)
+	}
+	if r := p.room; r != nil {
+		delete(r.peers, p.userID)
+		if len(r.peers) == 0 {
+			delete(s.rooms, r.channelID)
+		}
+	}
+	s.mu.Unlock()
+
+	if err := p.pc.Close(); err != nil {
+		log.Printf("SFU: failed to close connection for %s: %v", p.session.Username, err)
+	}
+	for peer := range changed {
+		peer.negotiate()
+	}
+}
+
+// publish forwards a track a peer sends to everyone else in its room until the track ends
+func (s *SFU) publish(p *peer, track *webrtc.TrackRemote) {
+	id := track.ID()
+	if id == "" {
+		id = track.Kind().String()
+	}
+
+	s.mu.Lock()
+	if p.closed {
+		s.mu.Unlock()
+		return
+	}
+	changed := map[*peer]bool{}
+	src := p.sources[id]
+	if src == nil {
+		src = newSource(p, id, track)
+		p.sources[id] = src
+		if p.room != nil {
+			for _, other := range p.room.peers {
+				if other != p && s.subscribe(other, src) {
+					changed[other] = true
+				}
+			}
+		}
+		go src.watch()
+	}
+	l := src.addLayer(track)
+	s.mu.Unlock()
+
+	for peer := range changed {
+		peer.negotiate()
+	}
+
+	src.forward(l)
+
+	// The track ended; once no layer of it is left, nobody can be sent it any more
+	s.mu.Lock()
+	changed = map[*peer]bool{}
+	if src.removeLayer(l) == 0 && p.sources[id] == src {
+		for _, sub := range s.unpublish(src) {
+			changed[sub] = true
+		}
+	}
+	s.mu.Unlock()
+	for peer := range changed {
+		peer.negotiate()
+	}
+}
+
+// unpublish stops forwarding a source and returns the peers that were subscribed to it.
+// Called with s.mu held.
+func (s *SFU) unpublish(src *source) []*peer {
+	delete(src.publisher.sources, src.id)
+	src.stop()
+
+	var subs []*peer
+	for _, dt := range src.subscriberList() {
+		src.removeSubscriber(dt)
+		delete(dt.sub.subs, src)
+		if !dt.sub.closed {
+			if err := dt.sub.pc.RemoveTrack(dt.sender); err != nil {
+				log.Printf("SFU: failed to remove track from %s: %v", dt.sub.session.Username, err)
+			}
+			subs = append(subs, dt.sub)
+		}
+	}
+	return subs
+}
+
+// subscribe sends a source to a peer. It reports whether the peer has to renegotiate.
+// Called with s.mu held.
+func (s *SFU) subscribe(sub *peer, src *source) bool {
+	if sub.closed || sub.subs[src] != nil {
+		return false
+	}
+	local, err := webrtc.NewTrackLocalStaticRTP(src.codec.RTPCodecCapability, src.id, src.publisher.userID.String())
+	if err != nil {
+		log.Printf("SFU: failed to create track: %v", err)
+		return false
+	}
+	// AddTrack would reuse the transceiver of a track the client sends, which it won't receive on
+	tr, err := sub.pc.AddTransceiverFromTrack(local, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if err != nil {
+		log.Printf("SFU: failed to send track to %s: %v", sub.session.Username, err)
+		return false
+	}
+
+	dt := newDownTrack(src, sub, local, tr.Sender(), sub.layerFor(src.publisher.userID))
+	sub.subs[src] = dt
+	src.addSubscriber(dt)
+	go dt.readRTCP()
+	return true
+}
+
+// setLayer sets the simulcast layer a peer wants of a publisher's video
+func (s *SFU) setLayer(p *peer, publisherID uuid.UUID, rid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.layers[publisherID] = rid
+	for src, dt := range p.subs {
+		if src.publisher.userID == publisherID {
+			dt.setWant(rid)
+			src.selectLayers()
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config configures an S3-compatible store such as AWS S3 or MinIO
+type S3Config struct {
+	Endpoint       string // host[:port] the server talks to
+	PublicEndpoint string // host[:port] clients use for presigned URLs, if different
+	Region         string
+	Bucket         string
+	AccessKey      string
+	SecretKey      string
+	UseSSL         bool
+}
+
+// S3 keeps uploads in a bucket. Presigned URLs are signed for the bucket itself,
+// so clients download straight from the storage service.
+type S3 struct {
+	client  *minio.Client
+	presign *minio.Client
+	bucket  string
+}
+
+// NewS3 connects to the bucket, creating it if it doesn't exist yet
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required for the s3 storage driver")
+	}
+
+	opts := &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	}
+	client, err := minio.New(cfg.Endpoint, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Signatures cover the host, so URLs for clients must be signed for the host they'll use
+	presign := client
+	if cfg.PublicEndpoint != "" {
+		if presign, err = minio.New(cfg.PublicEndpoint, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3{client: client, presign: presign, bucket: cfg.Bucket}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if !validKey(key) {
+		return ErrNotFound
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrNotFound
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; Stat surfaces a missing object before anything is streamed
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return nil
+	}
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) Walk(ctx context.Context, fn func(obj Object) error) error {
+	// Cancelling stops the listing goroutine if fn ends the walk early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if err := fn(Object{Key: info.Key, Size: info.Size, ModTime: info.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3) PresignedURL(ctx context.Context, key string, expiry time.Duration, resp ResponseHeaders) (string, error) {
+	params := url.Values{}
+	if resp.ContentType != "" {
+		params.Set("response-content-type", resp.ContentType)
+	}
+	if resp.ContentDisposition != "" {
+		params.Set("response-content-disposition", resp.ContentDisposition)
+	}
+	u, err := s.presign.PresignedGetObject(ctx, s.bucket, key, expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
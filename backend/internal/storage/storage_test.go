@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// presigned returns the expires and sig parameters of a local presigned URL
+func presigned(t *testing.T, l *Local, key string, expiry time.Duration) (string, string) {
+	t.Helper()
+	raw, err := l.PresignedURL(context.Background(), key, expiry, ResponseHeaders{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(raw, l.BaseURL+"/"+key+"?") {
+		t.Fatalf("presigned URL %s is not under %s", raw, l.BaseURL)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("expires"), u.Query().Get("sig")
+}
+
+func TestVerifyPresigned(t *testing.T) {
+	l := NewLocal(t.TempDir(), "/uploads", []byte("signing-key"))
+	key := "attachments/abc/photo.png"
+	expires, sig := presigned(t, l, key, time.Hour)
+	expired, expiredSig := presigned(t, l, key, -time.Minute)
+	later := strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		verifier  *Local
+		key       string
+		expires   string
+		signature string
+		want      bool
+	}{
+		{"valid", l, key, expires, sig, true},
+		{"expired", l, key, expired, expiredSig, false},
+		{"extended expiry", l, key, later, sig, false},
+		{"other key", l, "attachments/abc/other.png", expires, sig, false},
+		{"tampered signature", l, key, expires, sig[:len(sig)-1] + "A", false},
+		{"missing signature", l, key, expires, "", false},
+		{"missing expiry", l, key, "", sig, false},
+		{"malformed expiry", l, key, "soon", sig, false},
+		{"other signing key", NewLocal(l.Root, "/uploads", []byte("other-key")), key, expires, sig, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.verifier.VerifyPresigned(tt.key, tt.expires, tt.signature); got != tt.want {
+				t.Fatalf("VerifyPresigned = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"attachments/abc/photo.png", true},
+		{"avatar.png", true},
+		{"quarantine/abc/file..txt", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../secret", false},
+		{"attachments/../../secret", false},
+		{"attachments/./photo.png", false},
+		{"attachments//photo.png", false},
+		{"attachments/", false},
+		{"..", false},
+		{`attachments\..\..\secret`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := validKey(tt.key); got != tt.want {
+				t.Fatalf("validKey(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalRejectsTraversal(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "uploads")
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := NewLocal(root, "/uploads", []byte("signing-key"))
+	ctx := context.Background()
+
+	if _, err := l.Open(ctx, "../secret"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Open outside the root: got %v, want %v", err, ErrNotFound)
+	}
+	if err := l.Put(ctx, "../escaped", strings.NewReader("x"), 1, "text/plain"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Put outside the root: got %v, want %v", err, ErrNotFound)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Fatal("Put wrote outside the root")
+	}
+	if err := l.Delete(ctx, "../secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(secret); err != nil {
+		t.Fatal("Delete removed a file outside the root")
+	}
+}
+
+func TestKeyFromURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"/uploads/attachments/abc/photo.png", "attachments/abc/photo.png"},
+		{"/uploads/avatar.png", "avatar.png"},
+		{"/uploads/", ""},
+		{"/uploads", ""},
+		{"uploads/avatar.png", ""},
+		{"https://cdn.example.com/uploads/avatar.png", ""},
+		{"/static/avatar.png", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := KeyFromURL(tt.url); got != tt.want {
+				t.Fatalf("KeyFromURL(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+// Package uploadgc deletes uploads nothing refers to any more: files that were uploaded but
+// never posted, attachments of deleted messages, replaced avatars and icons, and stored
+// files without an attachment record at all.
+package uploadgc
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/shitcord/backend/internal/blobstore"
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+	"github.com/shitcord/backend/internal/storage"
+)
+
+// Reasons an upload is collected
+const (
+	ReasonUnreferenced = "unreferenced"       // Attachment no message, profile or icon points at
+	ReasonOrphanThumb  = "orphaned thumbnail" // Thumbnail whose image is gone
+	ReasonUnusedBlob   = "unused blob"        // Shared contents no attachment uses
+	ReasonUntracked    = "untracked"          // Stored file without an attachment record
+)
+
+// Orphan is an upload the collector found
+type Orphan struct {
+	Key    string
+	Size   int64
+	Reason string
+}
+
+// Report lists what a collection found, and deleted unless it was a dry run
+type Report struct {
+	Orphans []Orphan
+	Bytes   int64
+}
+
+func (r *Report) add(o Orphan) {
+	r.Orphans = append(r.Orphans, o)
+	r.Bytes += o.Size
+}
+
+// MinGrace is the shortest grace period allowed. Anything shorter could collect uploads that
+// are about to be posted and chunks of resumable uploads still in progress.
+const MinGrace = time.Hour
+
+// Collector finds and deletes unreferenced uploads. Uploads younger than Grace are left
+// alone, so files that are about to be posted aren't collected.
+type Collector struct {
+	Grace    time.Duration
+	Interval time.Duration
+	DryRun   bool
+}
+
+// NewCollector returns a collector configured from UPLOAD_GC_GRACE_HOURS (24 by default)
+// and UPLOAD_GC_INTERVAL_MINUTES (60 by default, 0 turns the background job off)
+func NewCollector() *Collector {
+	c := &Collector{Grace: 24 * time.Hour, Interval: time.Hour}
+	if h, err := strconv.Atoi(os.Getenv("UPLOAD_GC_GRACE_HOURS")); err == nil && h > 0 {
+		c.Grace = time.Duration(h) * time.Hour
+	}
+	if m, err := strconv.Atoi(os.Getenv("UPLOAD_GC_INTERVAL_MINUTES")); err == nil && m >= 0 {
+		c.Interval = time.Duration(m) * time.Minute
+	}
+	return c
+}
+
+// Run collects garbage every Interval. It returns straight away if Interval is 0.
+func (c *Collector) Run() {
+	if c.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, err := c.Collect(context.Background())
+		if err != nil {
+			log.Printf("Upload GC failed: %v", err)
+		}
+		if report != nil && len(report.Orphans) > 0 {
+			log.Printf("Upload GC removed %d files (%d bytes)", len(report.Orphans), report.Bytes)
+		}
+	}
+}
+
+// reference is a column that can point at an upload
+type reference struct {
+	model  interface{}
+	column string
+}
+
+var references = []reference{
+	{&models.Message{}, "attachment_url"},
+	{&models.Message{}, "author_avatar_url"},
+	{&models.ScheduledMessage{}, "attachment_url"},
+	{&models.User{}, "avatar_url"},
+	{&models.Server{}, "icon_url"},
+	{&models.DMChannel{}, "icon_url"},
+	{&models.Webhook{}, "avatar_url"},
+}
+
+// referencedURLs returns a subquery of the upload URLs a column holds
+func (r reference) referencedURLs() *gorm.DB {
+	return database.DB.Model(r.model).Select(r.column).Where(r.column+" LIKE ?", "/uploads/%")
+}
+
+// Collect finds unreferenced uploads older than the grace period and, unless this is a
+// dry run, deletes them from storage along with their attachment records
+func (c *Collector) Collect(ctx context.Context) (*Report, error) {
+	cutoff := time.Now().Add(-c.Grace)
+	report := &Report{}
+
+	// Attachments nothing points at, with their thumbnails
+	q := database.DB.Preload("Thumbnails").Where("parent_id IS NULL AND created_at < ?", cutoff)
+	for _, r := range references {
+		q = q.Where("url NOT IN (?)", r.referencedURLs())
+	}
+	var unreferenced []models.Attachment
+	if err := q.Find(&unreferenced).Error; err != nil {
+		return report, err
+	}
+	for _, att := range unreferenced {
+		if err := c.removeAttachments(ctx, report, ReasonUnreferenced, append([]models.Attachment{att}, att.Thumbnails...)); err != nil {
+			return report, err
+		}
+	}
+
+	// Thumbnails whose image record was deleted without them
+	var thumbs []models.Attachment
+	database.DB.Where("parent_id IS NOT NULL AND parent_id NOT IN (?)", database.DB.Model(&models.Attachment{}).Select("id")).
+		Find(&thumbs)
+	for _, thumb := range thumbs {
+		if err := c.removeAttachments(ctx, report, ReasonOrphanThumb, []models.Attachment{thumb}); err != nil {
+			return report, err
+		}
+	}
+
+	// Shared contents no attachment uses any more, whose count was thrown off by a crash
+	// or a failed delete
+	var blobs []models.Blob
+	database.DB.Where("updated_at < ? AND hash NOT IN (?)", cutoff,
+		database.DB.Model(&models.Attachment{}).Select("blob_hash").Where("blob_hash != ''")).Find(&blobs)
+	for _, blob := range blobs {
+		if !c.DryRun {
+			purged, err := blobstore.Purge(ctx, blob.Hash, cutoff)
+			if err != nil {
+				log.Printf("Upload GC failed to delete %s: %v", blob.Key, err)
+				continue
+			}
+			if !purged {
+				continue
+			}
+		}
+		report.add(Orphan{Key: blob.Key, Size: blob.Size, Reason: ReasonUnusedBlob})
+	}
+
+	// Stored files with no record, e.g. left behind by a crash between storing and recording
+	// an upload, or uploaded before attachments were tracked and never used
+	tracked, err := loadTrackedKeys()
+	if err != nil {
+		return report, err
+	}
+	var untracked []Orphan
+	err = storage.Default.Walk(ctx, func(obj storage.Object) error {
+		if obj.ModTime.After(cutoff) || tracked.has(obj.Key) {
+			return nil
+		}
+		untracked = append(untracked, Orphan{Key: obj.Key, Size: obj.Size, Reason: ReasonUntracked})
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, orphan := range untracked {
+		if !c.DryRun {
+			if err := storage.Default.Delete(ctx, orphan.Key); err != nil {
+				log.Printf("Upload GC failed to delete %s: %v", orphan.Key, err)
+				continue
+			}
+		}
+		report.add(orphan)
+	}
+
+	return report, nil
+}
+
+// trackedKeys is what the database knows is in storage. It is loaded once per run, before
+// storage is walked, so the walk doesn't query for every object; anything stored after it was
+// loaded is newer than the grace period and skipped anyway.
+type trackedKeys struct {
+	urls       map[string]bool // Attachments, and upload URLs something points at
+	blobs      map[string]bool
+	quarantine map[string]bool
+	sessions   map[string]bool // IDs of unfinished resumable uploads
+}
+
+func loadTrackedKeys() (*trackedKeys, error) {
+	t := &trackedKeys{urls: map[string]bool{}, blobs: map[string]bool{}, quarantine: map[string]bool{}, sessions: map[string]bool{}}
+	load := func(set map[string]bool, q *gorm.DB, column string) error {
+		var values []string
+		if err := q.Pluck(column, &values).Error; err != nil {
+			return err
+		}
+		for _, v := range values {
+			set[v] = true
+		}
+		return nil
+	}
+
+	if err := load(t.urls, database.DB.Model(&models.Attachment{}), "url"); err != nil {
+		return nil, err
+	}
+	for _, r := range references {
+		if err := load(t.urls, r.referencedURLs(), r.column); err != nil {
+			return nil, err
+		}
+	}
+	if err := load(t.blobs, database.DB.Model(&models.Blob{}), "key"); err != nil {
+		return nil, err
+	}
+	if err := load(t.quarantine, database.DB.Model(&models.UploadScan{}).Where("quarantine_key != ''"), "quarantine_key"); err != nil {
+		return nil, err
+	}
+	if err := load(t.sessions, database.DB.Model(&models.UploadSession{}), "id"); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// has reports whether a stored object is a blob, a quarantined upload, a chunk of an
+// unfinished resumable upload, an attachment uploaded before deduplication or a file
+// something still points at
+func (t *trackedKeys) has(key string) bool {
+	switch {
+	case strings.HasPrefix(key, "blobs/"):
+		return t.blobs[key]
+	case strings.HasPrefix(key, "quarantine/"):
+		return t.quarantine[key]
+	case strings.HasPrefix(key, "staging/"):
+		id, _, _ := strings.Cut(strings.TrimPrefix(key, "staging/"), "/")
+		return t.sessions[id]
+	}
+	return t.urls["/uploads/"+key]
+}
+
+// removeAttachments deletes attachment records and then their contents. Records go first so
+// a failed delete leaves unreferenced contents for the next run to find.
+func (c *Collector) removeAttachments(ctx context.Context, report *Report, reason string, atts []models.Attachment) error {
+	if !c.DryRun {
+		ids := make([]uuid.UUID, len(atts))
+		for i := range atts {
+			ids[i] = atts[i].ID
+		}
+		if err := database.DB.Where("id IN ?", ids).Delete(&models.Attachment{}).Error; err != nil {
+			return err
+		}
+		for i := range atts {
+			blobstore.Remove(ctx, &atts[i])
+		}
+	}
+	for _, att := range atts {
+		report.add(Orphan{Key: storage.KeyFromURL(att.URL), Size: att.Size, Reason: reason})
+	}
+	return nil
+}
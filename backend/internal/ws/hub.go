@@ -10,32 +10,54 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 
+	"github.com/shitcord/backend/internal/access"
 	"github.com/shitcord/backend/internal/database"
 	"github.com/shitcord/backend/internal/models"
 )
 
 // Event types for WebSocket messages
 const (
-	EventMessage       = "MESSAGE_CREATE"
-	EventMessageEdit   = "MESSAGE_UPDATE"
-	EventMessageDelete = "MESSAGE_DELETE"
-	EventTyping        = "TYPING_START"
-	EventPresence      = "PRESENCE_UPDATE"
-	EventVoiceJoin     = "VOICE_STATE_JOIN"
-	EventVoiceLeave    = "VOICE_STATE_LEAVE"
-	EventWebRTCOffer   = "WEBRTC_OFFER"
-	EventWebRTCAnswer  = "WEBRTC_ANSWER"
-	EventWebRTCICE     = "WEBRTC_ICE_CANDIDATE"
-	EventChannelUpdate = "CHANNEL_UPDATE"
-	EventMemberJoin    = "MEMBER_JOIN"
-	EventMemberLeave   = "MEMBER_LEAVE"
-	EventHeartbeat     = "HEARTBEAT"
-	EventHeartbeatAck  = "HEARTBEAT_ACK"
-	EventReady         = "READY"
-	EventDMCallRing    = "DM_CALL_RING"
-	EventDMCallAccept  = "DM_CALL_ACCEPT"
-	EventDMCallReject  = "DM_CALL_REJECT"
-	EventDMCallEnd     = "DM_CALL_END"
+	EventMessage             = "MESSAGE_CREATE"
+	EventMessageEdit         = "MESSAGE_UPDATE"
+	EventMessageDelete       = "MESSAGE_DELETE"
+	EventTyping              = "TYPING_START"
+	EventPresence            = "PRESENCE_UPDATE"
+	EventVoiceJoin           = "VOICE_STATE_JOIN"
+	EventVoiceLeave          = "VOICE_STATE_LEAVE"
+	EventVoiceUpdate         = "VOICE_STATE_UPDATE"
+	EventVoiceForced         = "VOICE_STATE_FORCED"
+	EventWebRTCOffer         = "WEBRTC_OFFER"
+	EventWebRTCAnswer        = "WEBRTC_ANSWER"
+	EventWebRTCICE           = "WEBRTC_ICE_CANDIDATE"
+	EventChannelUpdate       = "CHANNEL_UPDATE"
+	EventMemberJoin          = "MEMBER_JOIN"
+	EventMemberLeave         = "MEMBER_LEAVE"
+	EventHeartbeat           = "HEARTBEAT"
+	EventHeartbeatAck        = "HEARTBEAT_ACK"
+	EventReady               = "READY"
+	EventDMCallRing          = "DM_CALL_RING"
+	EventDMCallAccept        = "DM_CALL_ACCEPT"
+	EventDMCallReject        = "DM_CALL_REJECT"
+	EventDMCallEnd           = "DM_CALL_END"
+	EventMentionCreate       = "MENTION_CREATE"
+	EventAck                 = "ACK"
+	EventMessageAck          = "MESSAGE_ACK"
+	EventMessageReceipt      = "MESSAGE_RECEIPT"
+	EventDMCreate            = "DM_CHANNEL_CREATE"
+	EventDMUpdate            = "DM_CHANNEL_UPDATE"
+	EventDMParticipantAdd    = "DM_PARTICIPANT_ADD"
+	EventDMParticipantRemove = "DM_PARTICIPANT_REMOVE"
+	EventScheduledUpdate     = "SCHEDULED_MESSAGE_UPDATE"
+	EventPollVote            = "POLL_VOTE"
+	EventInteractionCreate   = "INTERACTION_CREATE"
+	EventInteractionDefer    = "INTERACTION_DEFER"
+	EventSFUJoin             = "SFU_JOIN"
+	EventSFUOffer            = "SFU_OFFER"
+	EventSFUAnswer           = "SFU_ANSWER"
+	EventSFUICE              = "SFU_ICE_CANDIDATE"
+	EventSFULayer            = "SFU_SET_LAYER"
+	EventSFULeave            = "SFU_LEAVE"
+	EventSFUError            = "SFU_ERROR"
 )
 
 // WSMessage represents a WebSocket message envelope
@@ -47,26 +69,34 @@ type WSMessage struct {
 	Timestamp int64           `json:"timestamp"`
 }
 
-// Client represents a connected WebSocket client
+// Client represents a single WebSocket session. A user can have several
+// sessions open at once (e.g. desktop and phone).
 type Client struct {
-	ID       uuid.UUID
-	Username string
-	Conn     *websocket.Conn
-	Hub      *Hub
-	Send     chan []byte
-	Channels map[string]bool // Subscribed channel IDs
-	Servers  map[string]bool // Subscribed server IDs
-	mu       sync.RWMutex
+	ID        uuid.UUID // User ID
+	SessionID uuid.UUID
+	Username  string
+	Conn      *websocket.Conn
+	Hub       *Hub
+	Send      chan []byte
+	Channels  map[string]bool // Subscribed channel IDs
+	Servers   map[string]bool // Subscribed server IDs
+	mu        sync.RWMutex
+
+	// Sent with READY. They are loaded before the client is registered, so the queries
+	// don't hold up the hub loop.
+	readStates []ChannelReadState
 }
 
 // Hub manages all WebSocket connections
 type Hub struct {
-	clients    map[uuid.UUID]*Client
-	channels   map[string]map[uuid.UUID]*Client // channelID -> clients
+	clients    map[uuid.UUID]map[*Client]bool // userID -> sessions
+	channels   map[string]map[*Client]bool    // channelID -> sessions
 	broadcast  chan *BroadcastMessage
 	register   chan *Client
 	unregister chan *Client
 	mu         sync.RWMutex
+
+	voiceTimers map[uuid.UUID]*time.Timer // Users who lost the session they are in voice from
 }
 
 // BroadcastMessage is a message to be sent to specific targets
@@ -74,21 +104,34 @@ type BroadcastMessage struct {
 	Message   []byte
 	ChannelID string
 	ServerID  string
-	ExcludeID uuid.UUID // Don't send back to sender
-	TargetID  *uuid.UUID // Send to specific user (for WebRTC signaling)
+	ExcludeID uuid.UUID                 // Don't send back to sender
+	TargetID  *uuid.UUID                // Send to specific user (for WebRTC signaling)
+	Session   *Client                   // Send to one session only (for SFU signaling)
+	OnDeliver func(userIDs []uuid.UUID) // Called with the users whose sessions got a channel message
 }
 
 // GlobalHub is the singleton hub instance accessible from handlers
 var GlobalHub *Hub
 
+// MediaServer relays media for clients through the server, taking their signaling
+type MediaServer interface {
+	HandleSignal(client *Client, event string, data json.RawMessage)
+	SessionClosed(client *Client)
+}
+
+// SFU is set when voice channels go through the server's SFU rather than peer-to-peer
+var SFU MediaServer
+
 // NewHub creates a new WebSocket hub
 func NewHub() *Hub {
 	h := &Hub{
-		clients:    make(map[uuid.UUID]*Client),
-		channels:   make(map[string]map[uuid.UUID]*Client),
+		clients:    make(map[uuid.UUID]map[*Client]bool),
+		channels:   make(map[string]map[*Client]bool),
 		broadcast:  make(chan *BroadcastMessage, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+
+		voiceTimers: make(map[uuid.UUID]*time.Timer),
 	}
 	GlobalHub = h
 	return h
@@ -100,7 +143,11 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
-			h.clients[client.ID] = client
+			firstSession := len(h.clients[client.ID]) == 0
+			if firstSession {
+				h.clients[client.ID] = make(map[*Client]bool)
+			}
+			h.clients[client.ID][client] = true
 
 			// Collect all currently online user IDs
 			onlineIDs := make([]string, 0, len(h.clients))
@@ -108,17 +155,19 @@ func (h *Hub) Run() {
 				onlineIDs = append(onlineIDs, id.String())
 			}
 			h.mu.Unlock()
-			log.Printf("Client connected: %s (%s)", client.Username, client.ID)
+			log.Printf("Client connected: %s (%s, session %s)", client.Username, client.ID, client.SessionID)
 
 			// Update DB status to online
-			if database.DB != nil {
+			if database.DB != nil && firstSession {
 				database.DB.Model(&models.User{}).Where("id = ?", client.ID).Update("status", "online")
 			}
 
-			// Send READY event with online user list
+			// Send READY event with online user list and read states
 			readyData, _ := json.Marshal(map[string]interface{}{
-				"status":     "connected",
+				"status":       "connected",
+				"session_id":   client.SessionID,
 				"online_users": onlineIDs,
+				"read_states":  client.readStates,
 			})
 			readyMsg := WSMessage{
 				Event:     EventReady,
@@ -128,6 +177,11 @@ func (h *Hub) Run() {
 			data, _ := json.Marshal(readyMsg)
 			client.Send <- data
 
+			// Other sessions of an already-online user don't change presence
+			if !firstSession {
+				continue
+			}
+
 			// Broadcast online presence to all other clients
 			presenceMsg := WSMessage{
 				Event:     EventPresence,
@@ -142,11 +196,13 @@ func (h *Hub) Run() {
 			onlineBytes, _ := json.Marshal(presenceMsg)
 
 			h.mu.RLock()
-			for id, c := range h.clients {
+			for id, sessions := range h.clients {
 				if id != client.ID {
-					select {
-					case c.Send <- onlineBytes:
-					default:
+					for c := range sessions {
+						select {
+						case c.Send <- onlineBytes:
+						default:
+						}
 					}
 				}
 			}
@@ -154,22 +210,39 @@ func (h *Hub) Run() {
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client.ID]; ok {
-				delete(h.clients, client.ID)
+			lastSession := false
+			if sessions, ok := h.clients[client.ID]; ok && sessions[client] {
+				delete(sessions, client)
 				close(client.Send)
+				if len(sessions) == 0 {
+					delete(h.clients, client.ID)
+					lastSession = true
+				}
 
 				// Remove from all channels
+				client.mu.RLock()
 				for channelID := range client.Channels {
 					if ch, ok := h.channels[channelID]; ok {
-						delete(ch, client.ID)
+						delete(ch, client)
 						if len(ch) == 0 {
 							delete(h.channels, channelID)
 						}
 					}
 				}
+				client.mu.RUnlock()
 			}
 			h.mu.Unlock()
-			log.Printf("Client disconnected: %s (%s)", client.Username, client.ID)
+			log.Printf("Client disconnected: %s (%s, session %s)", client.Username, client.ID, client.SessionID)
+
+			if SFU != nil {
+				go SFU.SessionClosed(client)
+			}
+			go h.voiceSessionClosed(client.ID)
+
+			// The user is still online on another session
+			if !lastSession {
+				continue
+			}
 
 			// Update DB status to offline
 			if database.DB != nil {
@@ -190,19 +263,34 @@ func (h *Hub) Run() {
 			msgBytes, _ := json.Marshal(presenceMsg)
 
 			h.mu.RLock()
-			for _, c := range h.clients {
-				select {
-				case c.Send <- msgBytes:
-				default:
+			for _, sessions := range h.clients {
+				for c := range sessions {
+					select {
+					case c.Send <- msgBytes:
+					default:
+					}
 				}
 			}
 			h.mu.RUnlock()
 
 		case msg := <-h.broadcast:
-			// Send to specific user (e.g., WebRTC signaling)
+			// Send to one session, if it's still connected
+			if msg.Session != nil {
+				h.mu.RLock()
+				if h.clients[msg.Session.ID][msg.Session] {
+					select {
+					case msg.Session.Send <- msg.Message:
+					default:
+					}
+				}
+				h.mu.RUnlock()
+				continue
+			}
+
+			// Send to specific user (e.g., WebRTC signaling), on every session they have open
 			if msg.TargetID != nil {
 				h.mu.RLock()
-				if client, ok := h.clients[*msg.TargetID]; ok {
+				for client := range h.clients[*msg.TargetID] {
 					select {
 					case client.Send <- msg.Message:
 					default:
@@ -214,26 +302,38 @@ func (h *Hub) Run() {
 
 			// Broadcast to channel
 			if msg.ChannelID != "" {
+				delivered := map[uuid.UUID]bool{}
 				h.mu.RLock()
-				if clients, ok := h.channels[msg.ChannelID]; ok {
-					for id, client := range clients {
-						if id != msg.ExcludeID {
-							select {
-							case client.Send <- msg.Message:
-							default:
-							}
+				for client := range h.channels[msg.ChannelID] {
+					if client.ID != msg.ExcludeID {
+						select {
+						case client.Send <- msg.Message:
+							delivered[client.ID] = true
+						default:
 						}
 					}
 				}
 				h.mu.RUnlock()
+
+				// Delivery callbacks may hit the database, so keep them off the hub loop
+				if msg.OnDeliver != nil && len(delivered) > 0 {
+					userIDs := make([]uuid.UUID, 0, len(delivered))
+					for id := range delivered {
+						userIDs = append(userIDs, id)
+					}
+					go msg.OnDeliver(userIDs)
+				}
 				continue
 			}
 
 			// Broadcast to all clients in a server
 			if msg.ServerID != "" {
 				h.mu.RLock()
-				for id, client := range h.clients {
-					if id != msg.ExcludeID {
+				for id, sessions := range h.clients {
+					if id == msg.ExcludeID {
+						continue
+					}
+					for client := range sessions {
 						client.mu.RLock()
 						if client.Servers[msg.ServerID] {
 							select {
@@ -250,55 +350,65 @@ func (h *Hub) Run() {
 	}
 }
 
-// SubscribeChannel adds a client to a channel
-func (h *Hub) SubscribeChannel(clientID uuid.UUID, channelID string) {
+// IsOnline reports whether a user has at least one open session
+func (h *Hub) IsOnline(userID uuid.UUID) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[userID]) > 0
+}
+
+// SubscribeChannel adds a client session to a channel
+func (h *Hub) SubscribeChannel(client *Client, channelID string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	client, ok := h.clients[clientID]
-	if !ok {
+	if !h.clients[client.ID][client] {
 		return
 	}
 
 	if _, ok := h.channels[channelID]; !ok {
-		h.channels[channelID] = make(map[uuid.UUID]*Client)
+		h.channels[channelID] = make(map[*Client]bool)
 	}
-	h.channels[channelID][clientID] = client
+	h.channels[channelID][client] = true
 
 	client.mu.Lock()
 	client.Channels[channelID] = true
 	client.mu.Unlock()
 }
 
-// UnsubscribeChannel removes a client from a channel
-func (h *Hub) UnsubscribeChannel(clientID uuid.UUID, channelID string) {
+// UnsubscribeChannel removes a client session from a channel
+func (h *Hub) UnsubscribeChannel(client *Client, channelID string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	if clients, ok := h.channels[channelID]; ok {
-		delete(clients, clientID)
+		delete(clients, client)
 		if len(clients) == 0 {
 			delete(h.channels, channelID)
 		}
 	}
 
-	if client, ok := h.clients[clientID]; ok {
-		client.mu.Lock()
-		delete(client.Channels, channelID)
-		client.mu.Unlock()
-	}
+	client.mu.Lock()
+	delete(client.Channels, channelID)
+	client.mu.Unlock()
 }
 
-// SubscribeServer marks a client as subscribed to a server
-func (h *Hub) SubscribeServer(clientID uuid.UUID, serverID string) {
+// UnsubscribeUser removes every session of a user from a channel
+func (h *Hub) UnsubscribeUser(userID uuid.UUID, channelID string) {
 	h.mu.RLock()
-	client, ok := h.clients[clientID]
+	sessions := make([]*Client, 0, len(h.clients[userID]))
+	for client := range h.clients[userID] {
+		sessions = append(sessions, client)
+	}
 	h.mu.RUnlock()
 
-	if !ok {
-		return
+	for _, client := range sessions {
+		h.UnsubscribeChannel(client, channelID)
 	}
+}
 
+// SubscribeServer marks a client session as subscribed to a server
+func (h *Hub) SubscribeServer(client *Client, serverID string) {
 	client.mu.Lock()
 	client.Servers[serverID] = true
 	client.mu.Unlock()
@@ -322,6 +432,26 @@ func (h *Hub) BroadcastToChannel(channelID string, event string, data interface{
 	}
 }
 
+// BroadcastToChannelWithDelivery is like BroadcastToChannel, but reports which
+// users had at least one session receive the message
+func (h *Hub) BroadcastToChannelWithDelivery(channelID string, event string, data interface{}, excludeID uuid.UUID, onDeliver func(userIDs []uuid.UUID)) {
+	dataBytes, _ := json.Marshal(data)
+	msg := WSMessage{
+		Event:     event,
+		Data:      dataBytes,
+		ChannelID: channelID,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	msgBytes, _ := json.Marshal(msg)
+
+	h.broadcast <- &BroadcastMessage{
+		Message:   msgBytes,
+		ChannelID: channelID,
+		ExcludeID: excludeID,
+		OnDeliver: onDeliver,
+	}
+}
+
 // BroadcastToServer sends a message to all clients in a server
 func (h *Hub) BroadcastToServer(serverID string, event string, data interface{}, excludeID uuid.UUID) {
 	dataBytes, _ := json.Marshal(data)
@@ -334,8 +464,8 @@ func (h *Hub) BroadcastToServer(serverID string, event string, data interface{},
 	msgBytes, _ := json.Marshal(msg)
 
 	h.broadcast <- &BroadcastMessage{
-		Message:  msgBytes,
-		ServerID: serverID,
+		Message:   msgBytes,
+		ServerID:  serverID,
 		ExcludeID: excludeID,
 	}
 }
@@ -356,6 +486,22 @@ func (h *Hub) SendToUser(targetID uuid.UUID, event string, data interface{}) {
 	}
 }
 
+// SendToSession sends a message to one session of a user
+func (h *Hub) SendToSession(client *Client, event string, data interface{}) {
+	dataBytes, _ := json.Marshal(data)
+	msg := WSMessage{
+		Event:     event,
+		Data:      dataBytes,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	msgBytes, _ := json.Marshal(msg)
+
+	h.broadcast <- &BroadcastMessage{
+		Message: msgBytes,
+		Session: client,
+	}
+}
+
 // HandleWebSocket returns the WebSocket handler
 func HandleWebSocket(hub *Hub) fiber.Handler {
 	return websocket.New(func(c *websocket.Conn) {
@@ -363,14 +509,16 @@ func HandleWebSocket(hub *Hub) fiber.Handler {
 		username, _ := c.Locals("username").(string)
 
 		client := &Client{
-			ID:       userID,
-			Username: username,
-			Conn:     c,
-			Hub:      hub,
-			Send:     make(chan []byte, 256),
-			Channels: make(map[string]bool),
-			Servers:  make(map[string]bool),
+			ID:        userID,
+			SessionID: uuid.New(),
+			Username:  username,
+			Conn:      c,
+			Hub:       hub,
+			Send:      make(chan []byte, 256),
+			Channels:  make(map[string]bool),
+			Servers:   make(map[string]bool),
 		}
+		client.readStates = loadReadStates(userID)
 
 		hub.register <- client
 
@@ -421,7 +569,7 @@ func handleClientMessage(hub *Hub, client *Client, msg *WSMessage) {
 		}
 		json.Unmarshal(msg.Data, &payload)
 		if payload.ChannelID != "" {
-			hub.SubscribeChannel(client.ID, payload.ChannelID)
+			hub.SubscribeChannel(client, payload.ChannelID)
 		}
 
 	case "UNSUBSCRIBE_CHANNEL":
@@ -430,7 +578,7 @@ func handleClientMessage(hub *Hub, client *Client, msg *WSMessage) {
 		}
 		json.Unmarshal(msg.Data, &payload)
 		if payload.ChannelID != "" {
-			hub.UnsubscribeChannel(client.ID, payload.ChannelID)
+			hub.UnsubscribeChannel(client, payload.ChannelID)
 		}
 
 	case "SUBSCRIBE_SERVER":
@@ -439,8 +587,29 @@ func handleClientMessage(hub *Hub, client *Client, msg *WSMessage) {
 		}
 		json.Unmarshal(msg.Data, &payload)
 		if payload.ServerID != "" {
-			hub.SubscribeServer(client.ID, payload.ServerID)
+			hub.SubscribeServer(client, payload.ServerID)
+		}
+
+	case EventAck:
+		// Mark a channel as read up to a message
+		var payload struct {
+			ChannelID string `json:"channel_id"`
+			MessageID string `json:"message_id"`
+		}
+		json.Unmarshal(msg.Data, &payload)
+
+		channelID, err := uuid.Parse(payload.ChannelID)
+		if err != nil {
+			return
+		}
+		messageID, err := uuid.Parse(payload.MessageID)
+		if err != nil {
+			return
+		}
+		if !access.CanAccessChannel(client.ID, channelID) {
+			return
 		}
+		AckMessage(client.ID, channelID, messageID)
 
 	case EventTyping:
 		// Broadcast typing indicator to channel
@@ -471,14 +640,31 @@ func handleClientMessage(hub *Hub, client *Client, msg *WSMessage) {
 		}
 
 		hub.SendToUser(targetID, msg.Event, map[string]interface{}{
-			"from_user_id": client.ID,
+			"from_user_id":  client.ID,
 			"from_username": client.Username,
-			"signal":       payload.Signal,
-			"channel_id":   payload.ChannelID,
+			"signal":        payload.Signal,
+			"channel_id":    payload.ChannelID,
 		})
 
+	case EventVoiceUpdate:
+		// Change the user's own mute, deafen, streaming and video flags
+		var update VoiceStateUpdate
+		if err := json.Unmarshal(msg.Data, &update); err != nil {
+			return
+		}
+		// Whichever session sends updates is the one the user is in voice from
+		update.SessionID = &client.SessionID
+		UpdateVoiceState(client.ID, update)
+
+	case EventSFUJoin, EventSFUAnswer, EventSFUICE, EventSFULayer, EventSFULeave:
+		// Signaling with the server's own peer connection for this session
+		if SFU != nil {
+			SFU.HandleSignal(client, msg.Event, msg.Data)
+		}
+
 	case EventDMCallRing, EventDMCallAccept, EventDMCallReject, EventDMCallEnd:
-		// Relay DM call events to target user
+		// Relay DM call events to every other participant of the DM.
+		// Older clients that only send target_user_id still reach that one user.
 		var payload struct {
 			TargetUserID string `json:"target_user_id"`
 			DMChannelID  string `json:"dm_channel_id"`
@@ -486,16 +672,25 @@ func handleClientMessage(hub *Hub, client *Client, msg *WSMessage) {
 		}
 		json.Unmarshal(msg.Data, &payload)
 
-		targetID, err := uuid.Parse(payload.TargetUserID)
-		if err != nil {
-			return
+		var targetIDs []uuid.UUID
+		if dmChannelID, err := uuid.Parse(payload.DMChannelID); err == nil {
+			if !access.CanAccessChannel(client.ID, dmChannelID) {
+				return
+			}
+			database.DB.Model(&models.DMParticipant{}).
+				Where("dm_channel_id = ? AND user_id != ?", dmChannelID, client.ID).
+				Pluck("user_id", &targetIDs)
+		} else if targetID, err := uuid.Parse(payload.TargetUserID); err == nil {
+			targetIDs = append(targetIDs, targetID)
 		}
 
-		hub.SendToUser(targetID, msg.Event, map[string]interface{}{
-			"from_user_id":  client.ID,
-			"from_username": client.Username,
-			"dm_channel_id": payload.DMChannelID,
-			"call_type":     payload.CallType,
-		})
+		for _, targetID := range targetIDs {
+			hub.SendToUser(targetID, msg.Event, map[string]interface{}{
+				"from_user_id":  client.ID,
+				"from_username": client.Username,
+				"dm_channel_id": payload.DMChannelID,
+				"call_type":     payload.CallType,
+			})
+		}
 	}
 }
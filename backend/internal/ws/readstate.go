@@ -0,0 +1,184 @@
+package ws
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// ErrMessageNotFound is returned when acking a message that isn't in the channel
+var ErrMessageNotFound = errors.New("message not found in channel")
+
+// ChannelReadState is a read state along with how many messages are still unread
+type ChannelReadState struct {
+	models.ReadState
+	UnreadCount int64 `json:"unread_count"`
+}
+
+// visibleChannelIDs returns every server channel and DM channel a user can read
+func visibleChannelIDs(userID uuid.UUID) []uuid.UUID {
+	var ids []uuid.UUID
+	database.DB.Model(&models.Channel{}).
+		Where("server_id IN (?)", database.DB.Model(&models.ServerMember{}).Select("server_id").Where("user_id = ?", userID)).
+		Pluck("id", &ids)
+
+	var dmIDs []uuid.UUID
+	database.DB.Model(&models.DMParticipant{}).
+		Where("user_id = ?", userID).
+		Pluck("dm_channel_id", &dmIDs)
+
+	return append(ids, dmIDs...)
+}
+
+// loadReadStates returns read states for every channel the user can see that
+// has either been acked before or has unread messages
+func loadReadStates(userID uuid.UUID) []ChannelReadState {
+	result := []ChannelReadState{}
+	if database.DB == nil {
+		return result
+	}
+
+	channelIDs := visibleChannelIDs(userID)
+	if len(channelIDs) == 0 {
+		return result
+	}
+
+	var states []models.ReadState
+	database.DB.Where("user_id = ? AND channel_id IN ?", userID, channelIDs).Find(&states)
+
+	var unread []struct {
+		ChannelID uuid.UUID
+		Count     int64
+	}
+	database.DB.Table("messages AS m").
+		Select("m.channel_id, COUNT(*) AS count").
+		Joins("LEFT JOIN read_states rs ON rs.channel_id = m.channel_id AND rs.user_id = ?", userID).
+		Where("m.channel_id IN ? AND m.deleted_at IS NULL AND m.author_id != ?", channelIDs, userID).
+		Where("m.visible_to_id IS NULL OR m.visible_to_id = ?", userID).
+		Where("m.expires_at IS NULL OR m.expires_at > ?", time.Now()).
+		Where("rs.last_message_at IS NULL OR m.created_at > rs.last_message_at").
+		Group("m.channel_id").
+		Scan(&unread)
+
+	unreadByChannel := make(map[uuid.UUID]int64, len(unread))
+	for _, row := range unread {
+		unreadByChannel[row.ChannelID] = row.Count
+	}
+
+	for _, state := range states {
+		result = append(result, ChannelReadState{
+			ReadState:   state,
+			UnreadCount: unreadByChannel[state.ChannelID],
+		})
+		delete(unreadByChannel, state.ChannelID)
+	}
+
+	// Channels that were never acked but have messages
+	for channelID, count := range unreadByChannel {
+		result = append(result, ChannelReadState{
+			ReadState:   models.ReadState{UserID: userID, ChannelID: channelID},
+			UnreadCount: count,
+		})
+	}
+
+	return result
+}
+
+// AckMessage marks a channel as read up to (and including) a message and syncs
+// the new read state to all of the user's sessions with a MESSAGE_ACK event.
+// Acking an older message moves the read marker back, marking later messages unread.
+// Callers must check that the user can access the channel.
+func AckMessage(userID, channelID, messageID uuid.UUID) (*ChannelReadState, error) {
+	var msg models.Message
+	if err := database.DB.Where("visible_to_id IS NULL OR visible_to_id = ?", userID).
+		First(&msg, "id = ? AND channel_id = ?", messageID, channelID).Error; err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	// Mentions up to the acked message count as read, later ones don't
+	readMessages := database.DB.Model(&models.Message{}).Select("id").
+		Where("channel_id = ? AND created_at <= ?", channelID, msg.CreatedAt)
+	database.DB.Model(&models.Mention{}).
+		Where("user_id = ? AND channel_id = ? AND message_id IN (?)", userID, channelID, readMessages).
+		Update("is_read", true)
+	database.DB.Model(&models.Mention{}).
+		Where("user_id = ? AND channel_id = ? AND message_id NOT IN (?)", userID, channelID, readMessages).
+		Update("is_read", false)
+
+	var mentionCount int64
+	database.DB.Model(&models.Mention{}).
+		Where("user_id = ? AND channel_id = ? AND is_read = ?", userID, channelID, false).
+		Count(&mentionCount)
+
+	var state models.ReadState
+	err := database.DB.Where("user_id = ? AND channel_id = ?", userID, channelID).First(&state).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	previousReadAt := state.LastMessageAt
+
+	state.UserID = userID
+	state.ChannelID = channelID
+	state.LastMessageID = &msg.ID
+	state.LastMessageAt = &msg.CreatedAt
+	state.MentionCount = int(mentionCount)
+	// Anything read has also been delivered
+	if state.DeliveredAt == nil || state.DeliveredAt.Before(msg.CreatedAt) {
+		state.DeliveredAt = &msg.CreatedAt
+	}
+	if err := database.DB.Save(&state).Error; err != nil {
+		return nil, err
+	}
+
+	if isDMChannel(channelID) {
+		sendReadReceipts(userID, channelID, previousReadAt, msg.CreatedAt)
+	}
+
+	var unreadCount int64
+	database.DB.Model(&models.Message{}).
+		Where("channel_id = ? AND created_at > ? AND author_id != ?", channelID, msg.CreatedAt, userID).
+		Where("visible_to_id IS NULL OR visible_to_id = ?", userID).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Count(&unreadCount)
+
+	result := &ChannelReadState{ReadState: state, UnreadCount: unreadCount}
+
+	// Keep the user's other devices in sync
+	if GlobalHub != nil {
+		GlobalHub.SendToUser(userID, EventMessageAck, result)
+	}
+
+	return result, nil
+}
+
+// IncrementMentionCounts bumps the unread mention counter of each user's read state for a channel
+func IncrementMentionCounts(channelID uuid.UUID, userIDs []uuid.UUID) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	states := make([]models.ReadState, 0, len(userIDs))
+	for _, userID := range userIDs {
+		states = append(states, models.ReadState{
+			UserID:       userID,
+			ChannelID:    channelID,
+			MentionCount: 1,
+			UpdatedAt:    time.Now(),
+		})
+	}
+
+	database.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "channel_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"mention_count": gorm.Expr("read_states.mention_count + 1"),
+			"updated_at":    time.Now(),
+		}),
+	}).Create(&states)
+}
@@ -0,0 +1,102 @@
+package ws
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// isDMChannel reports whether a channel ID belongs to a DM channel
+func isDMChannel(channelID uuid.UUID) bool {
+	var count int64
+	database.DB.Model(&models.DMChannel{}).Where("id = ?", channelID).Count(&count)
+	return count > 0
+}
+
+// receiptSharingUsers filters a list of users down to those who share receipts
+func receiptSharingUsers(userIDs []uuid.UUID) []uuid.UUID {
+	var ids []uuid.UUID
+	database.DB.Model(&models.User{}).
+		Where("id IN ? AND send_receipts = ?", userIDs, true).
+		Pluck("id", &ids)
+	return ids
+}
+
+// MarkDelivered moves each user's delivered marker forward to a DM message that
+// reached one of their sessions. If the author asked for receipts, they get a
+// MESSAGE_RECEIPT for every recipient who shares receipts.
+func MarkDelivered(msg *models.Message, userIDs []uuid.UUID) {
+	if database.DB == nil || len(userIDs) == 0 {
+		return
+	}
+
+	for _, userID := range userIDs {
+		deliveredAt := msg.CreatedAt
+		database.DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "channel_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"delivered_at": deliveredAt}),
+			Where: clause.Where{Exprs: []clause.Expression{
+				gorm.Expr("read_states.delivered_at IS NULL OR read_states.delivered_at < ?", deliveredAt),
+			}},
+		}).Create(&models.ReadState{
+			UserID:      userID,
+			ChannelID:   msg.ChannelID,
+			DeliveredAt: &deliveredAt,
+			UpdatedAt:   time.Now(),
+		})
+	}
+
+	if !msg.RequestReceipts || GlobalHub == nil {
+		return
+	}
+
+	for _, userID := range receiptSharingUsers(userIDs) {
+		if userID == msg.AuthorID {
+			continue
+		}
+		GlobalHub.SendToUser(msg.AuthorID, EventMessageReceipt, map[string]interface{}{
+			"channel_id":  msg.ChannelID,
+			"user_id":     userID,
+			"status":      "delivered",
+			"message_ids": []uuid.UUID{msg.ID},
+		})
+	}
+}
+
+// sendReadReceipts tells authors that a reader has now read their receipt-requesting
+// DM messages created after the previous read marker and up to the new one
+func sendReadReceipts(readerID, channelID uuid.UUID, previous *time.Time, current time.Time) {
+	if GlobalHub == nil || len(receiptSharingUsers([]uuid.UUID{readerID})) == 0 {
+		return
+	}
+
+	query := database.DB.Where(
+		"channel_id = ? AND request_receipts = ? AND author_id != ? AND created_at <= ?",
+		channelID, true, readerID, current,
+	)
+	if previous != nil {
+		query = query.Where("created_at > ?", *previous)
+	}
+
+	var messages []models.Message
+	query.Select("id", "author_id").Find(&messages)
+
+	byAuthor := map[uuid.UUID][]uuid.UUID{}
+	for _, m := range messages {
+		byAuthor[m.AuthorID] = append(byAuthor[m.AuthorID], m.ID)
+	}
+
+	for authorID, messageIDs := range byAuthor {
+		GlobalHub.SendToUser(authorID, EventMessageReceipt, map[string]interface{}{
+			"channel_id":  channelID,
+			"user_id":     readerID,
+			"status":      "read",
+			"message_ids": messageIDs,
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/shitcord/backend/internal/database"
+	"github.com/shitcord/backend/internal/eventhooks"
+	"github.com/shitcord/backend/internal/models"
+)
+
+// ErrNotInVoice is returned when updating the voice state of a user who isn't in a voice channel
+var ErrNotInVoice = errors.New("not in a voice channel")
+
+// VoiceStateUpdate changes the flags a user sets on their own voice state. Fields left out
+// are unchanged.
+type VoiceStateUpdate struct {
+	IsMuted     *bool `json:"is_muted"`
+	IsDeafened  *bool `json:"is_deafened"`
+	IsStreaming *bool `json:"is_streaming"`
+	IsVideo     *bool `json:"is_video"`
+
+	SessionID *uuid.UUID `json:"-"` // Gateway session sending the update, which the state is tied to
+}
+
+// UpdateVoiceState applies an update to a user's voice state and broadcasts the result to
+// the voice channel, including the user's own sessions
+func UpdateVoiceState(userID uuid.UUID, update VoiceStateUpdate) (*models.VoiceState, error) {
+	var state models.VoiceState
+	if err := database.DB.First(&state, "user_id = ?", userID).Error; err != nil {
+		return nil, ErrNotInVoice
+	}
+
+	changes := map[string]interface{}{}
+	if update.IsMuted != nil {
+		changes["is_muted"] = *update.IsMuted
+	}
+	if update.IsDeafened != nil {
+		changes["is_deafened"] = *update.IsDeafened
+	}
+	if update.IsStreaming != nil {
+		changes["is_streaming"] = *update.IsStreaming
+	}
+	if update.IsVideo != nil {
+		changes["is_video"] = *update.IsVideo
+	}
+	if update.SessionID != nil {
+		changes["session_id"] = *update.SessionID
+	}
+	if len(changes) > 0 {
+		if err := database.DB.Model(&state).Updates(changes).Error; err != nil {
+			return nil, err
+		}
+	}
+	database.DB.Preload("User").First(&state, "id = ?", state.ID)
+
+	if GlobalHub != nil {
+		GlobalHub.BroadcastToChannel(state.ChannelID.String(), EventVoiceUpdate, map[string]interface{}{
+			"channel_id":  state.ChannelID,
+			"server_id":   state.ServerID,
+			"voice_state": state,
+		}, uuid.Nil)
+	}
+	return &state, nil
+}
+
+// RemoveVoiceState takes a user out of their voice channel and tells the channel they left
+func RemoveVoiceState(state *models.VoiceState, excludeID uuid.UUID) {
+	database.DB.Delete(state)
+	eventhooks.Emit(state.ServerID, state.ChannelID.String(), eventhooks.EventVoiceLeave, map[string]interface{}{
+		"channel_id": state.ChannelID,
+		"server_id":  state.ServerID,
+		"user_id":    state.UserID,
+	})
+	if GlobalHub != nil {
+		GlobalHub.BroadcastToChannel(state.ChannelID.String(), EventVoiceLeave, map[string]interface{}{
+			"channel_id": state.ChannelID,
+			"user_id":    state.UserID,
+		}, excludeID)
+	}
+}
+
+// VoiceModeration is what a moderator changes about someone else's voice state. Fields left
+// out are unchanged.
+type VoiceModeration struct {
+	ServerMuted    *bool      `json:"server_muted"`
+	ServerDeafened *bool      `json:"server_deafened"`
+	ChannelID      *uuid.UUID `json:"channel_id"` // Voice channel of the same server to move the user to
+}
+
+// ModerateVoiceState applies a moderator's changes to a voice state and broadcasts them.
+// Server mute and deafen are also kept on the membership, so they apply again on every join.
+// A move is a leave from the old channel and a join to the new one. The user is sent
+// VOICE_STATE_FORCED with the resulting state.
+func ModerateVoiceState(state *models.VoiceState, mod VoiceModeration, moderatorID uuid.UUID) (*models.VoiceState, error) {
+	from := state.ChannelID
+	changes := map[string]interface{}{}
+	if mod.ServerMuted != nil {
+		changes["server_muted"] = *mod.ServerMuted
+	}
+	if mod.ServerDeafened != nil {
+		changes["server_deafened"] = *mod.ServerDeafened
+	}
+	if len(changes) > 0 {
+		if err := database.DB.Model(&models.ServerMember{}).
+			Where("user_id = ? AND server_id = ?", state.UserID, state.ServerID).
+			Updates(changes).Error; err != nil {
+			return nil, err
+		}
+	}
+	if mod.ChannelID != nil && *mod.ChannelID != from {
+		changes["channel_id"] = *mod.ChannelID
+	}
+	if len(changes) > 0 {
+		if err := database.DB.Model(state).Updates(changes).Error; err != nil {
+			return nil, err
+		}
+	}
+	database.DB.Preload("User").First(state, "id = ?", state.ID)
+
+	if state.ChannelID != from {
+		leave := map[string]interface{}{
+			"channel_id": from,
+			"server_id":  state.ServerID,
+			"user_id":    state.UserID,
+		}
+		join := map[string]interface{}{
+			"channel_id":  state.ChannelID,
+			"server_id":   state.ServerID,
+			"voice_state": state,
+		}
+		eventhooks.Emit(state.ServerID, from.String(), eventhooks.EventVoiceLeave, leave)
+		eventhooks.Emit(state.ServerID, state.ChannelID.String(), eventhooks.EventVoiceJoin, join)
+		if GlobalHub != nil {
+			GlobalHub.BroadcastToChannel(from.String(), EventVoiceLeave, leave, uuid.Nil)
+			GlobalHub.BroadcastToChannel(state.ChannelID.String(), EventVoiceJoin, join, uuid.Nil)
+		}
+	} else if GlobalHub != nil {
+		GlobalHub.BroadcastToChannel(state.ChannelID.String(), EventVoiceUpdate, map[string]interface{}{
+			"channel_id":  state.ChannelID,
+			"server_id":   state.ServerID,
+			"voice_state": state,
+		}, uuid.Nil)
+	}
+
+	forceVoiceState(state.UserID, state.ServerID, state, moderatorID)
+	return state, nil
+}
+
+// DisconnectVoiceState takes a user out of voice on a moderator's behalf and tells them with
+// VOICE_STATE_FORCED
+func DisconnectVoiceState(state *models.VoiceState, moderatorID uuid.UUID) {
+	RemoveVoiceState(state, uuid.Nil)
+	forceVoiceState(state.UserID, state.ServerID, nil, moderatorID)
+}
+
+// forceVoiceState sends a user the voice state a moderator left them with, nil if they were
+// disconnected, so their client can follow it
+func forceVoiceState(userID, serverID uuid.UUID, state *models.VoiceState, moderatorID uuid.UUID) {
+	if GlobalHub == nil {
+		return
+	}
+	GlobalHub.SendToUser(userID, EventVoiceForced, map[string]interface{}{
+		"server_id":    serverID,
+		"voice_state":  state,
+		"moderator_id": moderatorID,
+	})
+}
+
+// voiceDisconnectGrace returns how long a user stays in voice after losing their session:
+// VOICE_DISCONNECT_GRACE_SECONDS, 30 seconds by default
+func voiceDisconnectGrace() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("VOICE_DISCONNECT_GRACE_SECONDS")); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// voiceSessionClosed starts the grace period after which a user is taken out of voice, if
+// the session their voice state is tied to is gone. States not tied to a session wait for
+// the user's last session instead.
+func (h *Hub) voiceSessionClosed(userID uuid.UUID) {
+	if database.DB == nil {
+		return
+	}
+	var state models.VoiceState
+	if err := database.DB.First(&state, "user_id = ?", userID).Error; err != nil || h.inVoiceSession(&state) {
+		return
+	}
+
+	// Holding the lock until the timer is stored keeps it from firing first
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if timer := h.voiceTimers[userID]; timer != nil {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(voiceDisconnectGrace(), func() {
+		h.mu.Lock()
+		if h.voiceTimers[userID] == timer {
+			delete(h.voiceTimers, userID)
+		}
+		h.mu.Unlock()
+		h.removeStaleVoiceState(userID)
+	})
+	h.voiceTimers[userID] = timer
+}
+
+// inVoiceSession reports whether the session a voice state is tied to is connected, or any of
+// the user's sessions for states not tied to one
+func (h *Hub) inVoiceSession(state *models.VoiceState) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients[state.UserID] {
+		if state.SessionID == nil || c.SessionID == *state.SessionID {
+			return true
+		}
+	}
+	return false
+}
+
+// removeStaleVoiceState takes a user out of voice unless their session came back in time
+func (h *Hub) removeStaleVoiceState(userID uuid.UUID) {
+	var state models.VoiceState
+	if err := database.DB.First(&state, "user_id = ?", userID).Error; err != nil || h.inVoiceSession(&state) {
+		return
+	}
+
+	log.Printf("Removing %s from voice channel %s after their session disconnected", userID, state.ChannelID)
+	RemoveVoiceState(&state, uuid.Nil)
+}
@@ -117,21 +117,69 @@ export const dmAPI = {
   createDM: (recipientId: string) => api.post('/dms', { recipient_id: recipientId }),
 }
 
+// Files above this size use the resumable (tus) endpoint, sent in chunks of the same size
+const RESUMABLE_CHUNK_SIZE = 8 * 1024 * 1024
+const TUS_HEADERS = { 'Tus-Resumable': '1.0.0' }
+
 // Upload API
 export const uploadAPI = {
-  uploadFile: (file: File) => {
+  uploadFile: (file: File, channelId?: string, onProgress?: (progress: number) => void) => {
+    if (file.size > RESUMABLE_CHUNK_SIZE) {
+      return uploadAPI.uploadResumable(file, channelId, onProgress)
+    }
     const formData = new FormData()
     formData.append('file', file)
+    if (channelId) formData.append('channel_id', channelId)
     return api.post('/upload', formData, {
       headers: { 'Content-Type': 'multipart/form-data' },
+      onUploadProgress: (e) => e.total && onProgress?.(e.loaded / e.total),
+    })
+  },
+
+  // Uploads a file in chunks, picking up from the server's offset when a chunk fails
+  uploadResumable: async (file: File, channelId?: string, onProgress?: (progress: number) => void) => {
+    const metadata = [`filename ${btoa(unescape(encodeURIComponent(file.name)))}`]
+    if (channelId) metadata.push(`channel_id ${btoa(channelId)}`)
+
+    const created = await api.post('/upload/resumable', null, {
+      headers: { ...TUS_HEADERS, 'Upload-Length': String(file.size), 'Upload-Metadata': metadata.join(',') },
     })
+    const location = (created.headers['location'] as string).replace(/^\/api\/v1/, '')
+
+    let offset = 0
+    let failures = 0
+    while (offset < file.size) {
+      try {
+        const res = await api.patch(location, file.slice(offset, offset + RESUMABLE_CHUNK_SIZE), {
+          headers: { ...TUS_HEADERS, 'Upload-Offset': String(offset), 'Content-Type': 'application/offset+octet-stream' },
+        })
+        offset = Number(res.headers['upload-offset'])
+        failures = 0
+        onProgress?.(offset / file.size)
+      } catch (err) {
+        // Only retry when the server might have missed the chunk, not when it rejected the file
+        const status = (err as { response?: { status: number } }).response?.status
+        if ((status && status < 500 && status !== 409 && status !== 423) || ++failures > 5) throw err
+        await new Promise((resolve) => setTimeout(resolve, 1000 * failures))
+        const head = await api.head(location, { headers: TUS_HEADERS })
+        offset = Number(head.headers['upload-offset'])
+      }
+    }
+
+    const { data } = await api.get(location)
+    return { data: data.attachment }
   },
 }
 
 // Voice API
 export const voiceAPI = {
-  joinVoice: (channelId: string) => api.post(`/voice/join/${channelId}`),
+  joinVoice: (channelId: string, sessionId?: string | null) =>
+    api.post(`/voice/join/${channelId}`, { session_id: sessionId ?? undefined }),
   leaveVoice: (channelId: string) => api.post(`/voice/leave/${channelId}`),
+  moderateMember: (serverId: string, userId: string, data: { server_muted?: boolean; server_deafened?: boolean; channel_id?: string }) =>
+    api.patch(`/servers/${serverId}/voice/${userId}`, data),
+  disconnectMember: (serverId: string, userId: string) =>
+    api.delete(`/servers/${serverId}/voice/${userId}`),
 }
 
 // Admin API
@@ -5,7 +5,7 @@ import { messageAPI, uploadAPI, dmAPI, serverAPI } from '../api/client'
 import { wsService } from '../services/websocket'
 import { ringToneService } from '../services/ringtone'
 import { encryptionService } from '../services/encryption'
-import type { Message } from '../types'
+import type { Attachment, Message } from '../types'
 
 export default function ChatArea({ onMobileMenuToggle }: { onMobileMenuToggle?: () => void }) {
   const { currentServer, currentChannel, currentDMChannel, messages, setMessages, addMessage, typingUsers, activeDMCall, setActiveDMCall, members, setMembers, onlineUsers } = useChatStore()
@@ -14,6 +14,7 @@ export default function ChatArea({ onMobileMenuToggle }: { onMobileMenuToggle?:
   const [loading, setLoading] = useState(false)
   const [sending, setSending] = useState(false)
   const [uploading, setUploading] = useState(false)
+  const [uploadProgress, setUploadProgress] = useState(0)
   const [showMembers, setShowMembers] = useState(false)
   const [pendingFile, setPendingFile] = useState<{ file: File; previewUrl?: string } | null>(null)
   const [dragOver, setDragOver] = useState(false)
@@ -117,8 +118,9 @@ export default function ChatArea({ onMobileMenuToggle }: { onMobileMenuToggle?:
       // Upload file if pending
       if (pendingFile) {
         setUploading(true)
+        setUploadProgress(0)
         try {
-          const { data: uploadData } = await uploadAPI.uploadFile(pendingFile.file)
+          const { data: uploadData } = await uploadAPI.uploadFile(pendingFile.file, channelId, setUploadProgress)
           attachmentUrl = uploadData.url
           msgType = uploadData.type // image, video, audio, file
         } catch (err) {
@@ -420,7 +422,7 @@ export default function ChatArea({ onMobileMenuToggle }: { onMobileMenuToggle?:
             onClick={handleSendMessage}
             disabled={(!messageInput.trim() && !pendingFile) || sending || uploading}
           >
-            {uploading ? '⏳' : '➤'}
+            {uploading ? (uploadProgress > 0 ? `${Math.round(uploadProgress * 100)}%` : '⏳') : '➤'}
           </button>
         </div>
       </div>
@@ -552,7 +554,11 @@ function MessageItem({
 
         {/* Attachment rendering */}
         {message.attachment_url && (
-          <AttachmentRender url={message.attachment_url} type={message.type} />
+          <AttachmentRender
+            url={message.attachment_signed_url || message.attachment_url}
+            type={message.type}
+            attachment={message.attachment}
+          />
         )}
       </div>
 
@@ -592,12 +598,20 @@ function MessageItem({
 }
 
 // Render file attachments inline
-function AttachmentRender({ url, type }: { url: string; type: string }) {
+function AttachmentRender({ url, type, attachment }: { url: string; type: string; attachment?: Attachment }) {
   if (type === 'image') {
+    // Show the largest thumbnail if there is one, sized up front so the chat doesn't jump
+    const thumb = attachment?.thumbnails?.[attachment.thumbnails.length - 1]
     return (
       <div className="attachment-image">
         <a href={url} target="_blank" rel="noopener noreferrer">
-          <img src={url} alt="attachment" loading="lazy" />
+          <img
+            src={thumb ? thumb.signed_url || thumb.url : url}
+            alt="attachment"
+            loading="lazy"
+            width={thumb?.width ?? attachment?.width}
+            height={thumb?.height ?? attachment?.height}
+          />
         </a>
       </div>
     )
@@ -7,12 +7,15 @@ import { wsService } from '../services/websocket'
 import type { VoiceState } from '../types'
 
 export default function VoiceChannel({ onMobileMenuToggle }: { onMobileMenuToggle?: () => void }) {
-  const { currentChannel, setCurrentChannel } = useChatStore()
+  const { currentServer, currentChannel, setCurrentChannel } = useChatStore()
   const { user } = useAuthStore()
   const [isConnected, setIsConnected] = useState(false)
   const [isMuted, setIsMuted] = useState(false)
   const [isVideoOff, setIsVideoOff] = useState(false)
   const [isScreenSharing, setIsScreenSharing] = useState(false)
+  const [serverMuted, setServerMuted] = useState(false)
+  const [serverDeafened, setServerDeafened] = useState(false)
+  const [moveTarget, setMoveTarget] = useState<string | null>(null)
   const [participants, setParticipants] = useState<VoiceState[]>([])
   const [remoteStreams, setRemoteStreams] = useState<Map<string, MediaStream>>(new Map())
   const localVideoRef = useRef<HTMLVideoElement>(null)
@@ -59,35 +62,102 @@ export default function VoiceChannel({ onMobileMenuToggle }: { onMobileMenuToggl
       }
     }
 
+    const handleVoiceUpdate = (data: unknown) => {
+      const { channel_id, voice_state } = data as { channel_id: string; voice_state: VoiceState }
+      if (channel_id === currentChannel.id) {
+        setParticipants((prev) => prev.map((p) => (p.user_id === voice_state.user_id ? voice_state : p)))
+      }
+    }
+
     wsService.on('VOICE_STATE_JOIN', handleVoiceJoin)
     wsService.on('VOICE_STATE_LEAVE', handleVoiceLeave)
+    wsService.on('VOICE_STATE_UPDATE', handleVoiceUpdate)
     return () => {
       wsService.off('VOICE_STATE_JOIN', handleVoiceJoin)
       wsService.off('VOICE_STATE_LEAVE', handleVoiceLeave)
+      wsService.off('VOICE_STATE_UPDATE', handleVoiceUpdate)
     }
   }, [currentChannel])
 
+  // The server takes us out of voice if the session we joined from stays disconnected, so
+  // claim the voice state for the new session after a reconnect
+  useEffect(() => {
+    if (!isConnected) return
+
+    const handleReady = () => {
+      wsService.sendVoiceStateUpdate({ is_muted: isMuted, is_streaming: isScreenSharing })
+    }
+
+    wsService.on('READY', handleReady)
+    return () => wsService.off('READY', handleReady)
+  }, [isConnected, isMuted, isScreenSharing])
+
+  // Follow what moderators do to our voice state: server mute and deafen, moves and disconnects
+  useEffect(() => {
+    if (!currentChannel || !isConnected) return
+
+    const handleForced = (data: unknown) => {
+      const { voice_state } = data as { voice_state: VoiceState | null }
+      if (!voice_state || voice_state.channel_id !== currentChannel.id) {
+        webrtcService.leaveChannel()
+        setIsConnected(false)
+        setRemoteStreams(new Map())
+        setParticipants([])
+        setServerMuted(false)
+        setServerDeafened(false)
+
+        // Moved: reconnect in the new channel
+        const channel = voice_state && currentServer?.channels.find((c) => c.id === voice_state.channel_id)
+        if (channel) {
+          setMoveTarget(channel.id)
+          setCurrentChannel(channel)
+        }
+        return
+      }
+
+      setServerMuted(voice_state.server_muted)
+      setServerDeafened(voice_state.server_deafened)
+      if (voice_state.server_muted) {
+        webrtcService.setMuted(true)
+        setIsMuted(true)
+      }
+    }
+
+    wsService.on('VOICE_STATE_FORCED', handleForced)
+    return () => wsService.off('VOICE_STATE_FORCED', handleForced)
+  }, [currentChannel, currentServer, isConnected, setCurrentChannel])
+
   const handleJoin = async () => {
     if (!currentChannel) return
 
     try {
       // Join voice channel via API
-      const { data } = await voiceAPI.joinVoice(currentChannel.id)
+      const { data } = await voiceAPI.joinVoice(currentChannel.id, wsService.getSessionId())
       setParticipants(data.participants)
+      setServerMuted(data.voice_state.server_muted)
+      setServerDeafened(data.voice_state.server_deafened)
 
       // Start WebRTC
       const localStream = await webrtcService.joinChannel(currentChannel.id, {
         audio: true,
         video: isVideoChannel,
-      })
+      }, data.sfu)
+
+      if (isVideoChannel) {
+        wsService.sendVoiceStateUpdate({ is_video: true })
+      }
+      if (data.voice_state.server_muted) {
+        webrtcService.setMuted(true)
+        setIsMuted(true)
+      }
 
       // Show local video
       if (localVideoRef.current) {
         localVideoRef.current.srcObject = localStream
       }
 
-      // Connect to existing participants
-      for (const p of data.participants as VoiceState[]) {
+      // Connect to existing participants, unless the SFU relays them
+      for (const p of data.sfu ? [] : data.participants as VoiceState[]) {
         if (p.user_id !== user?.id) {
           await webrtcService.callUser(p.user_id, p.user?.username || '')
         }
@@ -100,6 +170,13 @@ export default function VoiceChannel({ onMobileMenuToggle }: { onMobileMenuToggl
     }
   }
 
+  useEffect(() => {
+    if (moveTarget && currentChannel?.id === moveTarget) {
+      setMoveTarget(null)
+      handleJoin()
+    }
+  }, [moveTarget, currentChannel])
+
   const handleLeave = async () => {
     if (!currentChannel) return
 
@@ -111,19 +188,23 @@ export default function VoiceChannel({ onMobileMenuToggle }: { onMobileMenuToggl
   }
 
   const handleToggleMute = () => {
+    if (serverMuted) return
     const muted = webrtcService.toggleMute()
     setIsMuted(muted)
+    wsService.sendVoiceStateUpdate({ is_muted: muted })
   }
 
   const handleToggleVideo = () => {
     const videoOff = webrtcService.toggleVideo()
     setIsVideoOff(videoOff)
+    wsService.sendVoiceStateUpdate({ is_video: !videoOff })
   }
 
   const handleToggleScreenShare = async () => {
     if (isScreenSharing) {
       webrtcService.stopScreenShare()
       setIsScreenSharing(false)
+      wsService.sendVoiceStateUpdate({ is_streaming: false })
       // Update local preview back to camera
       if (localVideoRef.current && webrtcService.getLocalStream()) {
         localVideoRef.current.srcObject = webrtcService.getLocalStream()
@@ -132,6 +213,7 @@ export default function VoiceChannel({ onMobileMenuToggle }: { onMobileMenuToggl
       try {
         const screenStream = await webrtcService.startScreenShare()
         setIsScreenSharing(true)
+        wsService.sendVoiceStateUpdate({ is_streaming: true })
         // Update local preview to show screen
         if (localVideoRef.current) {
           localVideoRef.current.srcObject = webrtcService.getLocalStream()
@@ -139,6 +221,7 @@ export default function VoiceChannel({ onMobileMenuToggle }: { onMobileMenuToggl
         // Auto-revert state when user stops via browser button
         screenStream.getVideoTracks()[0].addEventListener('ended', () => {
           setIsScreenSharing(false)
+          wsService.sendVoiceStateUpdate({ is_streaming: false })
           if (localVideoRef.current && webrtcService.getLocalStream()) {
             localVideoRef.current.srcObject = webrtcService.getLocalStream()
           }
@@ -222,6 +305,7 @@ export default function VoiceChannel({ onMobileMenuToggle }: { onMobileMenuToggl
               <span className="participant-name">
                 {user?.display_name || user?.username} (You)
                 {isMuted && ' 🔇'}
+                {serverDeafened && ' 🎧'}
               </span>
             </div>
 
@@ -232,6 +316,7 @@ export default function VoiceChannel({ onMobileMenuToggle }: { onMobileMenuToggl
                 userId={userId}
                 stream={stream}
                 isVideo={isVideoChannel}
+                deafened={serverDeafened}
                 participants={participants}
               />
             ))}
@@ -242,7 +327,8 @@ export default function VoiceChannel({ onMobileMenuToggle }: { onMobileMenuToggl
             <button
               className={`btn-mute ${isMuted ? 'active' : ''}`}
               onClick={handleToggleMute}
-              title={isMuted ? 'Unmute' : 'Mute'}
+              disabled={serverMuted}
+              title={serverMuted ? 'Muted by a moderator' : isMuted ? 'Unmute' : 'Mute'}
             >
               {isMuted ? '🔇' : '🎙️'}
             </button>
@@ -279,11 +365,13 @@ function RemoteParticipant({
   userId,
   stream,
   isVideo,
+  deafened,
   participants,
 }: {
   userId: string
   stream: MediaStream
   isVideo: boolean
+  deafened: boolean
   participants: VoiceState[]
 }) {
   const videoRef = useRef<HTMLVideoElement>(null)
@@ -300,7 +388,7 @@ function RemoteParticipant({
   return (
     <div className="voice-participant">
       {isVideo ? (
-        <video ref={videoRef} autoPlay playsInline />
+        <video ref={videoRef} autoPlay playsInline muted={deafened} />
       ) : (
         <div style={{
           width: '80px',
@@ -316,7 +404,12 @@ function RemoteParticipant({
           {name[0].toUpperCase()}
         </div>
       )}
-      <span className="participant-name">{name}</span>
+      <span className="participant-name">
+        {name}
+        {(participant?.is_muted || participant?.server_muted) && ' 🔇'}
+        {(participant?.is_deafened || participant?.server_deafened) && ' 🎧'}
+        {participant?.is_streaming && ' 🖥️'}
+      </span>
     </div>
   )
 }
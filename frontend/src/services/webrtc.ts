@@ -3,6 +3,9 @@
  * 
  * Manages peer-to-peer audio/video connections for voice and video calls.
  * Uses the WebSocket service for signaling (offer/answer/ICE exchange).
+ *
+ * When the server runs its SFU, voice channels instead use a single connection
+ * to the server, which forwards everyone else's audio and video over it.
  */
 
 import { wsService } from './websocket'
@@ -18,6 +21,13 @@ export interface PeerConnection {
 
 type StreamHandler = (userId: string, stream: MediaStream) => void
 
+// Simulcast layers sent to the SFU, which forwards one of them to each viewer
+const SIMULCAST_ENCODINGS: RTCRtpEncodingParameters[] = [
+  { rid: 'l', scaleResolutionDownBy: 4, maxBitrate: 150_000 },
+  { rid: 'm', scaleResolutionDownBy: 2, maxBitrate: 500_000 },
+  { rid: 'h', maxBitrate: 1_500_000 },
+]
+
 class WebRTCService {
   private peers: Map<string, PeerConnection> = new Map()
   private localStream: MediaStream | null = null
@@ -32,6 +42,13 @@ class WebRTCService {
     { urls: 'stun:stun.l.google.com:19302' },
     { urls: 'stun:stun1.l.google.com:19302' },
   ]
+  private iceRefreshTimer: ReturnType<typeof setTimeout> | null = null
+
+  // Connection to the server's SFU, when the channel uses it
+  private sfu: RTCPeerConnection | null = null
+  private sfuVideoSender: RTCRtpSender | null = null
+  private sfuStreams: Map<string, MediaStream> = new Map()
+  private pendingSFUCandidates: RTCIceCandidateInit[] = []
 
   constructor() {
     // Listen for WebRTC signaling events
@@ -39,6 +56,10 @@ class WebRTCService {
     wsService.on('WEBRTC_ANSWER', this.handleAnswer.bind(this))
     wsService.on('WEBRTC_ICE_CANDIDATE', this.handleICECandidate.bind(this))
     wsService.on('VOICE_STATE_LEAVE', this.handlePeerLeave.bind(this))
+    wsService.on('SFU_ANSWER', this.handleSFUAnswer.bind(this))
+    wsService.on('SFU_OFFER', this.handleSFUOffer.bind(this))
+    wsService.on('SFU_ICE_CANDIDATE', this.handleSFUICECandidate.bind(this))
+    wsService.on('SFU_ERROR', (data) => console.error('SFU error:', (data as { error: string }).error))
 
     // Fetch ICE server config (TURN/STUN) from backend
     this.fetchICEServers()
@@ -59,6 +80,16 @@ class WebRTCService {
         if (data.ice_servers && data.ice_servers.length > 0) {
           this.iceServers = data.ice_servers
           console.log('✓ ICE servers loaded from backend:', this.iceServers.length, 'servers')
+          // Calls in progress use the new credentials if they need to restart ICE
+          this.connections().forEach((connection) => {
+            connection.setConfiguration({ ...connection.getConfiguration(), iceServers: this.iceServers })
+          })
+        }
+        // TURN credentials expire; get new ones well before then while in a channel
+        if (this.iceRefreshTimer) clearTimeout(this.iceRefreshTimer)
+        this.iceRefreshTimer = null
+        if (data.ttl > 0 && this.channelId) {
+          this.iceRefreshTimer = setTimeout(() => this.fetchICEServers(), Math.min(data.ttl * 800, 2 ** 31 - 1))
         }
       }
     } catch (err) {
@@ -81,9 +112,10 @@ class WebRTCService {
   }
 
   /**
-   * Join a voice/video channel
+   * Join a voice/video channel. With sfu set, media goes through the server
+   * rather than to each participant.
    */
-  async joinChannel(channelId: string, options: { audio: boolean; video: boolean }): Promise<MediaStream> {
+  async joinChannel(channelId: string, options: { audio: boolean; video: boolean }, sfu = false): Promise<MediaStream> {
     this.channelId = channelId
 
     // Refresh ICE server config (TURN credentials may be time-limited)
@@ -104,9 +136,103 @@ class WebRTCService {
       } : false,
     })
 
+    if (sfu) {
+      await this.connectSFU()
+    }
+
     return this.localStream
   }
 
+  /**
+   * Connect to the SFU, sending one audio and one simulcast video upstream.
+   * The video transceiver exists even without a camera so screen sharing can
+   * use it without renegotiating.
+   */
+  private async connectSFU(): Promise<void> {
+    if (!this.localStream || !this.channelId) return
+
+    const pc = new RTCPeerConnection({ iceServers: this.iceServers })
+    this.sfu = pc
+    const stream = this.localStream
+    pc.addTransceiver(stream.getAudioTracks()[0] ?? 'audio', { direction: 'sendonly', streams: [stream] })
+    this.sfuVideoSender = pc.addTransceiver(stream.getVideoTracks()[0] ?? 'video', {
+      direction: 'sendonly',
+      streams: [stream],
+      sendEncodings: SIMULCAST_ENCODINGS,
+    }).sender
+
+    pc.onicecandidate = (event) => {
+      if (event.candidate) {
+        wsService.send('SFU_ICE_CANDIDATE', { candidate: event.candidate.toJSON() })
+      }
+    }
+
+    // Each participant's tracks arrive in a stream whose ID is their user ID
+    pc.ontrack = (event) => {
+      const stream = event.streams[0]
+      if (!stream) return
+      this.sfuStreams.set(stream.id, stream)
+      this.onRemoteStream?.(stream.id, stream)
+      this.updateSFULayers()
+    }
+
+    const offer = await pc.createOffer()
+    await pc.setLocalDescription(offer)
+    wsService.send('SFU_JOIN', { channel_id: this.channelId, sdp: pc.localDescription })
+  }
+
+  /**
+   * Ask the SFU for smaller video as the grid fills up
+   */
+  private updateSFULayers(): void {
+    const count = this.sfuStreams.size
+    const layer = count > 4 ? 'l' : count > 1 ? 'm' : 'h'
+    this.sfuStreams.forEach((_stream, userId) => {
+      wsService.send('SFU_SET_LAYER', { user_id: userId, layer })
+    })
+  }
+
+  private async handleSFUAnswer(data: unknown): Promise<void> {
+    const { sdp } = data as { sdp: RTCSessionDescriptionInit }
+    if (!this.sfu) return
+    await this.sfu.setRemoteDescription(sdp)
+    for (const candidate of this.pendingSFUCandidates) {
+      await this.sfu.addIceCandidate(candidate)
+    }
+    this.pendingSFUCandidates = []
+  }
+
+  /**
+   * The SFU offers again whenever participants' tracks come or go
+   */
+  private async handleSFUOffer(data: unknown): Promise<void> {
+    const { sdp } = data as { sdp: RTCSessionDescriptionInit }
+    if (!this.sfu) return
+    await this.sfu.setRemoteDescription(sdp)
+    const answer = await this.sfu.createAnswer()
+    await this.sfu.setLocalDescription(answer)
+    wsService.send('SFU_ANSWER', { sdp: this.sfu.localDescription })
+  }
+
+  private async handleSFUICECandidate(data: unknown): Promise<void> {
+    const { candidate } = data as { candidate: RTCIceCandidateInit }
+    if (!this.sfu) return
+    if (this.sfu.remoteDescription) {
+      await this.sfu.addIceCandidate(candidate)
+    } else {
+      this.pendingSFUCandidates.push(candidate)
+    }
+  }
+
+  /**
+   * All connections local media is sent on
+   */
+  private connections(): RTCPeerConnection[] {
+    const connections = Array.from(this.peers.values()).map((peer) => peer.connection)
+    if (this.sfu) connections.push(this.sfu)
+    return connections
+  }
+
   /**
    * Create a peer connection and send an offer to a user
    */
@@ -142,6 +268,14 @@ class WebRTCService {
     this.pendingICECandidates.clear()
     this.pendingOffer = null
 
+    if (this.sfu) {
+      this.sfu.close()
+      this.sfu = null
+      this.sfuVideoSender = null
+    }
+    this.sfuStreams.clear()
+    this.pendingSFUCandidates = []
+
     // Stop local stream
     if (this.localStream) {
       this.localStream.getTracks().forEach((track) => track.stop())
@@ -149,6 +283,20 @@ class WebRTCService {
     }
 
     this.channelId = null
+    if (this.iceRefreshTimer) {
+      clearTimeout(this.iceRefreshTimer)
+      this.iceRefreshTimer = null
+    }
+  }
+
+  /**
+   * Mute or unmute audio, e.g. when a moderator server-mutes us
+   */
+  setMuted(muted: boolean): void {
+    const audioTrack = this.localStream?.getAudioTracks()[0]
+    if (audioTrack) {
+      audioTrack.enabled = !muted
+    }
   }
 
   /**
@@ -199,6 +347,7 @@ class WebRTCService {
     }
 
     // Replace the video track on every peer connection
+    this.sfuVideoSender?.replaceTrack(screenTrack)
     this.peers.forEach((peer) => {
       const sender = peer.connection.getSenders().find((s) => s.track?.kind === 'video')
       if (sender) {
@@ -235,6 +384,7 @@ class WebRTCService {
 
     // Restore the original camera track on all peers
     if (this.originalVideoTrack) {
+      this.sfuVideoSender?.replaceTrack(this.originalVideoTrack)
       this.peers.forEach((peer) => {
         const sender = peer.connection.getSenders().find((s) => s.track?.kind === 'video' || s.track === screenTrack)
         if (sender) {
@@ -446,6 +596,11 @@ class WebRTCService {
 
   private handlePeerLeave(data: unknown): void {
     const { user_id } = data as { user_id: string }
+    if (this.sfuStreams.delete(user_id)) {
+      this.onPeerDisconnected?.(user_id)
+      this.updateSFULayers()
+      return
+    }
     this.removePeer(user_id)
   }
 
@@ -20,6 +20,7 @@ class WebSocketService {
   private reconnectAttempts = 0
   private maxReconnectAttempts = 10
   private isConnecting = false
+  private sessionId: string | null = null
 
   /**
    * Connect to the WebSocket server
@@ -151,6 +152,20 @@ class WebSocketService {
     this.send('WEBRTC_ICE_CANDIDATE', { target_user_id: targetUserId, signal, channel_id: channelId })
   }
 
+  /**
+   * Update your own mute, deafen, streaming and video flags in a voice channel
+   */
+  sendVoiceStateUpdate(update: { is_muted?: boolean; is_deafened?: boolean; is_streaming?: boolean; is_video?: boolean }): void {
+    this.send('VOICE_STATE_UPDATE', update)
+  }
+
+  /**
+   * ID of the current gateway session, which voice states are tied to
+   */
+  getSessionId(): string | null {
+    return this.sessionId
+  }
+
   /**
    * DM Call signaling
    */
@@ -197,7 +212,8 @@ class WebSocketService {
     switch (msg.event) {
       case 'READY': {
         console.log('✓ WebSocket ready')
-        const readyData = msg.data as { online_users?: string[] }
+        const readyData = msg.data as { session_id?: string; online_users?: string[] }
+        this.sessionId = readyData.session_id ?? null
         if (readyData.online_users) {
           // Seed the online users set with everyone currently connected
           const freshStore = useChatStore.getState()
@@ -48,6 +48,19 @@ export interface Channel {
   created_at: string
 }
 
+export interface Attachment {
+  id: string
+  url: string
+  signed_url?: string
+  filename: string
+  content_type: string
+  size: number
+  type: string
+  width?: number
+  height?: number
+  thumbnails?: Attachment[]
+}
+
 export interface Message {
   id: string
   channel_id: string
@@ -57,6 +70,8 @@ export interface Message {
   encryption_header: string
   type: 'text' | 'image' | 'file' | 'system'
   attachment_url?: string
+  attachment_signed_url?: string
+  attachment?: Attachment
   reply_to_id?: string
   is_edited: boolean
   is_pinned: boolean
@@ -83,6 +98,9 @@ export interface VoiceState {
   is_muted: boolean
   is_deafened: boolean
   is_streaming: boolean
+  is_video: boolean
+  server_muted: boolean
+  server_deafened: boolean
   user?: User
 }
 